@@ -0,0 +1,349 @@
+package admin
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"resonite-file-provider/animxmaker"
+	"resonite-file-provider/authentication"
+	"resonite-file-provider/config"
+	"resonite-file-provider/database"
+	"resonite-file-provider/reply"
+	"resonite-file-provider/upload"
+	"strconv"
+	"strings"
+)
+
+type UserInfo struct {
+	ID           int    `json:"id"`
+	Username     string `json:"username"`
+	Role         string `json:"role"`
+	Disabled     bool   `json:"disabled"`
+	Inventories  int    `json:"inventories"`
+	StorageBytes int64  `json:"storageBytes"`
+}
+
+type InventoryInfo struct {
+	ID           int    `json:"id"`
+	Name         string `json:"name"`
+	StorageBytes int64  `json:"storageBytes"`
+}
+
+// assetSize returns the size of an asset on disk, items are stored with a .brson suffix
+func assetSize(hash string) int64 {
+	var size int64
+	for _, name := range []string{hash, hash + ".brson"} {
+		if info, err := os.Stat(filepath.Join(config.GetConfig().Server.AssetsPath, name)); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+// StorageUse returns the storage used by each inventory of the user and the total.
+// Assets used in several inventories count once towards the total.
+func StorageUse(userId int) (map[int]int64, int64, error) {
+	rows, err := database.Db.Query(`
+		SELECT DISTINCT f.inventory_id, a.hash
+		FROM users_inventories ui
+		INNER JOIN Folders f ON f.inventory_id = ui.inventory_id
+		INNER JOIN Items i ON i.folder_id = f.id
+		INNER JOIN `+"`hash-usage`"+` h ON h.item_id = i.id
+		INNER JOIN Assets a ON a.id = h.asset_id
+		WHERE ui.user_id = ?`, userId)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	perInventory := make(map[int]int64)
+	counted := make(map[string]bool)
+	var total int64
+	for rows.Next() {
+		var inventoryId int
+		var hash string
+		if err := rows.Scan(&inventoryId, &hash); err != nil {
+			return nil, 0, err
+		}
+		size := assetSize(hash)
+		perInventory[inventoryId] += size
+		if !counted[hash] {
+			counted[hash] = true
+			total += size
+		}
+	}
+	return perInventory, total, nil
+}
+
+// targetUser reads the userId parameter and makes sure the user exists
+func targetUser(w http.ResponseWriter, r *http.Request) (int, string, bool) {
+	userId, err := strconv.Atoi(r.URL.Query().Get("userId"))
+	if err != nil {
+		reply.Error(w, r, "userId missing or invalid", http.StatusBadRequest)
+		return -1, "", false
+	}
+	var username string
+	err = database.Db.QueryRow("SELECT username FROM Users WHERE id = ?", userId).Scan(&username)
+	if err == sql.ErrNoRows {
+		reply.Error(w, r, "User not found", http.StatusNotFound)
+		return -1, "", false
+	} else if err != nil {
+		reply.Error(w, r, "Server error", http.StatusInternalServerError)
+		fmt.Println("[ADMIN] Query error:", err)
+		return -1, "", false
+	}
+	return userId, username, true
+}
+
+// handles GET /admin/users
+func listUsers(w http.ResponseWriter, r *http.Request) {
+	claims := authentication.AuthCheck(w, r)
+	if claims == nil || !authentication.RequireAdmin(w, r, claims) {
+		return
+	}
+	rows, err := database.Db.Query(`
+		SELECT u.id, u.username, u.role, u.disabled = 1, COUNT(ui.id)
+		FROM Users u
+		LEFT JOIN users_inventories ui ON ui.user_id = u.id
+		GROUP BY u.id
+		ORDER BY u.id`)
+	if err != nil {
+		reply.Error(w, r, "Server error", http.StatusInternalServerError)
+		fmt.Println("[ADMIN] Query error:", err)
+		return
+	}
+	var users []UserInfo
+	for rows.Next() {
+		var user UserInfo
+		if err := rows.Scan(&user.ID, &user.Username, &user.Role, &user.Disabled, &user.Inventories); err != nil {
+			rows.Close()
+			reply.Error(w, r, "Server error", http.StatusInternalServerError)
+			fmt.Println("[ADMIN] Scan error:", err)
+			return
+		}
+		users = append(users, user)
+	}
+	rows.Close()
+	for i := range users {
+		_, total, err := StorageUse(users[i].ID)
+		if err != nil {
+			reply.Error(w, r, "Server error", http.StatusInternalServerError)
+			fmt.Println("[ADMIN] Storage query error:", err)
+			return
+		}
+		users[i].StorageBytes = total
+	}
+	if strings.HasPrefix(r.UserAgent(), "Resonite") {
+		var ids, disabled, inventories, storage []int
+		var usernames, roles []string
+		for _, user := range users {
+			ids = append(ids, user.ID)
+			usernames = append(usernames, user.Username)
+			roles = append(roles, user.Role)
+			if user.Disabled {
+				disabled = append(disabled, 1)
+			} else {
+				disabled = append(disabled, 0)
+			}
+			inventories = append(inventories, user.Inventories)
+			storage = append(storage, int(user.StorageBytes/1024))
+		}
+		response := animxmaker.Animation{
+			Tracks: []animxmaker.AnimationTrackWrapper{
+				animxmaker.ListTrack(ids, "users", "id"),
+				animxmaker.ListTrack(usernames, "users", "username"),
+				animxmaker.ListTrack(roles, "users", "role"),
+				animxmaker.ListTrack(disabled, "users", "disabled"),
+				animxmaker.ListTrack(inventories, "users", "inventories"),
+				animxmaker.ListTrack(storage, "users", "storageKB"),
+			},
+		}
+		encodedResponse, err := response.EncodeAnimation("response")
+		if err != nil {
+			http.Error(w, "Error while encoding animx", http.StatusInternalServerError)
+			return
+		}
+		w.Write(encodedResponse)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"users":   users,
+		})
+	}
+}
+
+// handles GET /admin/users/inventories?userId=
+func listUserInventories(w http.ResponseWriter, r *http.Request) {
+	claims := authentication.AuthCheck(w, r)
+	if claims == nil || !authentication.RequireAdmin(w, r, claims) {
+		return
+	}
+	userId, _, ok := targetUser(w, r)
+	if !ok {
+		return
+	}
+	perInventory, total, err := StorageUse(userId)
+	if err != nil {
+		reply.Error(w, r, "Server error", http.StatusInternalServerError)
+		fmt.Println("[ADMIN] Storage query error:", err)
+		return
+	}
+	rows, err := database.Db.Query(`
+		SELECT i.id, i.name
+		FROM Inventories i
+		INNER JOIN users_inventories ui ON ui.inventory_id = i.id
+		WHERE ui.user_id = ?
+		ORDER BY i.id`, userId)
+	if err != nil {
+		reply.Error(w, r, "Server error", http.StatusInternalServerError)
+		fmt.Println("[ADMIN] Query error:", err)
+		return
+	}
+	defer rows.Close()
+	var inventories []InventoryInfo
+	for rows.Next() {
+		var inventory InventoryInfo
+		if err := rows.Scan(&inventory.ID, &inventory.Name); err != nil {
+			reply.Error(w, r, "Server error", http.StatusInternalServerError)
+			fmt.Println("[ADMIN] Scan error:", err)
+			return
+		}
+		inventory.StorageBytes = perInventory[inventory.ID]
+		inventories = append(inventories, inventory)
+	}
+	if strings.HasPrefix(r.UserAgent(), "Resonite") {
+		var ids, storage []int
+		var names []string
+		for _, inventory := range inventories {
+			ids = append(ids, inventory.ID)
+			names = append(names, inventory.Name)
+			storage = append(storage, int(inventory.StorageBytes/1024))
+		}
+		response := animxmaker.Animation{
+			Tracks: []animxmaker.AnimationTrackWrapper{
+				animxmaker.ListTrack(ids, "inventories", "id"),
+				animxmaker.ListTrack(names, "inventories", "name"),
+				animxmaker.ListTrack(storage, "inventories", "storageKB"),
+			},
+		}
+		encodedResponse, err := response.EncodeAnimation("response")
+		if err != nil {
+			http.Error(w, "Error while encoding animx", http.StatusInternalServerError)
+			return
+		}
+		w.Write(encodedResponse)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":      true,
+			"inventories":  inventories,
+			"storageBytes": total,
+		})
+	}
+}
+
+// setDisabled builds the handlers of /admin/users/disable and /admin/users/enable
+func setDisabled(disabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+		claims := authentication.AuthCheck(w, r)
+		if claims == nil || !authentication.RequireAdmin(w, r, claims) {
+			return
+		}
+		userId, username, ok := targetUser(w, r)
+		if !ok {
+			return
+		}
+		if userId == claims.UID {
+			reply.Error(w, r, "You can't disable your own account", http.StatusBadRequest)
+			return
+		}
+		if err := authentication.SetUserDisabled(userId, disabled); err != nil {
+			reply.Error(w, r, "Server error", http.StatusInternalServerError)
+			fmt.Println("[ADMIN] Update error:", err)
+			return
+		}
+		if disabled {
+			fmt.Println("[ADMIN]", claims.Username, "disabled user:", username)
+			reply.Success(w, r, "User disabled")
+		} else {
+			fmt.Println("[ADMIN]", claims.Username, "enabled user:", username)
+			reply.Success(w, r, "User enabled")
+		}
+	}
+}
+
+// handles POST /admin/users/setRole?userId=&role=
+func setRole(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := authentication.AuthCheck(w, r)
+	if claims == nil || !authentication.RequireAdmin(w, r, claims) {
+		return
+	}
+	userId, username, ok := targetUser(w, r)
+	if !ok {
+		return
+	}
+	role := r.URL.Query().Get("role")
+	if !authentication.IsValidRole(role) {
+		reply.Error(w, r, "role must be admin or user", http.StatusBadRequest)
+		return
+	}
+	// Prevents the last admin from locking everyone out of the admin endpoints
+	if userId == claims.UID && role != authentication.RoleAdmin {
+		reply.Error(w, r, "You can't remove your own admin role", http.StatusBadRequest)
+		return
+	}
+	if err := authentication.SetUserRole(userId, role); err != nil {
+		reply.Error(w, r, "Server error", http.StatusInternalServerError)
+		fmt.Println("[ADMIN] Update error:", err)
+		return
+	}
+	fmt.Println("[ADMIN]", claims.Username, "set role of", username, "to", role)
+	reply.Success(w, r, "Role changed")
+}
+
+// handles POST /admin/users/delete?userId=, removes the account with all of its inventories
+func deleteUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := authentication.AuthCheck(w, r)
+	if claims == nil || !authentication.RequireAdmin(w, r, claims) {
+		return
+	}
+	userId, username, ok := targetUser(w, r)
+	if !ok {
+		return
+	}
+	if userId == claims.UID {
+		reply.Error(w, r, "You can't delete your own account here", http.StatusBadRequest)
+		return
+	}
+	if err := upload.RemoveUser(userId); err != nil {
+		reply.Error(w, r, "Failed to delete user", http.StatusInternalServerError)
+		fmt.Println("[ADMIN] Error deleting user:", err)
+		return
+	}
+	fmt.Println("[ADMIN]", claims.Username, "deleted user:", username)
+	reply.Success(w, r, "User deleted")
+}
+
+func AddAdminListeners() {
+	http.HandleFunc("/admin/users", listUsers)
+	http.HandleFunc("/admin/users/inventories", listUserInventories)
+	http.HandleFunc("/admin/users/disable", setDisabled(true))
+	http.HandleFunc("/admin/users/enable", setDisabled(false))
+	http.HandleFunc("/admin/users/setRole", setRole)
+	http.HandleFunc("/admin/users/delete", deleteUser)
+}
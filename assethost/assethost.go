@@ -3,28 +3,12 @@ package assethost
 import (
 	"fmt"
 	"net/http"
-	"resonite-file-provider/authentication"
+	"resonite-file-provider/authorization"
 	"resonite-file-provider/config"
 	"resonite-file-provider/database"
 	"strings"
 )
 
-func isOwnedBy(owner int, url string) bool {
-	var exists bool
-	url = strings.TrimSuffix(url, ".brson")
-	database.Db.QueryRow(`
-	SELECT EXISTS (
-			SELECT 1 
-			FROM Users u
-			INNER JOIN users_inventories ui ON u.id = ui.user_id
-			INNER JOIN Inventories i ON ui.inventory_id = i.id
-			INNER JOIN Folders f ON f.inventory_id = i.id
-			INNER JOIN Items it ON it.folder_id = f.id
-			WHERE u.id = ? AND it.url = ?
-		)
-	`, owner, url).Scan(&exists)
-	return exists
-}
 func handleRequest(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		r.URL.Path = strings.TrimPrefix(r.URL.Path, "/assets/")
@@ -33,33 +17,64 @@ func handleRequest(next http.Handler) http.Handler {
 			return
 		}
 		
-		if !strings.HasSuffix(r.URL.Path, ".brson") {
+		if strings.HasPrefix(r.URL.Path, "signed/") {
+			userId, name, err := verifySignedPath(strings.TrimPrefix(r.URL.Path, "signed/"))
+			if err != nil {
+				http.Error(w, "Invalid or expired asset URL", http.StatusForbidden)
+				return
+			}
+			// Checked again so removing someone from an inventory also ends their signed URLs
+			asset := authorization.Asset(strings.TrimSuffix(name, ".brson"))
+			if allowed, err := authorization.Can(userId, authorization.EndpointAction("GET /assets/signed/"), asset); err != nil || !allowed {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			r.URL.Path = name
 			next.ServeHTTP(w, r)
 			return
 		}
-		var isPublic []byte;
-		database.Db.QueryRow(`
-			SELECT i.isPublic from Items i JOIN Assets a on a.hash = i.url WHERE a.hash = ?
-			`,
-			strings.TrimSuffix(r.URL.Path, ".brson")).Scan(&isPublic)
-		if isPublic[0] == 1 {
+		if !strings.HasSuffix(r.URL.Path, ".brson") {
 			next.ServeHTTP(w, r)
 			return
 		}
-		claims := authentication.AuthCheck(w, r)
-		if claims == nil {
-			http.Error(w, "Failed Auth", http.StatusUnauthorized)
+		asset := authorization.Asset(strings.TrimSuffix(r.URL.Path, ".brson"))
+		if public, err := authorization.Can(authorization.Anonymous, authorization.EndpointAction("GET /assets/"), asset); err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			fmt.Println("[ASSETS] Query error:", err)
 			return
-		}
-		uId := claims.UID
-		if !isOwnedBy(uId, r.URL.Path) {
-			http.Error(w, "Forbidden", http.StatusForbidden)
+		} else if public {
+			if isFullDownload(r) {
+				countDownload(strings.TrimSuffix(r.URL.Path, ".brson"))
+			}
+			next.ServeHTTP(w, r)
 			return
 		}
-		next.ServeHTTP(w, r)
+		// Private records are only served through signed URLs, the listing endpoints hand those out
+		http.Error(w, "A signed asset URL is required", http.StatusUnauthorized)
 	})
 }
 
+// isFullDownload is false for HEAD, range and revalidation requests, which would count one download many times
+func isFullDownload(r *http.Request) bool {
+	return r.Method == http.MethodGet && r.Header.Get("Range") == "" &&
+		r.Header.Get("If-None-Match") == "" && r.Header.Get("If-Modified-Since") == ""
+}
+
+// countDownload counts a download of the public items using the asset as their record, for sorting the catalog.
+// Private copies of the same asset aren't in the catalog and don't count. Failing to count never stops the download.
+func countDownload(hash string) {
+	items, err := authorization.PublicItems(hash)
+	if err != nil {
+		fmt.Println("[ASSETS] Failed to count download:", err)
+		return
+	}
+	for _, itemId := range items {
+		if _, err := database.Db.Exec("UPDATE `Items` SET `downloads` = `downloads` + 1 WHERE `id` = ?", itemId); err != nil {
+			fmt.Println("[ASSETS] Failed to count download:", err)
+		}
+	}
+}
+
 func AddAssetListeners() {
 	http.Handle("/assets/", handleRequest(http.FileServer(http.Dir(config.GetConfig().Server.AssetsPath))))
 }
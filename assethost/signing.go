@@ -0,0 +1,108 @@
+package assethost
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"resonite-file-provider/config"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errBadSignedPath = errors.New("malformed signed asset path")
+	errBadSignature  = errors.New("asset url signature is invalid")
+	errURLExpired    = errors.New("asset url expired")
+)
+
+// getURLKey reads the secret signing asset URLs. Without one a random key is made at startup,
+// which works for a single server but invalidates every handed out URL on restart.
+func getURLKey() []byte {
+	if key := os.Getenv("ASSET_URL_SECRET"); key != "" {
+		return []byte(key)
+	} else if info, err := os.Stat("/run/secrets/asset-url.key"); err == nil && !info.IsDir() {
+		file, err := os.ReadFile("/run/secrets/asset-url.key")
+		if err != nil {
+			panic("error while reading asset url secret")
+		}
+		return file
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic("failed to generate asset url secret")
+	}
+	fmt.Println("[ASSETS] ASSET_URL_SECRET not set, signed asset URLs won't survive a restart")
+	return key
+}
+
+var urlKey = getURLKey()
+
+func signedURLLifetime() time.Duration {
+	if minutes := config.GetConfig().Assets.SignedURLMinutes; minutes > 0 {
+		return time.Duration(minutes) * time.Minute
+	}
+	return time.Hour
+}
+
+// signature binds the asset and expiry to a subject, a user ID or anything else that was allowed to download it
+func signature(subject string, expires int64, hash string) string {
+	mac := hmac.New(sha256.New, urlKey)
+	fmt.Fprintf(mac, "%s/%d/%s", subject, expires, hash)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SignPath returns <expires>/<signature>/<hash>, which proves until it expires that the subject may download the asset
+func SignPath(subject string, hash string) string {
+	expires := time.Now().Add(signedURLLifetime()).Unix()
+	return fmt.Sprintf("%d/%s/%s", expires, signature(subject, expires, hash), hash)
+}
+
+// VerifyPath checks a path made by SignPath for the subject and returns the file name at its end
+func VerifyPath(subject string, path string) (string, error) {
+	parts := strings.Split(path, "/")
+	if len(parts) != 3 || parts[2] == "" {
+		return "", errBadSignedPath
+	}
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return "", errBadSignedPath
+	}
+	name := parts[2]
+	expected := signature(subject, expires, strings.TrimSuffix(name, ".brson"))
+	if !hmac.Equal([]byte(expected), []byte(parts[1])) {
+		return "", errBadSignature
+	}
+	if time.Now().Unix() > expires {
+		return "", errURLExpired
+	}
+	return name, nil
+}
+
+// SignedURL returns the path under which the user can download the asset until the URL expires,
+// in the form assets/signed/<userId>/<expires>/<signature>/<hash>. Like plain asset paths,
+// appending .brson gives the item record.
+func SignedURL(userId int, hash string) string {
+	return fmt.Sprintf("assets/signed/%d/%s", userId, SignPath(strconv.Itoa(userId), hash))
+}
+
+// verifySignedPath checks a path below assets/signed/ and returns the user it was signed for and the file name
+func verifySignedPath(path string) (int, string, error) {
+	subject, rest, found := strings.Cut(path, "/")
+	if !found {
+		return -1, "", errBadSignedPath
+	}
+	userId, err := strconv.Atoi(subject)
+	if err != nil {
+		return -1, "", errBadSignedPath
+	}
+	name, err := VerifyPath(subject, rest)
+	if err != nil {
+		return -1, "", err
+	}
+	return userId, name, nil
+}
@@ -0,0 +1,335 @@
+package authentication
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"resonite-file-provider/animxmaker"
+	"resonite-file-provider/database"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// API keys look like rfp_<64 hex chars>, the prefix lets AuthCheck tell them apart from JWTs
+const apiKeyPrefix = "rfp_"
+
+const (
+	ScopeRead   = "read"   // list and download inventory content
+	ScopeUpload = "upload" // upload items and create folders
+	ScopeManage = "manage" // create, rename and remove inventories, remove content, change visibility
+	ScopeAdmin  = "admin"  // administrative endpoints
+)
+
+var validScopes = []string{ScopeRead, ScopeUpload, ScopeManage, ScopeAdmin}
+
+type APIKey struct {
+	ID         int      `json:"id"`
+	Name       string   `json:"name"`
+	Prefix     string   `json:"prefix"`
+	Scopes     []string `json:"scopes"`
+	CreatedAt  string   `json:"createdAt"`
+	ExpiresAt  *string  `json:"expiresAt"`
+	LastUsedAt *string  `json:"lastUsedAt"`
+}
+
+// HasScope reports whether the request may perform actions of the given scope.
+// Login tokens are not scoped and can do everything the user can.
+func (c *Claims) HasScope(scope string) bool {
+	if c.APIKeyID == 0 {
+		return true
+	}
+	return slices.Contains(c.Scopes, scope)
+}
+
+// RequireScope writes a 403 and returns false if the claims lack the scope
+func RequireScope(w http.ResponseWriter, r *http.Request, claims *Claims, scope string) bool {
+	if claims.HasScope(scope) {
+		return true
+	}
+	fmt.Println("[AUTH] API key", claims.APIKeyID, "is missing scope:", scope)
+	writeForbidden(w, r, "API key is missing the "+scope+" scope")
+	return false
+}
+
+// RequireSession writes a 403 and returns false if the request was made with an API key.
+// Used for account endpoints an API key should never be able to reach.
+func RequireSession(w http.ResponseWriter, r *http.Request, claims *Claims) bool {
+	if claims.APIKeyID == 0 {
+		return true
+	}
+	writeForbidden(w, r, "This endpoint requires a login token, not an API key")
+	return false
+}
+
+func writeForbidden(w http.ResponseWriter, r *http.Request, message string) {
+	if strings.HasPrefix(r.UserAgent(), "Resonite") {
+		http.Error(w, message, http.StatusForbidden)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   message,
+		})
+	}
+}
+
+func parseScopes(scopeList string) ([]string, error) {
+	var scopes []string
+	for _, scope := range strings.Split(scopeList, ",") {
+		scope = strings.ToLower(strings.TrimSpace(scope))
+		if scope == "" || slices.Contains(scopes, scope) {
+			continue
+		}
+		if !slices.Contains(validScopes, scope) {
+			return nil, fmt.Errorf("unknown scope %q", scope)
+		}
+		scopes = append(scopes, scope)
+	}
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("at least one scope is required")
+	}
+	return scopes, nil
+}
+
+// CreateAPIKey stores a new key for the user and returns its id and the plain key.
+// The plain key is only known at this point, the database only keeps its hash.
+func CreateAPIKey(uId int, name string, scopes []string, expiresAt *time.Time) (int64, string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return -1, "", err
+	}
+	key := apiKeyPrefix + hex.EncodeToString(bytes)
+	var expires any
+	if expiresAt != nil {
+		expires = expiresAt.UTC()
+	}
+	result, err := database.Db.Exec(
+		"INSERT INTO `ApiKeys` (`user_id`, `name`, `key_hash`, `prefix`, `scopes`, `created_at`, `expires_at`) VALUES (?, ?, ?, ?, ?, UTC_TIMESTAMP(), ?)",
+		uId, name, hashToken(key), key[:len(apiKeyPrefix)+8], strings.Join(scopes, ","), expires,
+	)
+	if err != nil {
+		return -1, "", err
+	}
+	keyId, err := result.LastInsertId()
+	if err != nil {
+		return -1, "", err
+	}
+	return keyId, key, nil
+}
+
+// ParseAPIKey validates an API key and returns claims carrying its scopes
+func ParseAPIKey(key string) (*Claims, error) {
+	var keyId, uId int
+	var username, scopes string
+	var revoked, expired bool
+	err := database.Db.QueryRow(`
+		SELECT k.id, k.user_id, u.username, k.scopes, k.revoked = 1,
+			k.expires_at IS NOT NULL AND k.expires_at <= UTC_TIMESTAMP()
+		FROM ApiKeys k
+		INNER JOIN Users u ON u.id = k.user_id
+		WHERE k.key_hash = ?`, hashToken(key)).Scan(&keyId, &uId, &username, &scopes, &revoked, &expired)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("unknown API key")
+	} else if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, fmt.Errorf("API key has been revoked")
+	}
+	if expired {
+		return nil, fmt.Errorf("API key has expired")
+	}
+	if _, err := database.Db.Exec("UPDATE `ApiKeys` SET `last_used_at` = UTC_TIMESTAMP() WHERE `id` = ?", keyId); err != nil {
+		fmt.Println("[AUTH] Failed to update API key usage:", err)
+	}
+	return &Claims{
+		Username: username,
+		UID:      uId,
+		APIKeyID: keyId,
+		Scopes:   strings.Split(scopes, ","),
+	}, nil
+}
+
+func ListAPIKeys(uId int) ([]APIKey, error) {
+	rows, err := database.Db.Query(`
+		SELECT id, name, prefix, scopes, created_at, expires_at, last_used_at
+		FROM ApiKeys WHERE user_id = ? AND revoked = 0 ORDER BY id`, uId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []APIKey
+	for rows.Next() {
+		var key APIKey
+		var scopes string
+		var expiresAt, lastUsedAt sql.NullString
+		if err := rows.Scan(&key.ID, &key.Name, &key.Prefix, &scopes, &key.CreatedAt, &expiresAt, &lastUsedAt); err != nil {
+			return nil, err
+		}
+		key.Scopes = strings.Split(scopes, ",")
+		if expiresAt.Valid {
+			key.ExpiresAt = &expiresAt.String
+		}
+		if lastUsedAt.Valid {
+			key.LastUsedAt = &lastUsedAt.String
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// RevokeAPIKey returns false if the key doesn't exist or belongs to another user
+func RevokeAPIKey(keyId int, uId int) (bool, error) {
+	result, err := database.Db.Exec("UPDATE `ApiKeys` SET `revoked` = b'1' WHERE `id` = ? AND `user_id` = ?", keyId, uId)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+// RevokeAllAPIKeys stops every key of the user, keys don't outlive the password they were created under
+func RevokeAllAPIKeys(uId int) error {
+	_, err := database.Db.Exec("UPDATE `ApiKeys` SET `revoked` = b'1' WHERE `user_id` = ? AND `revoked` = 0", uId)
+	return err
+}
+
+// handles POST /auth/apikeys/create
+func createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := AuthCheck(w, r)
+	if claims == nil || !RequireSession(w, r, claims) {
+		return
+	}
+	name := strings.TrimSpace(r.URL.Query().Get("name"))
+	if name == "" {
+		http.Error(w, "name missing", http.StatusBadRequest)
+		return
+	}
+	scopes, err := parseScopes(r.URL.Query().Get("scopes"))
+	if err != nil {
+		http.Error(w, "scopes missing or invalid: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var expiresAt *time.Time
+	if days := r.URL.Query().Get("expiresInDays"); days != "" {
+		expiresInDays, err := strconv.Atoi(days)
+		if err != nil || expiresInDays <= 0 {
+			http.Error(w, "expiresInDays is invalid", http.StatusBadRequest)
+			return
+		}
+		expires := time.Now().AddDate(0, 0, expiresInDays)
+		expiresAt = &expires
+	}
+	keyId, key, err := CreateAPIKey(claims.UID, name, scopes, expiresAt)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		fmt.Println("[AUTH] Failed to create API key:", err)
+		return
+	}
+	fmt.Println("[AUTH] Created API key", keyId, "for user:", claims.Username)
+	if strings.HasPrefix(r.UserAgent(), "Resonite") {
+		w.Write([]byte(key))
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"id":      keyId,
+			"key":     key,
+			"name":    name,
+			"scopes":  scopes,
+		})
+	}
+}
+
+// handles GET /auth/apikeys/list
+func listAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	claims := AuthCheck(w, r)
+	if claims == nil || !RequireSession(w, r, claims) {
+		return
+	}
+	keys, err := ListAPIKeys(claims.UID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		fmt.Println("[AUTH] Failed to list API keys:", err)
+		return
+	}
+	if strings.HasPrefix(r.UserAgent(), "Resonite") {
+		var ids []int
+		var names, prefixes, scopes []string
+		for _, key := range keys {
+			ids = append(ids, key.ID)
+			names = append(names, key.Name)
+			prefixes = append(prefixes, key.Prefix)
+			scopes = append(scopes, strings.Join(key.Scopes, ","))
+		}
+		response := animxmaker.Animation{
+			Tracks: []animxmaker.AnimationTrackWrapper{
+				animxmaker.ListTrack(ids, "keys", "id"),
+				animxmaker.ListTrack(names, "keys", "name"),
+				animxmaker.ListTrack(prefixes, "keys", "prefix"),
+				animxmaker.ListTrack(scopes, "keys", "scopes"),
+			},
+		}
+		encodedResponse, err := response.EncodeAnimation("response")
+		if err != nil {
+			http.Error(w, "Error while encoding animx", http.StatusInternalServerError)
+			return
+		}
+		w.Write(encodedResponse)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"keys":    keys,
+		})
+	}
+}
+
+// handles POST /auth/apikeys/revoke
+func revokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := AuthCheck(w, r)
+	if claims == nil || !RequireSession(w, r, claims) {
+		return
+	}
+	keyId, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "id missing or invalid", http.StatusBadRequest)
+		return
+	}
+	revoked, err := RevokeAPIKey(keyId, claims.UID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		fmt.Println("[AUTH] Failed to revoke API key:", err)
+		return
+	}
+	if !revoked {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+	fmt.Println("[AUTH] Revoked API key", keyId, "of user:", claims.Username)
+	if strings.HasPrefix(r.UserAgent(), "Resonite") {
+		w.Write([]byte("API key revoked"))
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+		})
+	}
+}
@@ -5,46 +5,93 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"resonite-file-provider/database"
 	"strings"
-
-	"golang.org/x/crypto/bcrypt"
 )
 
-func hashPassword(password string) string {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
-		panic(err)
-	}
-	return string(bytes)
+// Credential bodies are tiny, anything bigger is not a login
+const maxCredentialsBody = 64 << 10
+
+// credentials sent to the login and register endpoints
+type credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// The two-factor code on login
+	Code string `json:"code"`
+	// The invite code on register
+	Invite string `json:"invite"`
 }
-func readBody(r *http.Request) (string, string, error) {
+
+// readBody accepts JSON and form bodies, and the newline separated username\npassword
+// that is easy to build in Resonite. Only the first two formats allow newlines in passwords.
+func readBody(r *http.Request) (credentials, error) {
+	r.Body = http.MaxBytesReader(nil, r.Body, maxCredentialsBody)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		var result credentials
+		if err := json.NewDecoder(r.Body).Decode(&result); err != nil {
+			return credentials{}, fmt.Errorf("invalid JSON body: %w", err)
+		}
+		result.Code = strings.TrimSpace(result.Code)
+		result.Invite = strings.TrimSpace(result.Invite)
+		return result, nil
+	case "application/x-www-form-urlencoded", "multipart/form-data":
+		if err := r.ParseMultipartForm(maxCredentialsBody); err != nil && err != http.ErrNotMultipart {
+			return credentials{}, fmt.Errorf("invalid form body: %w", err)
+		}
+		return credentials{
+			Username: r.PostFormValue("username"),
+			Password: r.PostFormValue("password"),
+			Code:     strings.TrimSpace(r.PostFormValue("code")),
+			Invite:   strings.TrimSpace(r.PostFormValue("invite")),
+		}, nil
+	}
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		return "", "", err
+		return credentials{}, err
 	}
 	bodyString := string(body)
 	// Non standard way to read the body for ease of use in Resonite
 	creds := strings.Split(bodyString, "\n")
 	if len(creds) < 2 {
-		return "", "", fmt.Errorf("invalid credentials format")
+		return credentials{}, fmt.Errorf("invalid credentials format")
+	}
+	result := credentials{
+		Username: creds[0],
+		Password: creds[1],
 	}
-	username := creds[0]
-	password := creds[1]
-	return username, password, nil
+	// The optional third line is the two-factor code on login and the invite code on register
+	if len(creds) > 2 {
+		result.Code = strings.TrimSpace(creds[2])
+		result.Invite = result.Code
+	}
+	return result, nil
 }
 func registerHandler(w http.ResponseWriter, r *http.Request) {
-	username, password, err := readBody(r)
+	creds, err := readBody(r)
 	if err != nil {
-		http.Error(w, "Server error", http.StatusInternalServerError)
+		http.Error(w, "Invalid request body, send username and password", http.StatusBadRequest)
 		fmt.Println("Read error:", err)
 		return
 	}
+	username, password := creds.Username, creds.Password
+	attemptKeys := throttleKeys("register", username, r)
+	if wait := loginThrottle.retryAfter(attemptKeys...); wait > 0 {
+		writeTooManyAttempts(w, r, wait)
+		return
+	}
 	if username == "" || password == "" {
 		http.Error(w, "Username and password are required", http.StatusBadRequest)
 		return
 	}
+	if err := ValidateUsername(username); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// The username column compares without regard to case, so "Alice" counts as taken by "alice"
 	var exists bool
 	err = database.Db.QueryRow("SELECT EXISTS(SELECT 1 FROM Users WHERE username = ?)", username).Scan(&exists)
 	if err != nil && err != sql.ErrNoRows {
@@ -53,29 +100,57 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if exists {
-		http.Error(w, "Username already exists", http.StatusConflict)
+		// Probing for taken usernames counts as a failure
+		loginThrottle.fail(attemptKeys...)
+		http.Error(w, errUsernameTaken.Error(), http.StatusConflict)
 		return
 	}
-	hashedPassword := hashPassword(password)
-	_, err = database.Db.Exec("INSERT INTO `Users`(`username`, `auth`) VALUES (?, ?); ", username, hashedPassword)
+	hashedPassword, err := hashPassword(password)
 	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		fmt.Println("Hashing error:", err)
+		return
+	}
+	_, role, err := createUser(username, hashedPassword, creds.Invite)
+	if err == errUsernameTaken {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err == errRegistrationClosed {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err == errInviteRequired || err == errInviteInvalid {
+		loginThrottle.fail(attemptKeys...)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		fmt.Println("Insert error:", err)
 		return
 	}
+	if role == RoleAdmin {
+		fmt.Println("[AUTH] First user registered, made admin:", username)
+	}
 	w.Write([]byte("User registered successfully"))
 }
 func loginHandler(w http.ResponseWriter, r *http.Request) {
-	username, password, err := readBody(r)
+	creds, err := readBody(r)
 	if err != nil {
-		http.Error(w, "Server error", http.StatusInternalServerError)
+		http.Error(w, "Invalid request body, send username and password", http.StatusBadRequest)
 		fmt.Println("Read error:", err)
 		return
 	}
+	username, password := creds.Username, creds.Password
+	attemptKeys := throttleKeys("login", username, r)
+	if wait := loginThrottle.retryAfter(attemptKeys...); wait > 0 {
+		writeTooManyAttempts(w, r, wait)
+		return
+	}
 	var storedHash string
 	var uId int
-	err = database.Db.QueryRow("SELECT auth, id FROM Users WHERE username = ?", username).Scan(&storedHash, &uId)
+	var disabled bool
+	err = database.Db.QueryRow("SELECT auth, id, disabled = 1 FROM Users WHERE username = ?", username).Scan(&storedHash, &uId, &disabled)
 	if err == sql.ErrNoRows {
+		loginThrottle.fail(attemptKeys...)
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	} else if err != nil {
@@ -83,59 +158,284 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		fmt.Println("Query error:", err)
 		return
 	}
-	if err := bcrypt.CompareHashAndPassword([]byte(storedHash), []byte(password)); err != nil {
+	match, needsRehash, err := verifyPassword(storedHash, password)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		fmt.Println("Password check error:", err)
+		return
+	}
+	if !match {
+		loginThrottle.fail(attemptKeys...)
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
-	token, err := GenerateToken(username, uId)
+	// Only revealed after the password matched, so it can't be used to probe for accounts
+	if disabled {
+		writeForbidden(w, r, "This account has been disabled")
+		return
+	}
+	enabled, err := IsTwoFactorEnabled(uId)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		fmt.Println("Query error:", err)
+		return
+	}
+	if enabled {
+		if creds.Code == "" {
+			writeTwoFactorError(w, r, "Two-factor code required")
+			return
+		}
+		valid, err := VerifySecondFactor(uId, creds.Code)
+		if err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			fmt.Println("Two-factor error:", err)
+			return
+		}
+		if !valid {
+			loginThrottle.fail(attemptKeys...)
+			writeTwoFactorError(w, r, "Invalid two-factor code")
+			return
+		}
+	}
+	// Only the username is cleared, an attacker logging into their own account shouldn't reset their IP
+	loginThrottle.reset(attemptKeys[0])
+	if needsRehash {
+		upgradePasswordHash(uId, storedHash, password)
+	}
+	accessToken, refreshToken, err := StartSession(username, uId, r)
 	if err != nil {
 		http.Error(w, "Server error", http.StatusInternalServerError)
+		fmt.Println("Token error:", err)
+		return
 	}
+	SetAuthCookies(w, accessToken, refreshToken)
+
+	fmt.Printf("[AUTH] Login successful for user: %s\n", username)
+
+	writeTokens(w, r, accessToken, refreshToken)
+}
 
-	// Set the auth token as a cookie with detailed settings for troubleshooting
-	cookie := &http.Cookie{
-		Name:     "auth_token",
-		Value:    token,
-		Path:     "/",
-		MaxAge:   86400, // 1 day
-		HttpOnly: false, // Allow JavaScript access for debugging
-		SameSite: http.SameSiteLaxMode,
-		Secure:   false, // Since we're in development
+// writeTokens returns a token pair. Resonite gets the bare access token like before refresh tokens existed,
+// the refresh token comes in the X-Refresh-Token header and, with ?refresh=true, as a second line.
+func writeTokens(w http.ResponseWriter, r *http.Request, accessToken string, refreshToken string) {
+	w.Header().Set("X-Refresh-Token", refreshToken)
+	if strings.HasPrefix(r.UserAgent(), "Resonite") {
+		if r.URL.Query().Get("refresh") == "true" {
+			w.Write([]byte(accessToken + "\n" + refreshToken))
+		} else {
+			w.Write([]byte(accessToken))
+		}
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":      true,
+			"token":        accessToken,
+			"refreshToken": refreshToken,
+			"expiresIn":    int(accessTokenLifetime().Seconds()),
+		})
 	}
+}
 
-	http.SetCookie(w, cookie)
+// handles POST /auth/refresh, the refresh token is read from the body or the refresh_token cookie
+func refreshHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		fmt.Println("Read error:", err)
+		return
+	}
+	refreshToken := strings.TrimSpace(string(body))
+	if refreshToken == "" {
+		if refreshCookie, err := r.Cookie("refresh_token"); err == nil {
+			refreshToken = refreshCookie.Value
+		}
+	}
+	if refreshToken == "" {
+		http.Error(w, "Refresh token missing", http.StatusUnauthorized)
+		return
+	}
+	accessToken, newRefreshToken, claims, err := RefreshSession(refreshToken)
+	if err == ErrRefreshTokenInvalid || err == ErrRefreshTokenReused {
+		clearAuthCookie(w)
+		if strings.HasPrefix(r.UserAgent(), "Resonite") {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   err.Error(),
+			})
+		}
+		return
+	} else if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		fmt.Println("Refresh error:", err)
+		return
+	}
+	SetAuthCookies(w, accessToken, newRefreshToken)
+	fmt.Printf("[AUTH] Refreshed session for user: %s\n", claims.Username)
+	writeTokens(w, r, accessToken, newRefreshToken)
+}
 
-	// Log the cookie details
-	fmt.Printf("[AUTH] Setting cookie: %s=%s; Path=%s; MaxAge=%d; HttpOnly=%t; SameSite=%v\n",
-		cookie.Name, cookie.Value[:10]+"...", cookie.Path, cookie.MaxAge, cookie.HttpOnly, cookie.SameSite)
+// clearAuthCookie removes the auth cookies from browsers
+func clearAuthCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:   "auth_token",
+		Value:  "",
+		Path:   "/",
+		MaxAge: -1,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:   "refresh_token",
+		Value:  "",
+		Path:   "/",
+		MaxAge: -1,
+	})
+}
 
-	fmt.Printf("[AUTH] Login successful for user: %s\n", username)
+func writeUnauthorized(w http.ResponseWriter, r *http.Request, message string) {
+	if strings.HasPrefix(r.UserAgent(), "Resonite") {
+		http.Error(w, message, http.StatusUnauthorized)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   message,
+		})
+	}
+}
 
-	// Also return the token in the response body for non-browser clients
-	w.Write([]byte(token))
+// logoutSession finds the session a logout request ends and its user. Clients can send their refresh token
+// as the body, otherwise the access token names the session. It may have expired already, a client must
+// still be able to log out then, so only its signature and the session itself have to be valid.
+func logoutSession(w http.ResponseWriter, r *http.Request) (string, int, bool) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		fmt.Println("Read error:", err)
+		return "", -1, false
+	}
+	var sessionId string
+	if refreshToken := strings.TrimSpace(string(body)); refreshToken != "" {
+		sessionId, err = RefreshTokenSession(refreshToken)
+		if err != nil && err != ErrRefreshTokenInvalid {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			fmt.Println("Session lookup error:", err)
+			return "", -1, false
+		}
+	} else if token := requestToken(r); strings.HasPrefix(token, apiKeyPrefix) {
+		writeForbidden(w, r, "This endpoint requires a login token, not an API key")
+		return "", -1, false
+	} else if token != "" {
+		sessionId, _ = SessionOf(token)
+	}
+	if sessionId == "" {
+		writeUnauthorized(w, r, "Auth token missing or invalid")
+		return "", -1, false
+	}
+	uId, found, err := sessionUser(sessionId)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		fmt.Println("Session lookup error:", err)
+		return "", -1, false
+	}
+	if !found {
+		writeUnauthorized(w, r, "Session expired or revoked")
+		return "", -1, false
+	}
+	return sessionId, uId, true
 }
 
+// handles POST /auth/logout, revokes the session of the token used for the request
 func logoutHandler(w http.ResponseWriter, r *http.Request) {
-	// Handle logout logic here
-	w.Write([]byte("Logout handler"))
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	sessionId, uId, ok := logoutSession(w, r)
+	if !ok {
+		return
+	}
+	if err := RevokeSession(sessionId); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		fmt.Println("Revoke error:", err)
+		return
+	}
+	clearAuthCookie(w)
+	fmt.Println("[AUTH] Logout for user ID:", uId)
+	if strings.HasPrefix(r.UserAgent(), "Resonite") {
+		w.Write([]byte("Logged out"))
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+		})
+	}
+}
+
+// handles POST /auth/logoutAll, revokes every session of the user
+func logoutAllHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	_, uId, ok := logoutSession(w, r)
+	if !ok {
+		return
+	}
+	if err := RevokeAllSessions(uId); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		fmt.Println("Revoke error:", err)
+		return
+	}
+	clearAuthCookie(w)
+	fmt.Println("[AUTH] Logout everywhere for user ID:", uId)
+	if strings.HasPrefix(r.UserAgent(), "Resonite") {
+		w.Write([]byte("Logged out everywhere"))
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+		})
+	}
+}
+
+// OptionalAuthCheck is AuthCheck for endpoints that also serve visitors without an account.
+// Requests without any token get nil claims, a token that is present still has to be valid.
+func OptionalAuthCheck(w http.ResponseWriter, r *http.Request) (*Claims, bool) {
+	_, cookieErr := r.Cookie("auth_token")
+	if cookieErr != nil && r.Header.Get("Authorization") == "" && r.URL.Query().Get("auth") == "" {
+		return nil, true
+	}
+	claims := AuthCheck(w, r)
+	return claims, claims != nil
+}
+
+// requestToken returns the token sent with the request. The cookie is preferred, API keys and tools
+// usually send the Authorization header, the auth query parameter is the fallback.
+func requestToken(r *http.Request) string {
+	if authCookie, err := r.Cookie("auth_token"); err == nil {
+		return authCookie.Value
+	}
+	if bearer, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found {
+		return strings.TrimSpace(bearer)
+	}
+	return r.URL.Query().Get("auth")
 }
 
 func AuthCheck(w http.ResponseWriter, r *http.Request) *Claims {
 	// Log cookies
 	cookies := r.Cookies()
 	fmt.Println("[AUTH] Request cookies:", cookies)
-	var auth string
-	// First try cookie (preferred)
-	authCookie, err := r.Cookie("auth_token")
-	if err == nil {
-		auth = authCookie.Value
-		fmt.Println("[AUTH] Found auth_token cookie:", auth[:10]+"...")
-	} else {
-		// Fallback to query parameter
-		auth = r.URL.Query().Get("auth")
-		if auth != "" {
-			fmt.Println("[AUTH] Found auth in query param:", auth[:10]+"...")
-		}
+	auth := requestToken(r)
+	if auth != "" {
+		fmt.Println("[AUTH] Found auth token:", tokenPreview(auth))
 	}
 	if auth == "" {
 		// Log debug information
@@ -152,7 +452,16 @@ func AuthCheck(w http.ResponseWriter, r *http.Request) *Claims {
 		}
 		return nil
 	}
-	claims, err := ParseToken(auth)
+	var claims *Claims
+	var err error
+	if strings.HasPrefix(auth, apiKeyPrefix) {
+		claims, err = ParseAPIKey(auth)
+	} else {
+		claims, err = ParseToken(auth)
+	}
+	if err == nil {
+		err = loadAccount(claims)
+	}
 	if err != nil {
 		if strings.HasPrefix(r.UserAgent(), "Resonite") {
 			http.Error(w, "Auth token missing or invalid", http.StatusUnauthorized)
@@ -167,12 +476,49 @@ func AuthCheck(w http.ResponseWriter, r *http.Request) *Claims {
 		}
 		return nil
 	}
+	if claims.APIKeyID == 0 {
+		if err := TouchSession(claims.ID, r); err != nil {
+			fmt.Println("[AUTH] Failed to update session:", err)
+		}
+	}
 	fmt.Println("[AUTH] Auth successful for user ID:", claims.UID, "Username:", claims.Username)
 	return claims
 }
 
 // Call this before starting the server
 func AddAuthListeners() {
+	startThrottleSweeper()
 	http.HandleFunc("/auth/login", loginHandler)
 	http.HandleFunc("/auth/register", registerHandler)
+	http.HandleFunc("/auth/refresh", refreshHandler)
+	http.HandleFunc("/auth/logout", logoutHandler)
+	http.HandleFunc("/auth/logoutAll", logoutAllHandler)
+	http.HandleFunc("/auth/sessions/list", listSessionsHandler)
+	http.HandleFunc("/auth/sessions/revoke", revokeSessionHandler)
+	http.HandleFunc("/auth/apikeys/create", createAPIKeyHandler)
+	http.HandleFunc("/auth/apikeys/list", listAPIKeysHandler)
+	http.HandleFunc("/auth/apikeys/revoke", revokeAPIKeyHandler)
+	http.HandleFunc("/auth/2fa/enroll", enrollTwoFactorHandler)
+	http.HandleFunc("/auth/2fa/verify", verifyTwoFactorHandler)
+	http.HandleFunc("/auth/2fa/disable", disableTwoFactorHandler)
+	http.HandleFunc("/auth/changePassword", changePasswordHandler)
+	http.HandleFunc("/auth/resetPassword", resetPasswordHandler)
+	http.HandleFunc("/auth/admin/passwordReset", createPasswordResetHandler)
+	http.HandleFunc("/auth/registrationMode", registrationModeHandler)
+	http.HandleFunc("/auth/admin/invites/create", createInviteHandler)
+	http.HandleFunc("/auth/admin/invites/list", listInvitesHandler)
+	http.HandleFunc("/auth/admin/invites/revoke", revokeInviteHandler)
+	http.HandleFunc("/auth/oidc/info", oidcInfoHandler)
+	http.HandleFunc("/auth/oidc/login", oidcLoginHandler)
+	http.HandleFunc("/auth/oidc/callback", oidcCallbackHandler)
+	http.HandleFunc("/auth/oidc/twoFactor", oidcTwoFactorHandler)
+	http.HandleFunc("/.well-known/jwks.json", jwksHandler)
+}
+
+// tokenPreview shortens a token for the logs
+func tokenPreview(token string) string {
+	if len(token) <= 10 {
+		return "..."
+	}
+	return token[:10] + "..."
 }
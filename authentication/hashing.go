@@ -0,0 +1,138 @@
+package authentication
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"resonite-file-provider/config"
+	"resonite-file-provider/database"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+var errUnknownHashFormat = errors.New("unknown password hash format")
+
+type argon2Params struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+}
+
+func currentArgon2Params() argon2Params {
+	settings := config.GetConfig().Auth
+	params := argon2Params{memory: 64 * 1024, iterations: 3, parallelism: 2}
+	if settings.Argon2MemoryKiB > 0 {
+		params.memory = uint32(settings.Argon2MemoryKiB)
+	}
+	if settings.Argon2Iterations > 0 {
+		params.iterations = uint32(settings.Argon2Iterations)
+	}
+	if settings.Argon2Parallelism > 0 && settings.Argon2Parallelism <= 255 {
+		params.parallelism = uint8(settings.Argon2Parallelism)
+	}
+	return params
+}
+
+// hashPassword hashes with Argon2id and encodes the result in the PHC string format,
+// so the parameters travel with the hash and can change later
+func hashPassword(password string) (string, error) {
+	params := currentArgon2Params()
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, params.iterations, params.memory, params.parallelism, argon2KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, params.memory, params.iterations, params.parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// HashSecret hashes a secret that isn't an account password, like the password of a share link
+func HashSecret(secret string) (string, error) {
+	return hashPassword(secret)
+}
+
+// CheckSecret compares a secret with a hash made by HashSecret
+func CheckSecret(storedHash string, secret string) (bool, error) {
+	match, _, err := verifyPassword(storedHash, secret)
+	return match, err
+}
+
+func parseArgon2Hash(encoded string) (argon2Params, []byte, []byte, error) {
+	var params argon2Params
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, errUnknownHashFormat
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2 version %q", parts[2])
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.iterations, &params.parallelism); err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2 parameters: %w", err)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	return params, salt, key, nil
+}
+
+// verifyPassword compares the password with a stored Argon2id or bcrypt hash. needsRehash is true
+// when the password matched a bcrypt hash or a hash made with other parameters than configured now.
+// Accounts without a password (created through OpenID Connect) have an empty hash and never match.
+func verifyPassword(storedHash string, password string) (match bool, needsRehash bool, err error) {
+	switch {
+	case storedHash == "":
+		return false, false, nil
+	case strings.HasPrefix(storedHash, "$argon2id$"):
+		params, salt, key, err := parseArgon2Hash(storedHash)
+		if err != nil {
+			return false, false, err
+		}
+		computed := argon2.IDKey([]byte(password), salt, params.iterations, params.memory, params.parallelism, uint32(len(key)))
+		if subtle.ConstantTimeCompare(computed, key) != 1 {
+			return false, false, nil
+		}
+		return true, params != currentArgon2Params(), nil
+	case strings.HasPrefix(storedHash, "$2"):
+		err := bcrypt.CompareHashAndPassword([]byte(storedHash), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, false, nil
+		} else if err != nil {
+			return false, false, err
+		}
+		return true, true, nil
+	}
+	return false, false, errUnknownHashFormat
+}
+
+// upgradePasswordHash replaces an outdated hash after a successful login. It only logs failures,
+// the login itself already succeeded and the old hash keeps working.
+func upgradePasswordHash(uId int, oldHash string, password string) {
+	newHash, err := hashPassword(password)
+	if err != nil {
+		fmt.Println("[AUTH] Failed to upgrade password hash:", err)
+		return
+	}
+	// Conditional on the old hash so a password changed in the meantime isn't overwritten
+	if _, err := database.Db.Exec("UPDATE `Users` SET `auth` = ? WHERE `id` = ? AND `auth` = ?", newHash, uId, oldHash); err != nil {
+		fmt.Println("[AUTH] Failed to upgrade password hash:", err)
+		return
+	}
+	fmt.Println("[AUTH] Upgraded password hash of user ID:", uId)
+}
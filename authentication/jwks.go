@@ -0,0 +1,46 @@
+package authentication
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+)
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+}
+
+// publicKeys lists the EdDSA keys that still verify tokens, HMAC secrets are never published
+func (ring *keyring) publicKeys() []jsonWebKey {
+	jwks := []jsonWebKey{}
+	for _, key := range ring.byId {
+		publicKey, ok := key.verifyKey.(ed25519.PublicKey)
+		if !ok || key.expired() {
+			continue
+		}
+		jwks = append(jwks, jsonWebKey{
+			Kty: "OKP",
+			Crv: "Ed25519",
+			X:   base64.RawURLEncoding.EncodeToString(publicKey),
+			Kid: key.ID,
+			Alg: key.method.Alg(),
+			Use: "sig",
+		})
+	}
+	return jwks
+}
+
+// handles GET /.well-known/jwks.json so other services can verify our tokens
+func jwksHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": keys.publicKeys(),
+	})
+}
@@ -1,13 +1,12 @@
 package authentication
 
 import (
+	"fmt"
 	"os"
 	"time"
 	"github.com/golang-jwt/jwt/v5"
 )
 
-var jwtKey = getJWTKey()
-
 func getJWTKey() []byte {
 	if key := os.Getenv("JWT_SECRET_KEY"); key != "" {
 		println("JWT Env found!")
@@ -26,36 +25,67 @@ func getJWTKey() []byte {
 type Claims struct {
     Username string `json:"username"`
     UID int `json:"uid"`
+    // Set when the request was authenticated with an API key instead of a login token
+    APIKeyID int      `json:"-"`
+    Scopes   []string `json:"-"`
+    // Loaded from the Users row by AuthCheck, so role changes apply immediately
+    Role string `json:"-"`
     jwt.RegisteredClaims
 }
 
-// GenerateToken creates a signed JWT for a username
-func GenerateToken(username string, uId int) (string, error) {
+// GenerateToken creates a short-lived signed JWT for a username.
+// The session id is stored as the jti so the token can be revoked server-side.
+func GenerateToken(username string, uId int, sessionId string) (string, error) {
     claims := &Claims{
         Username: username,
 	UID: uId,
         RegisteredClaims: jwt.RegisteredClaims{
-            ExpiresAt: jwt.NewNumericDate(time.Now().Add(730 * time.Hour)),
+            ID:        sessionId,
+            ExpiresAt: jwt.NewNumericDate(time.Now().Add(accessTokenLifetime())),
         },
     }
 
-    token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-    return token.SignedString(jwtKey)
+    key := keys.signingKey()
+    token := jwt.NewWithClaims(key.method, claims)
+    token.Header["kid"] = key.ID
+    return token.SignedString(key.signKey)
 }
 
-// ParseToken validates and extracts claims from a JWT
+// ParseToken validates and extracts claims from a JWT, rejecting tokens whose session was revoked
 func ParseToken(tokenStr string) (*Claims, error) {
-    token, err := jwt.ParseWithClaims(tokenStr, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-        return jwtKey, nil
-    })
+    token, err := jwt.ParseWithClaims(tokenStr, &Claims{}, keys.verificationKey, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg(), jwt.SigningMethodEdDSA.Alg()}))
     if err != nil {
         return nil, err
     }
 
-    if claims, ok := token.Claims.(*Claims); ok && token.Valid {
-        return claims, nil
+    claims, ok := token.Claims.(*Claims)
+    if !ok || !token.Valid {
+        return nil, jwt.ErrTokenSignatureInvalid
     }
-
-    return nil, jwt.ErrTokenSignatureInvalid
+    if claims.ID == "" {
+        return nil, fmt.Errorf("token has no session id, please log in again")
+    }
+    active, err := IsSessionActive(claims.ID, claims.UID)
+    if err != nil {
+        return nil, err
+    }
+    if !active {
+        return nil, fmt.Errorf("session has been revoked")
+    }
+    return claims, nil
 }
 
+
+// SessionOf returns the session id of a correctly signed token without checking its expiry,
+// so logging out still revokes the session behind a token that already ran out
+func SessionOf(tokenStr string) (string, error) {
+    token, err := jwt.ParseWithClaims(tokenStr, &Claims{}, keys.verificationKey, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg(), jwt.SigningMethodEdDSA.Alg()}), jwt.WithoutClaimsValidation())
+    if err != nil {
+        return "", err
+    }
+    claims, ok := token.Claims.(*Claims)
+    if !ok || claims.ID == "" {
+        return "", fmt.Errorf("token has no session id")
+    }
+    return claims.ID, nil
+}
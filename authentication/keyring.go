@@ -0,0 +1,184 @@
+package authentication
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"os"
+	"resonite-file-provider/config"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// The key used when no keyring is configured, and for tokens issued without a kid header
+const defaultKeyId = "default"
+
+type signingKey struct {
+	ID string
+	// HS256 (default) or EdDSA
+	Algorithm string
+	// Used by HS256 keys
+	Secret     string
+	SecretFile string
+	// PKCS8 PEM file used by EdDSA keys
+	PrivateKeyFile string
+	// Once set the key no longer signs tokens, it still verifies them until the grace period ends
+	RetiredAt *time.Time
+
+	method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+type keyring struct {
+	Active string
+	Keys   []*signingKey
+
+	byId map[string]*signingKey
+}
+
+var keys = loadKeyring()
+
+func getKeyringPath() string {
+	if path := os.Getenv("JWT_KEYRING_FILE"); path != "" {
+		return path
+	}
+	return "/run/secrets/jwt-keyring.toml"
+}
+
+// loadKeyring reads the keyring file, or wraps the single JWT secret in a keyring if there is none
+//
+// Example keyring:
+//
+//	active = "2025-06"
+//
+//	[[keys]]
+//	id = "2025-06"
+//	secretFile = "/run/secrets/jwt-2025-06.key"
+//
+//	[[keys]]
+//	id = "2025-01"
+//	secretFile = "/run/secrets/jwt-2025-01.key"
+//	retiredAt = 2025-06-01T00:00:00Z
+func loadKeyring() *keyring {
+	path := getKeyringPath()
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() {
+		return &keyring{
+			Active: defaultKeyId,
+			byId: map[string]*signingKey{
+				defaultKeyId: newHMACKey(defaultKeyId, getJWTKey()),
+			},
+		}
+	}
+	var ring keyring
+	if _, err := toml.DecodeFile(path, &ring); err != nil {
+		panic(fmt.Sprintf("error while reading jwt keyring: %s", err.Error()))
+	}
+	ring.byId = make(map[string]*signingKey)
+	for _, key := range ring.Keys {
+		if key.ID == "" {
+			panic("jwt keyring contains a key without an id")
+		}
+		if _, exists := ring.byId[key.ID]; exists {
+			panic(fmt.Sprintf("jwt keyring contains the key %q twice", key.ID))
+		}
+		if err := key.load(); err != nil {
+			panic(fmt.Sprintf("error while loading jwt key %q: %s", key.ID, err.Error()))
+		}
+		ring.byId[key.ID] = key
+	}
+	active, ok := ring.byId[ring.Active]
+	if !ok {
+		panic(fmt.Sprintf("active jwt key %q is not in the keyring", ring.Active))
+	}
+	if active.RetiredAt != nil {
+		panic(fmt.Sprintf("active jwt key %q is retired", ring.Active))
+	}
+	println(fmt.Sprintf("JWT keyring loaded with %d keys, signing with %q", len(ring.byId), ring.Active))
+	return &ring
+}
+
+func newHMACKey(id string, secret []byte) *signingKey {
+	return &signingKey{
+		ID:        id,
+		method:    jwt.SigningMethodHS256,
+		signKey:   secret,
+		verifyKey: secret,
+	}
+}
+
+// load reads the key material for the configured algorithm
+func (key *signingKey) load() error {
+	switch key.Algorithm {
+	case "", jwt.SigningMethodHS256.Alg():
+		secret := []byte(key.Secret)
+		if key.SecretFile != "" {
+			file, err := os.ReadFile(key.SecretFile)
+			if err != nil {
+				return err
+			}
+			secret = file
+		}
+		if len(secret) == 0 {
+			return fmt.Errorf("no secret")
+		}
+		key.method = jwt.SigningMethodHS256
+		key.signKey = secret
+		key.verifyKey = secret
+		return nil
+	case jwt.SigningMethodEdDSA.Alg():
+		if key.PrivateKeyFile == "" {
+			return fmt.Errorf("EdDSA keys need a privateKeyFile")
+		}
+		file, err := os.ReadFile(key.PrivateKeyFile)
+		if err != nil {
+			return err
+		}
+		privateKey, err := jwt.ParseEdPrivateKeyFromPEM(file)
+		if err != nil {
+			return err
+		}
+		key.method = jwt.SigningMethodEdDSA
+		key.signKey = privateKey
+		key.verifyKey = privateKey.(ed25519.PrivateKey).Public()
+		return nil
+	}
+	return fmt.Errorf("unsupported algorithm %q", key.Algorithm)
+}
+
+func keyGracePeriod() time.Duration {
+	if hours := config.GetConfig().Auth.JwtKeyGraceHours; hours > 0 {
+		return time.Duration(hours) * time.Hour
+	}
+	return 24 * time.Hour
+}
+
+func (ring *keyring) signingKey() *signingKey {
+	return ring.byId[ring.Active]
+}
+
+// verificationKey is the jwt.Keyfunc, it picks the key named by the kid header
+func (ring *keyring) verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		kid = defaultKeyId
+	}
+	key, ok := ring.byId[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("signing key %q does not use %s", kid, token.Method.Alg())
+	}
+	if key.expired() {
+		return nil, fmt.Errorf("signing key %q has been retired", kid)
+	}
+	return key.verifyKey, nil
+}
+
+// expired reports whether the key was retired and its grace period is over
+func (key *signingKey) expired() bool {
+	return key.RetiredAt != nil && time.Now().After(key.RetiredAt.Add(keyGracePeriod()))
+}
@@ -0,0 +1,654 @@
+package authentication
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"resonite-file-provider/config"
+	"resonite-file-provider/database"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// How long the user has to finish the login at the identity provider
+const oidcStateLifetime = 10 * time.Minute
+
+var oidcHttpClient = &http.Client{Timeout: 10 * time.Second}
+
+type oidcProviderMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+}
+
+// oidcPending is a login that was sent to the identity provider and hasn't come back yet
+type oidcPending struct {
+	nonce        string
+	codeVerifier string
+	inviteCode   string
+	// Set when a logged in user links the provider to their existing account
+	linkUserId int
+	expiresAt  time.Time
+}
+
+// oidcSecondFactor is a provider login of an account with two-factor authentication that still needs its code
+type oidcSecondFactor struct {
+	userId    int
+	username  string
+	expiresAt time.Time
+}
+
+type oidcIdentity struct {
+	Subject           string `json:"sub"`
+	PreferredUsername string `json:"preferred_username"`
+	Name              string `json:"name"`
+	Nonce             string `json:"nonce"`
+	jwt.RegisteredClaims
+}
+
+type oidcProvider struct {
+	mu       sync.Mutex
+	metadata *oidcProviderMetadata
+	keys     map[string]any
+	pending  map[string]*oidcPending
+	// Keyed by the oidc_2fa cookie
+	secondFactors map[string]*oidcSecondFactor
+}
+
+var oidc = &oidcProvider{pending: make(map[string]*oidcPending), secondFactors: make(map[string]*oidcSecondFactor)}
+
+var usernameCleanup = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+func oidcSettings() config.OIDCConfig {
+	settings := config.GetConfig().OIDC
+	settings.Issuer = strings.TrimSuffix(settings.Issuer, "/")
+	if settings.Scopes == "" {
+		settings.Scopes = "openid profile"
+	}
+	if settings.DisplayName == "" {
+		settings.DisplayName = "Single Sign-On"
+	}
+	return settings
+}
+
+func OIDCEnabled() bool {
+	settings := oidcSettings()
+	return settings.Issuer != "" && settings.ClientID != "" && settings.RedirectURL != ""
+}
+
+func randomString(size int) (string, error) {
+	bytes := make([]byte, size)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
+}
+
+func getJSON(address string, target any) error {
+	response, err := oidcHttpClient.Get(address)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", address, response.Status)
+	}
+	return json.NewDecoder(response.Body).Decode(target)
+}
+
+// discover loads the provider metadata once, a failed attempt is retried on the next login
+func (p *oidcProvider) discover() (*oidcProviderMetadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+	issuer := oidcSettings().Issuer
+	var metadata oidcProviderMetadata
+	if err := getJSON(issuer+"/.well-known/openid-configuration", &metadata); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(metadata.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("provider reports issuer %q, expected %q", metadata.Issuer, issuer)
+	}
+	if metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" || metadata.JwksURI == "" {
+		return nil, errors.New("provider metadata is missing endpoints")
+	}
+	p.metadata = &metadata
+	return p.metadata, nil
+}
+
+// parseJWK converts a key from the provider's JWKS into a key jwt can verify with
+func parseJWK(key map[string]string) (any, error) {
+	decode := func(field string) ([]byte, error) {
+		return base64.RawURLEncoding.DecodeString(key[field])
+	}
+	switch key["kty"] {
+	case "RSA":
+		n, err := decode("n")
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode("e")
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if key["crv"] != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", key["crv"])
+		}
+		x, err := decode("x")
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode("y")
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		if key["crv"] != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", key["crv"])
+		}
+		x, err := decode("x")
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", key["kty"])
+}
+
+// verificationKey returns the provider key with the kid, the JWKS is fetched again
+// when the kid is unknown so key rotation at the provider works without a restart
+func (p *oidcProvider) verificationKey(kid string, jwksURI string) (any, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	var jwks struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	if err := getJSON(jwksURI, &jwks); err != nil {
+		return nil, err
+	}
+	p.keys = make(map[string]any)
+	for _, jwk := range jwks.Keys {
+		if use := jwk["use"]; use != "" && use != "sig" {
+			continue
+		}
+		key, err := parseJWK(jwk)
+		if err != nil {
+			fmt.Println("[OIDC] Skipping provider key", jwk["kid"]+":", err)
+			continue
+		}
+		p.keys[jwk["kid"]] = key
+	}
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	// Providers with a single key often leave out the kid
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("provider has no key with kid %q", kid)
+}
+
+func (p *oidcProvider) savePending(state string, pending *oidcPending) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for key, other := range p.pending {
+		if now.After(other.expiresAt) {
+			delete(p.pending, key)
+		}
+	}
+	p.pending[state] = pending
+}
+
+// takePending returns the login of the state and forgets it, every state works once
+func (p *oidcProvider) takePending(state string) *oidcPending {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pending, ok := p.pending[state]
+	if !ok {
+		return nil
+	}
+	delete(p.pending, state)
+	if time.Now().After(pending.expiresAt) {
+		return nil
+	}
+	return pending
+}
+
+func (p *oidcProvider) saveSecondFactor(challenge string, secondFactor *oidcSecondFactor) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for key, other := range p.secondFactors {
+		if now.After(other.expiresAt) {
+			delete(p.secondFactors, key)
+		}
+	}
+	p.secondFactors[challenge] = secondFactor
+}
+
+// secondFactor returns the login waiting for a code, it stays until finishSecondFactor so a mistyped code can be retried
+func (p *oidcProvider) secondFactor(challenge string) *oidcSecondFactor {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	secondFactor, ok := p.secondFactors[challenge]
+	if !ok || time.Now().After(secondFactor.expiresAt) {
+		return nil
+	}
+	return secondFactor
+}
+
+// finishSecondFactor forgets the challenge, false if another request finished it first
+func (p *oidcProvider) finishSecondFactor(challenge string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.secondFactors[challenge]; !ok {
+		return false
+	}
+	delete(p.secondFactors, challenge)
+	return true
+}
+
+// exchangeCode redeems the authorization code and returns the verified identity
+func (p *oidcProvider) exchangeCode(code string, pending *oidcPending) (*oidcIdentity, error) {
+	metadata, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+	settings := oidcSettings()
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", settings.RedirectURL)
+	form.Set("client_id", settings.ClientID)
+	form.Set("code_verifier", pending.codeVerifier)
+	if secret := os.Getenv("OIDC_CLIENT_SECRET"); secret != "" {
+		form.Set("client_secret", secret)
+	}
+	response, err := oidcHttpClient.PostForm(metadata.TokenEndpoint, form)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("invalid token response: %w", err)
+	}
+	if response.StatusCode != http.StatusOK || tokens.Error != "" {
+		return nil, fmt.Errorf("token request failed: %s %s", tokens.Error, tokens.ErrorDescription)
+	}
+	if tokens.IDToken == "" {
+		return nil, errors.New("token response has no id_token")
+	}
+	identity := &oidcIdentity{}
+	_, err = jwt.ParseWithClaims(tokens.IDToken, identity, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.verificationKey(kid, metadata.JwksURI)
+	},
+		jwt.WithValidMethods([]string{"RS256", "ES256", "EdDSA"}),
+		jwt.WithIssuer(metadata.Issuer),
+		jwt.WithAudience(settings.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid id_token: %w", err)
+	}
+	if identity.Nonce != pending.nonce {
+		return nil, errors.New("id_token nonce does not match")
+	}
+	if identity.Subject == "" {
+		return nil, errors.New("id_token has no subject")
+	}
+	return identity, nil
+}
+
+// availableUsername turns the name the provider suggests into a free, valid username
+func availableUsername(identity *oidcIdentity) (string, error) {
+	base := identity.PreferredUsername
+	if base == "" {
+		base = identity.Name
+	}
+	base = strings.Trim(usernameCleanup.ReplaceAllString(base, "_"), "_.-")
+	if len(base) > maxUsernameLength-4 {
+		base = base[:maxUsernameLength-4]
+	}
+	if ValidateUsername(base) != nil && ValidateUsername(base+"2") != nil {
+		base = "user"
+	}
+	candidate := base
+	for i := 2; ; i++ {
+		if ValidateUsername(candidate) == nil {
+			var exists bool
+			if err := database.Db.QueryRow("SELECT EXISTS(SELECT 1 FROM Users WHERE username = ?)", candidate).Scan(&exists); err != nil {
+				return "", err
+			}
+			if !exists {
+				return candidate, nil
+			}
+		}
+		candidate = fmt.Sprintf("%s%d", base, i)
+	}
+}
+
+// How often resolveIdentity starts over after losing a race against another callback
+const identityAttempts = 5
+
+var errIdentityTaken = errors.New("login was linked concurrently")
+
+// resolveIdentity finds the account linked to the provider subject, links it to the
+// logged in user or registers a new account following the registration mode.
+// A concurrent callback may take the username or link the subject first, then it starts over.
+func resolveIdentity(identity *oidcIdentity, pending *oidcPending) (int, string, error) {
+	for attempt := 0; attempt < identityAttempts; attempt++ {
+		uId, username, err := resolveIdentityOnce(identity, pending)
+		if err != errUsernameTaken && err != errIdentityTaken {
+			return uId, username, err
+		}
+	}
+	return -1, "", errors.New("could not link the login, too many concurrent attempts")
+}
+
+// resolveIdentityOnce creates the account and links the subject in one transaction, so an account never
+// exists without its login
+func resolveIdentityOnce(identity *oidcIdentity, pending *oidcPending) (int, string, error) {
+	issuer := oidcSettings().Issuer
+	var uId int
+	var username string
+	err := database.Db.QueryRow(`
+		SELECT u.id, u.username
+		FROM UserIdentities i
+		INNER JOIN Users u ON u.id = i.user_id
+		WHERE i.issuer = ? AND i.subject = ?`, issuer, identity.Subject).Scan(&uId, &username)
+	if err == nil {
+		if pending.linkUserId != 0 && pending.linkUserId != uId {
+			return -1, "", errors.New("this login is already linked to another account")
+		}
+		return uId, username, nil
+	} else if err != sql.ErrNoRows {
+		return -1, "", err
+	}
+	tx, err := database.Db.Begin()
+	if err != nil {
+		return -1, "", err
+	}
+	defer tx.Rollback()
+	registered := false
+	if pending.linkUserId != 0 {
+		uId = pending.linkUserId
+		if err := tx.QueryRow("SELECT username FROM Users WHERE id = ?", uId).Scan(&username); err != nil {
+			return -1, "", err
+		}
+	} else {
+		username, err = availableUsername(identity)
+		if err != nil {
+			return -1, "", err
+		}
+		// Accounts created through the provider have no password, they can set one with a reset token
+		newId, _, err := createUserTx(tx, username, "", pending.inviteCode)
+		if err != nil {
+			return -1, "", err
+		}
+		uId = int(newId)
+		registered = true
+	}
+	_, err = tx.Exec(
+		"INSERT INTO `UserIdentities` (`user_id`, `issuer`, `subject`, `created_at`) VALUES (?, ?, ?, UTC_TIMESTAMP())",
+		uId, issuer, identity.Subject,
+	)
+	if isDuplicateKey(err) {
+		return -1, "", errIdentityTaken
+	} else if err != nil {
+		return -1, "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return -1, "", err
+	}
+	if registered {
+		fmt.Println("[OIDC] Registered user", username, "for subject", identity.Subject)
+	}
+	return uId, username, nil
+}
+
+// handles GET /auth/oidc/info so the login page knows whether to show the button
+func oidcInfoHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled": OIDCEnabled(),
+		"name":    oidcSettings().DisplayName,
+	})
+}
+
+// handles GET /auth/oidc/login, sends the browser to the identity provider.
+// ?link=1 links the provider to the logged in account, ?invite= is used on invite-only instances.
+func oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if !OIDCEnabled() {
+		http.Error(w, "OpenID Connect login is not configured", http.StatusNotFound)
+		return
+	}
+	pending := &oidcPending{
+		inviteCode: r.URL.Query().Get("invite"),
+		expiresAt:  time.Now().Add(oidcStateLifetime),
+	}
+	if r.URL.Query().Get("link") == "1" {
+		claims := AuthCheck(w, r)
+		if claims == nil || !RequireSession(w, r, claims) {
+			return
+		}
+		pending.linkUserId = claims.UID
+	}
+	metadata, err := oidc.discover()
+	if err != nil {
+		http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+		fmt.Println("[OIDC] Discovery failed:", err)
+		return
+	}
+	state, err := randomString(24)
+	if err == nil {
+		pending.nonce, err = randomString(24)
+	}
+	if err == nil {
+		pending.codeVerifier, err = randomString(48)
+	}
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		fmt.Println("[OIDC] Failed to generate state:", err)
+		return
+	}
+	oidc.savePending(state, pending)
+	// Binds the state to this browser so a login started elsewhere can't be completed here
+	http.SetCookie(w, &http.Cookie{
+		Name:     "oidc_state",
+		Value:    state,
+		Path:     "/auth/oidc",
+		MaxAge:   int(oidcStateLifetime.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	challenge := sha256.Sum256([]byte(pending.codeVerifier))
+	settings := oidcSettings()
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", settings.ClientID)
+	params.Set("redirect_uri", settings.RedirectURL)
+	params.Set("scope", settings.Scopes)
+	params.Set("state", state)
+	params.Set("nonce", pending.nonce)
+	params.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	params.Set("code_challenge_method", "S256")
+	separator := "?"
+	if strings.Contains(metadata.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	http.Redirect(w, r, metadata.AuthorizationEndpoint+separator+params.Encode(), http.StatusFound)
+}
+
+// handles GET /auth/oidc/callback, the identity provider redirects here with the code
+func oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if !OIDCEnabled() {
+		http.Error(w, "OpenID Connect login is not configured", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	state := query.Get("state")
+	stateCookie, err := r.Cookie("oidc_state")
+	if err != nil || state == "" || stateCookie.Value != state {
+		http.Error(w, "Login state missing or invalid, please try again", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: "oidc_state", Value: "", Path: "/auth/oidc", MaxAge: -1})
+	pending := oidc.takePending(state)
+	if pending == nil {
+		http.Error(w, "Login expired, please try again", http.StatusBadRequest)
+		return
+	}
+	if providerError := query.Get("error"); providerError != "" {
+		http.Error(w, "Identity provider refused the login: "+providerError, http.StatusUnauthorized)
+		return
+	}
+	identity, err := oidc.exchangeCode(query.Get("code"), pending)
+	if err != nil {
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		fmt.Println("[OIDC] Code exchange failed:", err)
+		return
+	}
+	uId, username, err := resolveIdentity(identity, pending)
+	if err == errRegistrationClosed || err == errInviteRequired || err == errInviteInvalid {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
+		http.Error(w, "Login failed", http.StatusInternalServerError)
+		fmt.Println("[OIDC] Failed to resolve identity:", err)
+		return
+	}
+	var disabled bool
+	if err := database.Db.QueryRow("SELECT disabled = 1 FROM Users WHERE id = ?", uId).Scan(&disabled); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		fmt.Println("[OIDC] Query error:", err)
+		return
+	}
+	if disabled {
+		http.Error(w, "This account has been disabled", http.StatusForbidden)
+		return
+	}
+	// The provider doesn't know about our second factor, so it is asked for like on a password login
+	enabled, err := IsTwoFactorEnabled(uId)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		fmt.Println("[OIDC] Query error:", err)
+		return
+	}
+	if enabled {
+		challenge, err := randomString(24)
+		if err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			fmt.Println("[OIDC] Failed to generate challenge:", err)
+			return
+		}
+		oidc.saveSecondFactor(challenge, &oidcSecondFactor{
+			userId:    uId,
+			username:  username,
+			expiresAt: time.Now().Add(oidcStateLifetime),
+		})
+		http.SetCookie(w, &http.Cookie{
+			Name:     "oidc_2fa",
+			Value:    challenge,
+			Path:     "/auth/oidc",
+			MaxAge:   int(oidcStateLifetime.Seconds()),
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+		})
+		http.Redirect(w, r, "/login?twoFactor=oidc", http.StatusFound)
+		return
+	}
+	accessToken, refreshToken, err := StartSession(username, uId, r)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		fmt.Println("[OIDC] Token error:", err)
+		return
+	}
+	SetAuthCookies(w, accessToken, refreshToken)
+	fmt.Println("[OIDC] Login successful for user:", username)
+	http.Redirect(w, r, "/dashboard", http.StatusFound)
+}
+
+// handles POST /auth/oidc/twoFactor?code=, finishes a provider login with the two-factor or a recovery code
+func oidcTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	challengeCookie, err := r.Cookie("oidc_2fa")
+	if err != nil {
+		http.Error(w, "Login expired, please try again", http.StatusBadRequest)
+		return
+	}
+	challenge := challengeCookie.Value
+	pending := oidc.secondFactor(challenge)
+	if pending == nil {
+		http.Error(w, "Login expired, please try again", http.StatusBadRequest)
+		return
+	}
+	attemptKeys := throttleKeys("login", pending.username, r)
+	if wait := loginThrottle.retryAfter(attemptKeys...); wait > 0 {
+		writeTooManyAttempts(w, r, wait)
+		return
+	}
+	valid, err := VerifySecondFactor(pending.userId, r.URL.Query().Get("code"))
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		fmt.Println("[OIDC] Two-factor error:", err)
+		return
+	}
+	if !valid {
+		loginThrottle.fail(attemptKeys...)
+		writeTwoFactorError(w, r, "Invalid two-factor code")
+		return
+	}
+	if !oidc.finishSecondFactor(challenge) {
+		http.Error(w, "Login expired, please try again", http.StatusBadRequest)
+		return
+	}
+	loginThrottle.reset(attemptKeys[0])
+	http.SetCookie(w, &http.Cookie{Name: "oidc_2fa", Value: "", Path: "/auth/oidc", MaxAge: -1})
+	accessToken, refreshToken, err := StartSession(pending.username, pending.userId, r)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		fmt.Println("[OIDC] Token error:", err)
+		return
+	}
+	SetAuthCookies(w, accessToken, refreshToken)
+	fmt.Println("[OIDC] Login successful for user:", pending.username)
+	writeTokens(w, r, accessToken, refreshToken)
+}
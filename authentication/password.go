@@ -0,0 +1,270 @@
+package authentication
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"resonite-file-provider/config"
+	"resonite-file-provider/database"
+	"strings"
+	"time"
+)
+
+var errResetTokenInvalid = fmt.Errorf("reset token invalid, expired or already used")
+
+func passwordResetLifetime() time.Duration {
+	if minutes := config.GetConfig().Auth.PasswordResetMinutes; minutes > 0 {
+		return time.Duration(minutes) * time.Minute
+	}
+	return 60 * time.Minute
+}
+
+// readPasswordPair reads two values from the body. Like readBody it accepts JSON and forms
+// with the given field names, or the two values on separate lines.
+func readPasswordPair(r *http.Request, firstField string, secondField string) (string, string, error) {
+	r.Body = http.MaxBytesReader(nil, r.Body, maxCredentialsBody)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		var fields map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&fields); err != nil {
+			return "", "", err
+		}
+		return fields[firstField], fields[secondField], nil
+	case "application/x-www-form-urlencoded", "multipart/form-data":
+		if err := r.ParseMultipartForm(maxCredentialsBody); err != nil && err != http.ErrNotMultipart {
+			return "", "", err
+		}
+		return r.PostFormValue(firstField), r.PostFormValue(secondField), nil
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return "", "", err
+	}
+	lines := strings.Split(string(body), "\n")
+	if len(lines) < 2 {
+		return "", "", fmt.Errorf("expected two lines")
+	}
+	return lines[0], lines[1], nil
+}
+
+// CheckPassword reports whether the password matches the one stored for the user
+func CheckPassword(uId int, password string) (bool, error) {
+	var storedHash string
+	err := database.Db.QueryRow("SELECT auth FROM Users WHERE id = ?", uId).Scan(&storedHash)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	match, _, err := verifyPassword(storedHash, password)
+	return match, err
+}
+
+// HasPassword is false for accounts created through single sign-on that never set a password
+func HasPassword(uId int) (bool, error) {
+	var hasPassword bool
+	err := database.Db.QueryRow("SELECT auth != '' FROM Users WHERE id = ?", uId).Scan(&hasPassword)
+	return hasPassword, err
+}
+
+func SetPassword(uId int, password string) error {
+	hashedPassword, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = database.Db.Exec("UPDATE `Users` SET `auth` = ? WHERE `id` = ?", hashedPassword, uId)
+	return err
+}
+
+// CreatePasswordReset returns a one-time token the user can set a new password with.
+// Older unused tokens of the user stop working.
+func CreatePasswordReset(uId int, createdBy int) (string, time.Time, error) {
+	bytes := make([]byte, 24)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", time.Time{}, err
+	}
+	token := hex.EncodeToString(bytes)
+	expiresAt := time.Now().Add(passwordResetLifetime())
+	if _, err := database.Db.Exec("UPDATE `PasswordResets` SET `used` = b'1' WHERE `user_id` = ? AND `used` = 0", uId); err != nil {
+		return "", time.Time{}, err
+	}
+	_, err := database.Db.Exec(
+		"INSERT INTO `PasswordResets` (`user_id`, `token_hash`, `created_by`, `created_at`, `expires_at`) VALUES (?, ?, ?, UTC_TIMESTAMP(), ?)",
+		uId, hashToken(token), createdBy, expiresAt.UTC(),
+	)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token, expiresAt, nil
+}
+
+// UsePasswordReset consumes the token, sets the new password, logs the user out everywhere and revokes their API keys
+func UsePasswordReset(token string, password string) (int, error) {
+	var resetId, uId int
+	err := database.Db.QueryRow(
+		"SELECT id, user_id FROM PasswordResets WHERE token_hash = ? AND used = 0 AND expires_at > UTC_TIMESTAMP()",
+		hashToken(token),
+	).Scan(&resetId, &uId)
+	if err == sql.ErrNoRows {
+		return -1, errResetTokenInvalid
+	} else if err != nil {
+		return -1, err
+	}
+	result, err := database.Db.Exec("UPDATE `PasswordResets` SET `used` = b'1' WHERE `id` = ? AND `used` = 0", resetId)
+	if err != nil {
+		return -1, err
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return -1, err
+	} else if affected == 0 {
+		return -1, errResetTokenInvalid
+	}
+	if err := SetPassword(uId, password); err != nil {
+		return -1, err
+	}
+	if err := RevokeAllSessions(uId); err != nil {
+		return -1, err
+	}
+	if err := RevokeAllAPIKeys(uId); err != nil {
+		return -1, err
+	}
+	return uId, nil
+}
+
+// handles POST /auth/changePassword, body is oldPassword\nnewPassword
+func changePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := AuthCheck(w, r)
+	if claims == nil || !RequireSession(w, r, claims) {
+		return
+	}
+	oldPassword, newPassword, err := readPasswordPair(r, "oldPassword", "newPassword")
+	if err != nil {
+		http.Error(w, "Body must contain the old and the new password", http.StatusBadRequest)
+		return
+	}
+	if newPassword == "" {
+		http.Error(w, "New password is required", http.StatusBadRequest)
+		return
+	}
+	valid, err := CheckPassword(claims.UID, oldPassword)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		fmt.Println("Query error:", err)
+		return
+	}
+	if !valid {
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	if err := SetPassword(claims.UID, newPassword); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		fmt.Println("Update error:", err)
+		return
+	}
+	// Everyone who knew the old password is logged out, the device making the change stays logged in
+	if _, err := database.Db.Exec("UPDATE `Sessions` SET `revoked` = b'1' WHERE `user_id` = ? AND `id` != ?", claims.UID, claims.ID); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		fmt.Println("Revoke error:", err)
+		return
+	}
+	if err := RevokeAllAPIKeys(claims.UID); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		fmt.Println("Revoke error:", err)
+		return
+	}
+	fmt.Println("[AUTH] Password changed for user:", claims.Username)
+	if strings.HasPrefix(r.UserAgent(), "Resonite") {
+		w.Write([]byte("Password changed"))
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+		})
+	}
+}
+
+// handles POST /auth/resetPassword, body is resetToken\nnewPassword
+func resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	token, newPassword, err := readPasswordPair(r, "token", "newPassword")
+	if err != nil {
+		http.Error(w, "Body must contain the reset token and the new password", http.StatusBadRequest)
+		return
+	}
+	token = strings.TrimSpace(token)
+	if token == "" || newPassword == "" {
+		http.Error(w, "Reset token and new password are required", http.StatusBadRequest)
+		return
+	}
+	uId, err := UsePasswordReset(token, newPassword)
+	if err == errResetTokenInvalid {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		fmt.Println("Reset error:", err)
+		return
+	}
+	fmt.Println("[AUTH] Password reset for user ID:", uId)
+	if strings.HasPrefix(r.UserAgent(), "Resonite") {
+		w.Write([]byte("Password reset, you can now log in"))
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+		})
+	}
+}
+
+// handles POST /auth/admin/passwordReset, lets an admin hand a reset token to a user
+func createPasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := AuthCheck(w, r)
+	if claims == nil || !RequireAdmin(w, r, claims) {
+		return
+	}
+	username := r.URL.Query().Get("username")
+	var uId int
+	err := database.Db.QueryRow("SELECT id FROM Users WHERE username = ?", username).Scan(&uId)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		fmt.Println("Query error:", err)
+		return
+	}
+	token, expiresAt, err := CreatePasswordReset(uId, claims.UID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		fmt.Println("Reset error:", err)
+		return
+	}
+	fmt.Println("[AUTH] Admin", claims.Username, "created a password reset for user:", username)
+	if strings.HasPrefix(r.UserAgent(), "Resonite") {
+		w.Write([]byte(token))
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":   true,
+			"token":     token,
+			"expiresAt": expiresAt.UTC().Format(time.RFC3339),
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package authentication
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"resonite-file-provider/config"
+	"resonite-file-provider/database"
+	"time"
+)
+
+var (
+	ErrRefreshTokenInvalid = errors.New("refresh token invalid or expired")
+	ErrRefreshTokenReused  = errors.New("refresh token was already used, session revoked")
+)
+
+func accessTokenLifetime() time.Duration {
+	if minutes := config.GetConfig().Auth.AccessTokenMinutes; minutes > 0 {
+		return time.Duration(minutes) * time.Minute
+	}
+	return 15 * time.Minute
+}
+
+func refreshTokenLifetime() time.Duration {
+	if hours := config.GetConfig().Auth.RefreshTokenHours; hours > 0 {
+		return time.Duration(hours) * time.Hour
+	}
+	return 720 * time.Hour
+}
+
+// hashToken is used for every opaque token we store, only the hash is kept in the database
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newRefreshToken(sessionId string) (string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(bytes)
+	_, err := database.Db.Exec(
+		"INSERT INTO `RefreshTokens` (`session_id`, `token_hash`, `expires_at`) VALUES (?, ?, ?)",
+		sessionId, hashToken(token), time.Now().Add(refreshTokenLifetime()).UTC(),
+	)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// StartSession opens a new session for the user and returns its first access and refresh tokens
+func StartSession(username string, uId int, r *http.Request) (string, string, error) {
+	sessionId, err := CreateSession(uId, time.Now().Add(refreshTokenLifetime()), r)
+	if err != nil {
+		return "", "", err
+	}
+	refreshToken, err := newRefreshToken(sessionId)
+	if err != nil {
+		return "", "", err
+	}
+	accessToken, err := GenerateToken(username, uId, sessionId)
+	if err != nil {
+		return "", "", err
+	}
+	return accessToken, refreshToken, nil
+}
+
+// RefreshSession exchanges a refresh token for a new access and refresh token.
+// Every refresh token can be used once, presenting one a second time means it was
+// copied, so the whole session is revoked.
+func RefreshSession(refreshToken string) (string, string, *Claims, error) {
+	var tokenId int
+	var sessionId string
+	var used, expired bool
+	var uId int
+	var username string
+	err := database.Db.QueryRow(`
+		SELECT r.id, r.session_id, r.used = 1, r.expires_at <= UTC_TIMESTAMP(), s.user_id, u.username
+		FROM RefreshTokens r
+		INNER JOIN Sessions s ON s.id = r.session_id
+		INNER JOIN Users u ON u.id = s.user_id
+		WHERE r.token_hash = ?`, hashToken(refreshToken)).Scan(&tokenId, &sessionId, &used, &expired, &uId, &username)
+	if err == sql.ErrNoRows {
+		return "", "", nil, ErrRefreshTokenInvalid
+	} else if err != nil {
+		return "", "", nil, err
+	}
+	if used {
+		fmt.Println("[AUTH] Refresh token reuse detected, revoking session of user ID:", uId)
+		if err := RevokeSession(sessionId); err != nil {
+			return "", "", nil, err
+		}
+		return "", "", nil, ErrRefreshTokenReused
+	}
+	if expired {
+		return "", "", nil, ErrRefreshTokenInvalid
+	}
+	active, err := IsSessionActive(sessionId, uId)
+	if err != nil {
+		return "", "", nil, err
+	}
+	if !active {
+		return "", "", nil, ErrRefreshTokenInvalid
+	}
+	// Marking the token as used only succeeds once, this guards against two concurrent refreshes
+	result, err := database.Db.Exec("UPDATE `RefreshTokens` SET `used` = b'1' WHERE `id` = ? AND `used` = 0", tokenId)
+	if err != nil {
+		return "", "", nil, err
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return "", "", nil, err
+	} else if affected == 0 {
+		if err := RevokeSession(sessionId); err != nil {
+			return "", "", nil, err
+		}
+		return "", "", nil, ErrRefreshTokenReused
+	}
+	if err := ExtendSession(sessionId, time.Now().Add(refreshTokenLifetime())); err != nil {
+		return "", "", nil, err
+	}
+	newRefreshToken, err := newRefreshToken(sessionId)
+	if err != nil {
+		return "", "", nil, err
+	}
+	accessToken, err := GenerateToken(username, uId, sessionId)
+	if err != nil {
+		return "", "", nil, err
+	}
+	claims := &Claims{Username: username, UID: uId}
+	claims.ID = sessionId
+	return accessToken, newRefreshToken, claims, nil
+}
+
+// RefreshTokenSession returns the session a refresh token belongs to, also for used or expired ones
+func RefreshTokenSession(refreshToken string) (string, error) {
+	var sessionId string
+	err := database.Db.QueryRow("SELECT session_id FROM RefreshTokens WHERE token_hash = ?", hashToken(refreshToken)).Scan(&sessionId)
+	if err == sql.ErrNoRows {
+		return "", ErrRefreshTokenInvalid
+	}
+	return sessionId, err
+}
+
+// SetAuthCookies stores both tokens in the browser, each cookie lives as long as its token
+func SetAuthCookies(w http.ResponseWriter, accessToken string, refreshToken string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "auth_token",
+		Value:    accessToken,
+		Path:     "/",
+		MaxAge:   int(accessTokenLifetime().Seconds()),
+		HttpOnly: false, // The dashboard reads it to know whether it is logged in
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     "refresh_token",
+		Value:    refreshToken,
+		Path:     "/",
+		MaxAge:   int(refreshTokenLifetime().Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
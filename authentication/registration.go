@@ -0,0 +1,312 @@
+package authentication
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"resonite-file-provider/animxmaker"
+	"resonite-file-provider/config"
+	"resonite-file-provider/database"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+const (
+	RegistrationOpen       = "open"
+	RegistrationInviteOnly = "invite-only"
+	RegistrationClosed     = "closed"
+)
+
+var (
+	errRegistrationClosed = errors.New("registration is closed on this instance")
+	errInviteRequired     = errors.New("an invite code is required to register")
+	errInviteInvalid      = errors.New("invite code invalid, expired or used up")
+)
+
+type InviteCode struct {
+	ID        int     `json:"id"`
+	CreatedBy string  `json:"createdBy"`
+	CreatedAt string  `json:"createdAt"`
+	ExpiresAt *string `json:"expiresAt"`
+	MaxUses   int     `json:"maxUses"`
+	Uses      int     `json:"uses"`
+}
+
+// RegistrationMode returns the configured mode, anything unknown is treated as closed
+func RegistrationMode() string {
+	switch mode := strings.ToLower(config.GetConfig().Registration.Mode); mode {
+	case "", RegistrationOpen:
+		return RegistrationOpen
+	case RegistrationInviteOnly, "invite":
+		return RegistrationInviteOnly
+	default:
+		return RegistrationClosed
+	}
+}
+
+// isDuplicateKey reports whether the statement failed on a unique key, usually a lost race
+func isDuplicateKey(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1062
+}
+
+// createUser inserts the user according to the registration mode and returns their id and role.
+// The first account on an empty database always gets through and becomes the admin.
+func createUser(username string, hashedPassword string, inviteCode string) (int64, string, error) {
+	tx, err := database.Db.Begin()
+	if err != nil {
+		return -1, "", err
+	}
+	defer tx.Rollback()
+	uId, role, err := createUserTx(tx, username, hashedPassword, inviteCode)
+	if err != nil {
+		return -1, "", err
+	}
+	return uId, role, tx.Commit()
+}
+
+// createUserTx is createUser inside a transaction, for callers that store more with the account
+func createUserTx(tx *sql.Tx, username string, hashedPassword string, inviteCode string) (int64, string, error) {
+	// Locks the table so two concurrent registrations can't both become the first user
+	var userCount int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM Users FOR UPDATE").Scan(&userCount); err != nil {
+		return -1, "", err
+	}
+	role := RoleUser
+	if userCount == 0 {
+		role = RoleAdmin
+	} else {
+		switch RegistrationMode() {
+		case RegistrationClosed:
+			return -1, "", errRegistrationClosed
+		case RegistrationInviteOnly:
+			if inviteCode == "" {
+				return -1, "", errInviteRequired
+			}
+			result, err := tx.Exec(`
+				UPDATE InviteCodes SET uses = uses + 1
+				WHERE code_hash = ? AND revoked = 0 AND uses < max_uses
+					AND (expires_at IS NULL OR expires_at > UTC_TIMESTAMP())`, hashToken(strings.TrimSpace(inviteCode)))
+			if err != nil {
+				return -1, "", err
+			}
+			if affected, err := result.RowsAffected(); err != nil {
+				return -1, "", err
+			} else if affected == 0 {
+				return -1, "", errInviteInvalid
+			}
+		}
+	}
+	result, err := tx.Exec("INSERT INTO `Users`(`username`, `auth`, `role`) VALUES (?, ?, ?)", username, hashedPassword, role)
+	if isDuplicateKey(err) {
+		// Lost a race against another registration of the same name
+		return -1, "", errUsernameTaken
+	} else if err != nil {
+		return -1, "", err
+	}
+	uId, err := result.LastInsertId()
+	if err != nil {
+		return -1, "", err
+	}
+	return uId, role, nil
+}
+
+// CreateInviteCode returns a new code that can be used maxUses times
+func CreateInviteCode(createdBy int, maxUses int, expiresAt *time.Time) (int64, string, error) {
+	bytes := make([]byte, 12)
+	if _, err := rand.Read(bytes); err != nil {
+		return -1, "", err
+	}
+	code := hex.EncodeToString(bytes)
+	var expires any
+	if expiresAt != nil {
+		expires = expiresAt.UTC()
+	}
+	result, err := database.Db.Exec(
+		"INSERT INTO `InviteCodes` (`code_hash`, `created_by`, `created_at`, `expires_at`, `max_uses`) VALUES (?, ?, UTC_TIMESTAMP(), ?, ?)",
+		hashToken(code), createdBy, expires, maxUses,
+	)
+	if err != nil {
+		return -1, "", err
+	}
+	inviteId, err := result.LastInsertId()
+	if err != nil {
+		return -1, "", err
+	}
+	return inviteId, code, nil
+}
+
+// ListInviteCodes returns the codes that can still be used
+func ListInviteCodes() ([]InviteCode, error) {
+	rows, err := database.Db.Query(`
+		SELECT i.id, u.username, i.created_at, i.expires_at, i.max_uses, i.uses
+		FROM InviteCodes i
+		INNER JOIN Users u ON u.id = i.created_by
+		WHERE i.revoked = 0 AND i.uses < i.max_uses AND (i.expires_at IS NULL OR i.expires_at > UTC_TIMESTAMP())
+		ORDER BY i.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var invites []InviteCode
+	for rows.Next() {
+		var invite InviteCode
+		var expiresAt sql.NullString
+		if err := rows.Scan(&invite.ID, &invite.CreatedBy, &invite.CreatedAt, &expiresAt, &invite.MaxUses, &invite.Uses); err != nil {
+			return nil, err
+		}
+		if expiresAt.Valid {
+			invite.ExpiresAt = &expiresAt.String
+		}
+		invites = append(invites, invite)
+	}
+	return invites, nil
+}
+
+// handles GET /auth/registrationMode so clients know whether to ask for an invite code
+func registrationModeHandler(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.UserAgent(), "Resonite") {
+		w.Write([]byte(RegistrationMode()))
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"mode": RegistrationMode(),
+		})
+	}
+}
+
+// handles POST /auth/admin/invites/create
+func createInviteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := AuthCheck(w, r)
+	if claims == nil || !RequireAdmin(w, r, claims) {
+		return
+	}
+	maxUses := 1
+	if uses := r.URL.Query().Get("maxUses"); uses != "" {
+		parsed, err := strconv.Atoi(uses)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "maxUses is invalid", http.StatusBadRequest)
+			return
+		}
+		maxUses = parsed
+	}
+	var expiresAt *time.Time
+	if days := r.URL.Query().Get("expiresInDays"); days != "" {
+		expiresInDays, err := strconv.Atoi(days)
+		if err != nil || expiresInDays <= 0 {
+			http.Error(w, "expiresInDays is invalid", http.StatusBadRequest)
+			return
+		}
+		expires := time.Now().AddDate(0, 0, expiresInDays)
+		expiresAt = &expires
+	}
+	inviteId, code, err := CreateInviteCode(claims.UID, maxUses, expiresAt)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		fmt.Println("[AUTH] Failed to create invite code:", err)
+		return
+	}
+	fmt.Println("[AUTH] Admin", claims.Username, "created invite", inviteId, "with", maxUses, "uses")
+	if strings.HasPrefix(r.UserAgent(), "Resonite") {
+		w.Write([]byte(code))
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"id":      inviteId,
+			"code":    code,
+			"maxUses": maxUses,
+		})
+	}
+}
+
+// handles GET /auth/admin/invites/list
+func listInvitesHandler(w http.ResponseWriter, r *http.Request) {
+	claims := AuthCheck(w, r)
+	if claims == nil || !RequireAdmin(w, r, claims) {
+		return
+	}
+	invites, err := ListInviteCodes()
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		fmt.Println("[AUTH] Failed to list invite codes:", err)
+		return
+	}
+	if strings.HasPrefix(r.UserAgent(), "Resonite") {
+		var ids, maxUses, uses []int
+		var createdBy []string
+		for _, invite := range invites {
+			ids = append(ids, invite.ID)
+			maxUses = append(maxUses, invite.MaxUses)
+			uses = append(uses, invite.Uses)
+			createdBy = append(createdBy, invite.CreatedBy)
+		}
+		response := animxmaker.Animation{
+			Tracks: []animxmaker.AnimationTrackWrapper{
+				animxmaker.ListTrack(ids, "invites", "id"),
+				animxmaker.ListTrack(createdBy, "invites", "createdBy"),
+				animxmaker.ListTrack(maxUses, "invites", "maxUses"),
+				animxmaker.ListTrack(uses, "invites", "uses"),
+			},
+		}
+		encodedResponse, err := response.EncodeAnimation("response")
+		if err != nil {
+			http.Error(w, "Error while encoding animx", http.StatusInternalServerError)
+			return
+		}
+		w.Write(encodedResponse)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"invites": invites,
+		})
+	}
+}
+
+// handles POST /auth/admin/invites/revoke
+func revokeInviteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := AuthCheck(w, r)
+	if claims == nil || !RequireAdmin(w, r, claims) {
+		return
+	}
+	inviteId, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "id missing or invalid", http.StatusBadRequest)
+		return
+	}
+	result, err := database.Db.Exec("UPDATE `InviteCodes` SET `revoked` = b'1' WHERE `id` = ?", inviteId)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		fmt.Println("[AUTH] Failed to revoke invite code:", err)
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		http.Error(w, "Invite code not found", http.StatusNotFound)
+		return
+	}
+	fmt.Println("[AUTH] Admin", claims.Username, "revoked invite", inviteId)
+	if strings.HasPrefix(r.UserAgent(), "Resonite") {
+		w.Write([]byte("Invite code revoked"))
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+		})
+	}
+}
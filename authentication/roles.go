@@ -0,0 +1,59 @@
+package authentication
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"resonite-file-provider/database"
+)
+
+const (
+	RoleAdmin = "admin"
+	RoleUser  = "user"
+)
+
+var (
+	errAccountDisabled = errors.New("account is disabled")
+	errAccountDeleted  = errors.New("account no longer exists")
+)
+
+func IsValidRole(role string) bool {
+	return role == RoleAdmin || role == RoleUser
+}
+
+// loadAccount fills in the role of the user and fails for disabled or deleted accounts.
+// It runs on every request so disabling a user takes effect before their tokens expire.
+func loadAccount(claims *Claims) error {
+	var role string
+	var disabled bool
+	err := database.Db.QueryRow("SELECT role, disabled = 1 FROM Users WHERE id = ?", claims.UID).Scan(&role, &disabled)
+	if err == sql.ErrNoRows {
+		return errAccountDeleted
+	} else if err != nil {
+		return err
+	}
+	if disabled {
+		return errAccountDisabled
+	}
+	claims.Role = role
+	return nil
+}
+
+func IsAdmin(uId int) (bool, error) {
+	var admin bool
+	err := database.Db.QueryRow("SELECT EXISTS(SELECT 1 FROM Users WHERE id = ? AND role = ?)", uId, RoleAdmin).Scan(&admin)
+	return admin, err
+}
+
+// RequireAdmin writes a 403 and returns false unless the user is an admin.
+// API keys additionally need the admin scope.
+func RequireAdmin(w http.ResponseWriter, r *http.Request, claims *Claims) bool {
+	if !RequireScope(w, r, claims, ScopeAdmin) {
+		return false
+	}
+	if claims.Role != RoleAdmin {
+		writeForbidden(w, r, "This endpoint is only available to admins")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,271 @@
+package authentication
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"resonite-file-provider/animxmaker"
+	"resonite-file-provider/database"
+	"strings"
+	"time"
+)
+
+// Last seen is only written once per interval so every request doesn't cost an UPDATE
+const sessionTouchInterval = "1 MINUTE"
+
+// Session describes a login, UserAgent and IP are those of the device that logged in
+type Session struct {
+	ID                string  `json:"id"`
+	UserAgent         string  `json:"userAgent"`
+	IP                string  `json:"ip"`
+	CreatedAt         string  `json:"createdAt"`
+	LastSeenAt        *string `json:"lastSeenAt"`
+	LastSeenUserAgent string  `json:"lastSeenUserAgent"`
+	LastSeenIP        string  `json:"lastSeenIp"`
+	Current           bool    `json:"current"`
+}
+
+// newSessionId returns a random identifier that is used as the jti of a token
+func newSessionId() (string, error) {
+	bytes := make([]byte, 16)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+// clientUserAgent returns the user agent cut to the length of the column
+func clientUserAgent(r *http.Request) string {
+	userAgent := r.UserAgent()
+	if len(userAgent) > 255 {
+		userAgent = userAgent[:255]
+	}
+	return userAgent
+}
+
+// CreateSession stores a new session for the user and returns its id
+func CreateSession(uId int, expiresAt time.Time, r *http.Request) (string, error) {
+	sessionId, err := newSessionId()
+	if err != nil {
+		return "", err
+	}
+	_, err = database.Db.Exec(
+		"INSERT INTO `Sessions` (`id`, `user_id`, `created_at`, `expires_at`, `user_agent`, `ip`, `last_seen_at`, `last_seen_user_agent`, `last_seen_ip`) VALUES (?, ?, UTC_TIMESTAMP(), ?, ?, ?, UTC_TIMESTAMP(), ?, ?)",
+		sessionId, uId, expiresAt.UTC(), clientUserAgent(r), ClientIP(r), clientUserAgent(r), ClientIP(r),
+	)
+	if err != nil {
+		return "", err
+	}
+	return sessionId, nil
+}
+
+// IsSessionActive reports whether the session exists, belongs to the user, and was neither revoked nor expired
+func IsSessionActive(sessionId string, uId int) (bool, error) {
+	var active bool
+	err := database.Db.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM Sessions
+			WHERE id = ? AND user_id = ? AND revoked = 0 AND expires_at > UTC_TIMESTAMP()
+		)`, sessionId, uId).Scan(&active)
+	if err != nil {
+		return false, err
+	}
+	return active, nil
+}
+
+// sessionUser returns the user of the session, found is false when it doesn't exist, was revoked or expired
+func sessionUser(sessionId string) (int, bool, error) {
+	var uId int
+	err := database.Db.QueryRow(
+		"SELECT user_id FROM Sessions WHERE id = ? AND revoked = 0 AND expires_at > UTC_TIMESTAMP()", sessionId,
+	).Scan(&uId)
+	if err == sql.ErrNoRows {
+		return -1, false, nil
+	} else if err != nil {
+		return -1, false, err
+	}
+	return uId, true, nil
+}
+
+func RevokeSession(sessionId string) error {
+	_, err := database.Db.Exec("UPDATE `Sessions` SET `revoked` = b'1' WHERE `id` = ?", sessionId)
+	return err
+}
+
+// RevokeAllSessions logs the user out on every device
+func RevokeAllSessions(uId int) error {
+	_, err := database.Db.Exec("UPDATE `Sessions` SET `revoked` = b'1' WHERE `user_id` = ?", uId)
+	return err
+}
+
+// ExtendSession moves the expiry of a session, used when its refresh token is rotated
+func ExtendSession(sessionId string, expiresAt time.Time) error {
+	_, err := database.Db.Exec("UPDATE `Sessions` SET `expires_at` = ? WHERE `id` = ?", expiresAt.UTC(), sessionId)
+	return err
+}
+
+// TouchSession records the device and time a session was last used, the device that logged in is kept
+func TouchSession(sessionId string, r *http.Request) error {
+	_, err := database.Db.Exec(
+		"UPDATE `Sessions` SET `last_seen_at` = UTC_TIMESTAMP(), `last_seen_user_agent` = ?, `last_seen_ip` = ? WHERE `id` = ? AND (`last_seen_at` IS NULL OR `last_seen_at` < UTC_TIMESTAMP() - INTERVAL "+sessionTouchInterval+")",
+		clientUserAgent(r), ClientIP(r), sessionId,
+	)
+	return err
+}
+
+// IsRecentLogin reports whether the session was started by a login within maxAge. Refreshing keeps
+// the session, so only actually logging in again makes it recent.
+func IsRecentLogin(sessionId string, maxAge time.Duration) (bool, error) {
+	var recent bool
+	err := database.Db.QueryRow(
+		"SELECT created_at > UTC_TIMESTAMP() - INTERVAL ? SECOND FROM Sessions WHERE id = ?",
+		int(maxAge.Seconds()), sessionId,
+	).Scan(&recent)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return recent, err
+}
+
+// ListSessions returns the sessions of the user that are still active, newest first
+func ListSessions(uId int, currentSessionId string) ([]Session, error) {
+	rows, err := database.Db.Query(`
+		SELECT id, user_agent, ip, created_at, last_seen_at, last_seen_user_agent, last_seen_ip
+		FROM Sessions
+		WHERE user_id = ? AND revoked = 0 AND expires_at > UTC_TIMESTAMP()
+		ORDER BY COALESCE(last_seen_at, created_at) DESC`, uId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var sessions []Session
+	for rows.Next() {
+		var session Session
+		var userAgent, ip, lastSeenAt, lastSeenUserAgent, lastSeenIP sql.NullString
+		if err := rows.Scan(&session.ID, &userAgent, &ip, &session.CreatedAt, &lastSeenAt, &lastSeenUserAgent, &lastSeenIP); err != nil {
+			return nil, err
+		}
+		session.UserAgent = userAgent.String
+		session.IP = ip.String
+		session.LastSeenUserAgent = lastSeenUserAgent.String
+		session.LastSeenIP = lastSeenIP.String
+		if lastSeenAt.Valid {
+			session.LastSeenAt = &lastSeenAt.String
+		}
+		session.Current = session.ID == currentSessionId
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+// RevokeUserSession revokes one session of the user, false if the user has no such session
+func RevokeUserSession(sessionId string, uId int) (bool, error) {
+	result, err := database.Db.Exec("UPDATE `Sessions` SET `revoked` = b'1' WHERE `id` = ? AND `user_id` = ? AND `revoked` = 0", sessionId, uId)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// handles GET /auth/sessions/list
+func listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	claims := AuthCheck(w, r)
+	if claims == nil || !RequireSession(w, r, claims) {
+		return
+	}
+	sessions, err := ListSessions(claims.UID, claims.ID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		fmt.Println("[AUTH] Failed to list sessions:", err)
+		return
+	}
+	if strings.HasPrefix(r.UserAgent(), "Resonite") {
+		var ids, userAgents, ips, createdAt, lastSeenAt, lastSeenUserAgents, lastSeenIPs []string
+		var current []int
+		for _, session := range sessions {
+			ids = append(ids, session.ID)
+			userAgents = append(userAgents, session.UserAgent)
+			ips = append(ips, session.IP)
+			lastSeenUserAgents = append(lastSeenUserAgents, session.LastSeenUserAgent)
+			lastSeenIPs = append(lastSeenIPs, session.LastSeenIP)
+			createdAt = append(createdAt, session.CreatedAt)
+			if session.LastSeenAt != nil {
+				lastSeenAt = append(lastSeenAt, *session.LastSeenAt)
+			} else {
+				lastSeenAt = append(lastSeenAt, "")
+			}
+			if session.Current {
+				current = append(current, 1)
+			} else {
+				current = append(current, 0)
+			}
+		}
+		response := animxmaker.Animation{
+			Tracks: []animxmaker.AnimationTrackWrapper{
+				animxmaker.ListTrack(ids, "sessions", "id"),
+				animxmaker.ListTrack(userAgents, "sessions", "userAgent"),
+				animxmaker.ListTrack(ips, "sessions", "ip"),
+				animxmaker.ListTrack(createdAt, "sessions", "createdAt"),
+				animxmaker.ListTrack(lastSeenAt, "sessions", "lastSeenAt"),
+				animxmaker.ListTrack(lastSeenUserAgents, "sessions", "lastSeenUserAgent"),
+				animxmaker.ListTrack(lastSeenIPs, "sessions", "lastSeenIp"),
+				animxmaker.ListTrack(current, "sessions", "current"),
+			},
+		}
+		encodedResponse, err := response.EncodeAnimation("response")
+		if err != nil {
+			http.Error(w, "Error while encoding animx", http.StatusInternalServerError)
+			return
+		}
+		w.Write(encodedResponse)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":  true,
+			"sessions": sessions,
+		})
+	}
+}
+
+// handles POST /auth/sessions/revoke?id=, logs one device out
+func revokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := AuthCheck(w, r)
+	if claims == nil || !RequireSession(w, r, claims) {
+		return
+	}
+	sessionId := r.URL.Query().Get("id")
+	if sessionId == "" {
+		http.Error(w, "id missing", http.StatusBadRequest)
+		return
+	}
+	revoked, err := RevokeUserSession(sessionId, claims.UID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		fmt.Println("[AUTH] Failed to revoke session:", err)
+		return
+	}
+	if !revoked {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	if sessionId == claims.ID {
+		clearAuthCookie(w)
+	}
+	fmt.Println("[AUTH] User", claims.Username, "revoked a session")
+	if strings.HasPrefix(r.UserAgent(), "Resonite") {
+		w.Write([]byte("Session revoked"))
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package authentication
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"resonite-file-provider/config"
+	"resonite-file-provider/environment"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type failureRecord struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// throttle counts failed attempts per key (a username or an IP) and locks keys out with exponential backoff
+type throttle struct {
+	mu      sync.Mutex
+	records map[string]*failureRecord
+}
+
+var loginThrottle = &throttle{records: make(map[string]*failureRecord)}
+
+func rateLimitSettings() config.RateLimitConfig {
+	settings := config.GetConfig().RateLimit
+	if settings.MaxFailures <= 0 {
+		settings.MaxFailures = 5
+	}
+	if settings.BaseLockoutSeconds <= 0 {
+		settings.BaseLockoutSeconds = 30
+	}
+	if settings.MaxLockoutSeconds <= 0 {
+		settings.MaxLockoutSeconds = 3600
+	}
+	if settings.FailureWindowMinutes <= 0 {
+		settings.FailureWindowMinutes = 15
+	}
+	return settings
+}
+
+// retryAfter returns how long the longest lockout of the keys still lasts, zero if none is locked
+func (t *throttle) retryAfter(keys ...string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var wait time.Duration
+	now := time.Now()
+	for _, key := range keys {
+		if record, ok := t.records[key]; ok && record.lockedUntil.After(now) {
+			wait = max(wait, record.lockedUntil.Sub(now))
+		}
+	}
+	return wait
+}
+
+// fail records a failed attempt for every key. Once a key reaches the threshold every further
+// failure doubles its lockout, up to the configured maximum.
+func (t *throttle) fail(keys ...string) {
+	settings := rateLimitSettings()
+	window := time.Duration(settings.FailureWindowMinutes) * time.Minute
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	for _, key := range keys {
+		record, ok := t.records[key]
+		if !ok || now.Sub(record.lastFailure) > window {
+			record = &failureRecord{}
+			t.records[key] = record
+		}
+		record.failures++
+		record.lastFailure = now
+		if record.failures >= settings.MaxFailures {
+			exponent := float64(record.failures - settings.MaxFailures)
+			lockout := math.Min(float64(settings.BaseLockoutSeconds)*math.Pow(2, exponent), float64(settings.MaxLockoutSeconds))
+			record.lockedUntil = now.Add(time.Duration(lockout) * time.Second)
+			fmt.Printf("[AUTH] %s locked out for %.0f seconds after %d failures\n", key, lockout, record.failures)
+		}
+	}
+}
+
+func (t *throttle) reset(keys ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, key := range keys {
+		delete(t.records, key)
+	}
+}
+
+// sweep forgets records whose lockout ended and whose last failure is outside the window
+func (t *throttle) sweep() {
+	window := time.Duration(rateLimitSettings().FailureWindowMinutes) * time.Minute
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	for key, record := range t.records {
+		if now.Sub(record.lastFailure) > window && now.After(record.lockedUntil) {
+			delete(t.records, key)
+		}
+	}
+}
+
+func startThrottleSweeper() {
+	go func() {
+		for range time.Tick(time.Minute) {
+			loginThrottle.sweep()
+		}
+	}()
+}
+
+// ClientIP returns the address of the client, trusting X-Forwarded-For only behind a proxy.
+// Only the rightmost entry is used, the proxy appends it while everything before it comes from the client.
+func ClientIP(r *http.Request) string {
+	if environment.GetEnvAsBool("BEHIND_PROXY", false) {
+		if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+			entries := strings.Split(forwarded[len(forwarded)-1], ",")
+			if last := strings.TrimSpace(entries[len(entries)-1]); last != "" {
+				return last
+			}
+		}
+		if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+			return realIP
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// throttleKeys builds the per-username and per-IP keys of an action like login or register
+func throttleKeys(action string, username string, r *http.Request) []string {
+	return []string{
+		action + ":user:" + strings.ToLower(username),
+		action + ":ip:" + ClientIP(r),
+	}
+}
+
+func writeTooManyAttempts(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	message := fmt.Sprintf("Too many failed attempts, try again in %d seconds", seconds)
+	if strings.HasPrefix(r.UserAgent(), "Resonite") {
+		http.Error(w, message, http.StatusTooManyRequests)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":    false,
+			"error":      message,
+			"retryAfter": seconds,
+		})
+	}
+}
@@ -0,0 +1,311 @@
+package authentication
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"resonite-file-provider/database"
+	"strings"
+	"time"
+)
+
+// RFC 6238 parameters, these are the defaults every authenticator app understands
+const (
+	totpIssuer        = "Resonite File Provider"
+	totpDigits        = 6
+	totpPeriod        = 30
+	recoveryCodeCount = 10
+)
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func generateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return base32NoPadding.EncodeToString(secret), nil
+}
+
+// totpCode computes the HOTP value of the secret for one time step
+func totpCode(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulus := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%modulus)
+}
+
+// matchTOTP returns the time step the code belongs to, allowing one step of clock drift
+func matchTOTP(secret string, code string, now time.Time) (int64, bool) {
+	key, err := base32NoPadding.DecodeString(secret)
+	if err != nil {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - 1; step <= current+1; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func totpURI(username string, secret string) string {
+	label := url.PathEscape(totpIssuer + ":" + username)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", totpIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+	// Some authenticator apps show a + literally, so spaces are escaped as %20
+	return "otpauth://totp/" + label + "?" + strings.ReplaceAll(params.Encode(), "+", "%20")
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.ReplaceAll(code, "-", "")
+}
+
+func IsTwoFactorEnabled(uId int) (bool, error) {
+	var enabled bool
+	err := database.Db.QueryRow("SELECT EXISTS(SELECT 1 FROM TwoFactor WHERE user_id = ? AND enabled = 1)", uId).Scan(&enabled)
+	return enabled, err
+}
+
+// VerifySecondFactor accepts a current TOTP code or an unused recovery code.
+// A TOTP code can't be used twice and a recovery code is consumed.
+func VerifySecondFactor(uId int, code string) (bool, error) {
+	var secret string
+	var lastStep sql.NullInt64
+	err := database.Db.QueryRow("SELECT secret, last_used_step FROM TwoFactor WHERE user_id = ?", uId).Scan(&secret, &lastStep)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if step, ok := matchTOTP(secret, strings.TrimSpace(code), time.Now()); ok {
+		if lastStep.Valid && step <= lastStep.Int64 {
+			return false, nil
+		}
+		result, err := database.Db.Exec(
+			"UPDATE `TwoFactor` SET `last_used_step` = ? WHERE `user_id` = ? AND (`last_used_step` IS NULL OR `last_used_step` < ?)",
+			step, uId, step,
+		)
+		if err != nil {
+			return false, err
+		}
+		affected, err := result.RowsAffected()
+		return affected > 0, err
+	}
+	result, err := database.Db.Exec(
+		"UPDATE `RecoveryCodes` SET `used` = b'1' WHERE `user_id` = ? AND `code_hash` = ? AND `used` = 0",
+		uId, hashToken(normalizeRecoveryCode(code)),
+	)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if affected > 0 {
+		fmt.Println("[AUTH] Recovery code used by user ID:", uId)
+	}
+	return affected > 0, err
+}
+
+// newRecoveryCodes replaces all recovery codes of the user and returns the new ones
+func newRecoveryCodes(uId int) ([]string, error) {
+	if _, err := database.Db.Exec("DELETE FROM `RecoveryCodes` WHERE `user_id` = ?", uId); err != nil {
+		return nil, err
+	}
+	var codes []string
+	for i := 0; i < recoveryCodeCount; i++ {
+		bytes := make([]byte, 5)
+		if _, err := rand.Read(bytes); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(base32NoPadding.EncodeToString(bytes))
+		code = code[:4] + "-" + code[4:]
+		if _, err := database.Db.Exec(
+			"INSERT INTO `RecoveryCodes` (`user_id`, `code_hash`) VALUES (?, ?)",
+			uId, hashToken(normalizeRecoveryCode(code)),
+		); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+func writeTwoFactorError(w http.ResponseWriter, r *http.Request, message string) {
+	if strings.HasPrefix(r.UserAgent(), "Resonite") {
+		http.Error(w, message, http.StatusUnauthorized)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":           false,
+			"error":             message,
+			"twoFactorRequired": true,
+		})
+	}
+}
+
+// handles POST /auth/2fa/enroll, starts enrollment and returns the otpauth URI to scan
+func enrollTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := AuthCheck(w, r)
+	if claims == nil || !RequireSession(w, r, claims) {
+		return
+	}
+	enabled, err := IsTwoFactorEnabled(claims.UID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		fmt.Println("[AUTH] Two-factor query error:", err)
+		return
+	}
+	if enabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		fmt.Println("[AUTH] Failed to generate two-factor secret:", err)
+		return
+	}
+	_, err = database.Db.Exec(`
+		INSERT INTO TwoFactor (user_id, secret, enabled) VALUES (?, ?, b'0')
+		ON DUPLICATE KEY UPDATE secret = VALUES(secret), enabled = b'0', last_used_step = NULL`,
+		claims.UID, secret,
+	)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		fmt.Println("[AUTH] Failed to store two-factor secret:", err)
+		return
+	}
+	uri := totpURI(claims.Username, secret)
+	if strings.HasPrefix(r.UserAgent(), "Resonite") {
+		w.Write([]byte(uri + "\n" + secret))
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":    true,
+			"otpauthUri": uri,
+			"secret":     secret,
+		})
+	}
+}
+
+// handles POST /auth/2fa/verify, confirms enrollment with a first code and returns the recovery codes
+func verifyTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := AuthCheck(w, r)
+	if claims == nil || !RequireSession(w, r, claims) {
+		return
+	}
+	code := strings.TrimSpace(r.URL.Query().Get("code"))
+	var secret string
+	var enabled bool
+	err := database.Db.QueryRow("SELECT secret, enabled = 1 FROM TwoFactor WHERE user_id = ?", claims.UID).Scan(&secret, &enabled)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Two-factor enrollment was not started", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		fmt.Println("[AUTH] Two-factor query error:", err)
+		return
+	}
+	if enabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	step, ok := matchTOTP(secret, code, time.Now())
+	if !ok {
+		writeTwoFactorError(w, r, "Invalid two-factor code")
+		return
+	}
+	if _, err := database.Db.Exec("UPDATE `TwoFactor` SET `enabled` = b'1', `last_used_step` = ? WHERE `user_id` = ?", step, claims.UID); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		fmt.Println("[AUTH] Failed to enable two-factor:", err)
+		return
+	}
+	codes, err := newRecoveryCodes(claims.UID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		fmt.Println("[AUTH] Failed to create recovery codes:", err)
+		return
+	}
+	fmt.Println("[AUTH] Two-factor enabled for user:", claims.Username)
+	if strings.HasPrefix(r.UserAgent(), "Resonite") {
+		w.Write([]byte(strings.Join(codes, "\n")))
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":       true,
+			"recoveryCodes": codes,
+		})
+	}
+}
+
+// handles POST /auth/2fa/disable, needs a current code or a recovery code
+func disableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := AuthCheck(w, r)
+	if claims == nil || !RequireSession(w, r, claims) {
+		return
+	}
+	valid, err := VerifySecondFactor(claims.UID, r.URL.Query().Get("code"))
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		fmt.Println("[AUTH] Two-factor error:", err)
+		return
+	}
+	if !valid {
+		writeTwoFactorError(w, r, "Invalid two-factor code")
+		return
+	}
+	if _, err := database.Db.Exec("DELETE FROM `RecoveryCodes` WHERE `user_id` = ?", claims.UID); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		fmt.Println("[AUTH] Failed to remove recovery codes:", err)
+		return
+	}
+	if _, err := database.Db.Exec("DELETE FROM `TwoFactor` WHERE `user_id` = ?", claims.UID); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		fmt.Println("[AUTH] Failed to disable two-factor:", err)
+		return
+	}
+	fmt.Println("[AUTH] Two-factor disabled for user:", claims.Username)
+	if strings.HasPrefix(r.UserAgent(), "Resonite") {
+		w.Write([]byte("Two-factor authentication disabled"))
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+		})
+	}
+}
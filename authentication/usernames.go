@@ -0,0 +1,48 @@
+package authentication
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	minUsernameLength = 3
+	maxUsernameLength = 32
+)
+
+// Letters, digits, dots, dashes and underscores, starting with a letter or digit
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// Names that could be mistaken for the service or its staff
+var reservedUsernames = map[string]bool{
+	"admin":         true,
+	"administrator": true,
+	"anonymous":     true,
+	"everyone":      true,
+	"moderator":     true,
+	"null":          true,
+	"public":        true,
+	"resonite":      true,
+	"root":          true,
+	"support":       true,
+	"system":        true,
+	"undefined":     true,
+}
+
+var errUsernameTaken = errors.New("Username already exists")
+
+// ValidateUsername checks the rules for new usernames, existing accounts keep working either way
+func ValidateUsername(username string) error {
+	if len(username) < minUsernameLength || len(username) > maxUsernameLength {
+		return fmt.Errorf("Username must be between %d and %d characters long", minUsernameLength, maxUsernameLength)
+	}
+	if !usernamePattern.MatchString(username) {
+		return errors.New("Username may only contain letters, digits, dots, dashes and underscores and must start with a letter or digit")
+	}
+	if reservedUsernames[strings.ToLower(username)] {
+		return errors.New("This username is reserved")
+	}
+	return nil
+}
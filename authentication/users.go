@@ -0,0 +1,127 @@
+package authentication
+
+import (
+	"database/sql"
+	"resonite-file-provider/authorization"
+	"resonite-file-provider/database"
+	"strings"
+)
+
+// SetUserDisabled disables or enables an account, disabling also logs the user out everywhere
+func SetUserDisabled(uId int, disabled bool) error {
+	value := 0
+	if disabled {
+		value = 1
+	}
+	if _, err := database.Db.Exec("UPDATE `Users` SET `disabled` = ? WHERE `id` = ?", value, uId); err != nil {
+		return err
+	}
+	if disabled {
+		return RevokeAllSessions(uId)
+	}
+	return nil
+}
+
+func SetUserRole(uId int, role string) error {
+	_, err := database.Db.Exec("UPDATE `Users` SET `role` = ? WHERE `id` = ?", role, uId)
+	return err
+}
+
+// queryIds runs a query selecting one int column inside the transaction
+func queryIds(tx *sql.Tx, statement string, args ...any) ([]int, error) {
+	rows, err := tx.Query(statement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// leaveGroups takes the user out of all groups. A group losing its last admin makes its longest standing
+// member admin, so it can still be managed. A group losing its last member is deleted, the inventories
+// only it owned were removed together with the user's own.
+func leaveGroups(tx *sql.Tx, uId int) error {
+	groups, err := queryIds(tx, "SELECT group_id FROM group_members WHERE user_id = ? FOR UPDATE", uId)
+	if err != nil {
+		return err
+	}
+	for _, groupId := range groups {
+		admins, err := queryIds(tx, "SELECT user_id FROM group_members WHERE group_id = ? AND role = ? AND user_id <> ? FOR UPDATE", groupId, authorization.GroupRoleAdmin, uId)
+		if err != nil {
+			return err
+		}
+		if len(admins) > 0 {
+			continue
+		}
+		successor, err := queryIds(tx, "SELECT id FROM group_members WHERE group_id = ? AND user_id <> ? ORDER BY id LIMIT 1 FOR UPDATE", groupId, uId)
+		if err != nil {
+			return err
+		}
+		if len(successor) > 0 {
+			if _, err := tx.Exec("UPDATE `group_members` SET `role` = ? WHERE `id` = ?", authorization.GroupRoleAdmin, successor[0]); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM `group_members` WHERE `user_id` = ?", uId); err != nil {
+		return err
+	}
+	for _, groupId := range groups {
+		var empty bool
+		if err := tx.QueryRow("SELECT NOT EXISTS(SELECT 1 FROM group_members WHERE group_id = ?)", groupId).Scan(&empty); err != nil {
+			return err
+		}
+		if !empty {
+			continue
+		}
+		if _, err := tx.Exec("DELETE FROM `groups_inventories` WHERE `group_id` = ?", groupId); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM `Groups` WHERE `id` = ?", groupId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveUserData deletes the user together with their sessions, keys and two-factor data inside the transaction.
+// Inventories have to be removed before in the same transaction, see upload.RemoveUser.
+func RemoveUserData(tx *sql.Tx, uId int) error {
+	if err := leaveGroups(tx, uId); err != nil {
+		return err
+	}
+	statements := []string{
+		"DELETE FROM `RefreshTokens` WHERE `session_id` IN (SELECT `id` FROM `Sessions` WHERE `user_id` = ?)",
+		"DELETE FROM `Sessions` WHERE `user_id` = ?",
+		"DELETE FROM `ApiKeys` WHERE `user_id` = ?",
+		"DELETE FROM `RecoveryCodes` WHERE `user_id` = ?",
+		"DELETE FROM `TwoFactor` WHERE `user_id` = ?",
+		"DELETE FROM `PasswordResets` WHERE `user_id` = ? OR `created_by` = ?",
+		"DELETE FROM `InviteCodes` WHERE `created_by` = ?",
+		"DELETE FROM `UserIdentities` WHERE `user_id` = ?",
+		"DELETE FROM `ShareLinks` WHERE `created_by` = ?",
+		"DELETE FROM `Deliveries` WHERE `recipient_id` = ?",
+		"UPDATE `Deliveries` SET `sender_id` = NULL WHERE `sender_id` = ?",
+		"DELETE FROM `users_inventories` WHERE `user_id` = ?",
+		"UPDATE `Items` SET `uploaded_by` = NULL WHERE `uploaded_by` = ?",
+		"DELETE FROM `Users` WHERE `id` = ?",
+	}
+	for _, statement := range statements {
+		args := make([]any, strings.Count(statement, "?"))
+		for i := range args {
+			args[i] = uId
+		}
+		if _, err := tx.Exec(statement, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
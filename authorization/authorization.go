@@ -0,0 +1,336 @@
+// Package authorization decides what a user may do with items, folders, inventories, groups and assets.
+// Every handler asks Can before touching a resource, the rules live here and nowhere else.
+package authorization
+
+import (
+	"errors"
+	"fmt"
+)
+
+// MaxFolderDepth bounds every walk up a folder chain, deeper chains are treated as broken rather than walked forever
+const MaxFolderDepth = 256
+
+// ErrFolderChainTooDeep is returned by WalkAncestors for chains that don't reach a root folder within MaxFolderDepth
+var ErrFolderChainTooDeep = errors.New("folder chain is deeper than allowed")
+
+// Roles of an inventory member, every role includes the permissions of the ones before it
+const (
+	RoleViewer = "viewer"
+	RoleEditor = "editor"
+	RoleOwner  = "owner"
+)
+
+var roleRanks = map[string]int{
+	RoleViewer: 1,
+	RoleEditor: 2,
+	RoleOwner:  3,
+}
+
+func IsValidRole(role string) bool {
+	_, ok := roleRanks[role]
+	return ok
+}
+
+// RoleAtLeast reports whether role grants everything required grants
+func RoleAtLeast(role string, required string) bool {
+	return roleRanks[role] > 0 && roleRanks[role] >= roleRanks[required]
+}
+
+// HighestRole returns whichever of the two roles grants more, a user reached through several
+// groups and a direct membership gets the best of them
+func HighestRole(a string, b string) string {
+	if roleRanks[b] > roleRanks[a] {
+		return b
+	}
+	return a
+}
+
+// Roles of a group member. Admins manage the members of the group and the inventories it holds,
+// every member gets the inventory roles of the group.
+const (
+	GroupRoleMember = "member"
+	GroupRoleAdmin  = "admin"
+)
+
+var groupRoleRanks = map[string]int{
+	GroupRoleMember: 1,
+	GroupRoleAdmin:  2,
+}
+
+func IsValidGroupRole(role string) bool {
+	_, ok := groupRoleRanks[role]
+	return ok
+}
+
+// Anonymous is the user ID of requests without a login, it is never a member of anything
+const Anonymous = 0
+
+type Action string
+
+const (
+	// Browse, search and download
+	ActionRead Action = "read"
+	// Upload items into a folder
+	ActionUpload Action = "upload"
+	// Create a subfolder
+	ActionCreateFolder Action = "createFolder"
+	// Remove items and folders
+	ActionRemove Action = "remove"
+	// Rename items and folders
+	ActionRename Action = "rename"
+	// Rename a whole inventory
+	ActionRenameInventory Action = "renameInventory"
+	// Move items and folders out of their folder, the target needs ActionUpload or ActionCreateFolder
+	ActionMove Action = "move"
+	// Make items and folders public or private
+	ActionChangeVisibility Action = "changeVisibility"
+	// Add, remove and change members of an inventory
+	ActionShare Action = "share"
+	// Remove a whole inventory
+	ActionDeleteInventory Action = "deleteInventory"
+	// Remove a group
+	ActionDeleteGroup Action = "deleteGroup"
+)
+
+// The minimum inventory role for each action
+var requiredRoles = map[Action]string{
+	ActionRead:             RoleViewer,
+	ActionUpload:           RoleEditor,
+	ActionCreateFolder:     RoleEditor,
+	ActionRemove:           RoleEditor,
+	ActionRename:           RoleEditor,
+	ActionMove:             RoleEditor,
+	ActionChangeVisibility: RoleEditor,
+	ActionShare:            RoleOwner,
+	ActionRenameInventory:  RoleOwner,
+	ActionDeleteInventory:  RoleOwner,
+}
+
+// The minimum group role for each action on a group
+var requiredGroupRoles = map[Action]string{
+	// See the members and inventories of the group
+	ActionRead: GroupRoleMember,
+	// Add and remove members and inventories
+	ActionShare:       GroupRoleAdmin,
+	ActionDeleteGroup: GroupRoleAdmin,
+}
+
+type ResourceKind int
+
+const (
+	KindItem ResourceKind = iota
+	KindFolder
+	KindInventory
+	KindAsset
+	KindGroup
+)
+
+// Resource is anything a permission can be checked on. Items, folders, inventories and groups are
+// identified by their ID, assets by their hash.
+type Resource struct {
+	Kind ResourceKind
+	ID   int
+	Hash string
+}
+
+func Item(itemId int) Resource           { return Resource{Kind: KindItem, ID: itemId} }
+func Folder(folderId int) Resource       { return Resource{Kind: KindFolder, ID: folderId} }
+func Inventory(inventoryId int) Resource { return Resource{Kind: KindInventory, ID: inventoryId} }
+func Asset(hash string) Resource         { return Resource{Kind: KindAsset, Hash: hash} }
+func Group(groupId int) Resource         { return Resource{Kind: KindGroup, ID: groupId} }
+
+func (r Resource) String() string {
+	switch r.Kind {
+	case KindItem:
+		return fmt.Sprintf("item %d", r.ID)
+	case KindFolder:
+		return fmt.Sprintf("folder %d", r.ID)
+	case KindInventory:
+		return fmt.Sprintf("inventory %d", r.ID)
+	case KindAsset:
+		return "asset " + r.Hash
+	case KindGroup:
+		return fmt.Sprintf("group %d", r.ID)
+	}
+	return "unknown resource"
+}
+
+// inventoryOf resolves the inventory a resource belongs to, found is false for resources that don't exist
+func inventoryOf(resource Resource) (int, bool, error) {
+	switch resource.Kind {
+	case KindInventory:
+		return resource.ID, true, nil
+	case KindFolder:
+		return store.FolderInventory(resource.ID)
+	case KindItem:
+		folderId, found, err := store.ItemFolder(resource.ID)
+		if err != nil || !found {
+			return -1, found, err
+		}
+		return store.FolderInventory(folderId)
+	}
+	return -1, false, fmt.Errorf("%s has no single inventory", resource)
+}
+
+// Role returns the role of the user in the inventory the resource belongs to,
+// an empty string if they aren't a member or the resource doesn't exist
+func Role(userId int, resource Resource) (string, error) {
+	if userId == Anonymous {
+		return "", nil
+	}
+	inventoryId, found, err := inventoryOf(resource)
+	if err != nil || !found {
+		return "", err
+	}
+	return store.InventoryRole(inventoryId, userId)
+}
+
+// Can reports whether the user may perform the action on the resource. Resources that don't exist
+// are denied like ones the user has no access to, so IDs of other users' resources don't leak.
+func Can(userId int, action Action, resource Resource) (bool, error) {
+	if resource.Kind == KindGroup {
+		return canOnGroup(userId, action, resource.ID)
+	}
+	required, ok := requiredRoles[action]
+	if !ok {
+		return false, fmt.Errorf("unknown action %q", action)
+	}
+	if resource.Kind == KindAsset {
+		// Assets are only ever downloaded, they change through the items using them
+		if action != ActionRead {
+			return false, nil
+		}
+		return canReadAsset(userId, resource.Hash)
+	}
+	role, err := Role(userId, resource)
+	if err != nil {
+		return false, err
+	}
+	if RoleAtLeast(role, required) {
+		return true, nil
+	}
+	// Public items and folders can be read by everyone, without an account too
+	if action == ActionRead && (resource.Kind == KindItem || resource.Kind == KindFolder) {
+		return IsPublic(resource)
+	}
+	return false, nil
+}
+
+// WalkAncestors calls step with the folder and then with every folder above it, until the root folder
+// has been visited or step returns false. step returns the parent of the folder it was given, -1 for roots.
+func WalkAncestors(folderId int, step func(folderId int) (int, bool, error)) error {
+	for depth := 0; folderId != -1; depth++ {
+		if depth >= MaxFolderDepth {
+			return ErrFolderChainTooDeep
+		}
+		parentId, more, err := step(folderId)
+		if err != nil || !more {
+			return err
+		}
+		folderId = parentId
+	}
+	return nil
+}
+
+// IsPublic reports whether an item or folder is visible to everyone. Items and folders without a
+// visibility of their own inherit it from the folder above them, up to the root folder of the
+// inventory, which stands for the whole inventory. Anything never made public is private.
+func IsPublic(resource Resource) (bool, error) {
+	var folderId int
+	switch resource.Kind {
+	case KindItem:
+		visibility, parentId, found, err := store.ItemVisibility(resource.ID)
+		if err != nil || !found {
+			return false, err
+		}
+		if visibility.Valid {
+			return visibility.Bool, nil
+		}
+		folderId = parentId
+	case KindFolder:
+		folderId = resource.ID
+	default:
+		return false, nil
+	}
+	public := false
+	err := WalkAncestors(folderId, func(folderId int) (int, bool, error) {
+		visibility, parentId, found, err := store.FolderVisibility(folderId)
+		if err != nil || !found {
+			return -1, false, err
+		}
+		if visibility.Valid {
+			public = visibility.Bool
+			return -1, false, nil
+		}
+		return parentId, true, nil
+	})
+	if err == ErrFolderChainTooDeep {
+		return false, nil
+	}
+	return public, err
+}
+
+// PublicItems returns the items using the asset that are visible to everyone
+func PublicItems(hash string) ([]int, error) {
+	items, err := store.AssetItems(hash)
+	if err != nil {
+		return nil, err
+	}
+	var public []int
+	for _, item := range items {
+		isPublic, err := IsPublic(Item(item.ItemId))
+		if err != nil {
+			return nil, err
+		}
+		if isPublic {
+			public = append(public, item.ItemId)
+		}
+	}
+	return public, nil
+}
+
+// An asset can be read by anyone when an item using it is public, otherwise by every member
+// of an inventory containing such an item
+func canReadAsset(userId int, hash string) (bool, error) {
+	items, err := store.AssetItems(hash)
+	if err != nil {
+		return false, err
+	}
+	for _, item := range items {
+		public, err := IsPublic(Item(item.ItemId))
+		if err != nil {
+			return false, err
+		}
+		if public {
+			return true, nil
+		}
+	}
+	if userId == Anonymous {
+		return false, nil
+	}
+	for _, item := range items {
+		role, err := store.InventoryRole(item.InventoryId, userId)
+		if err != nil {
+			return false, err
+		}
+		if RoleAtLeast(role, RoleViewer) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func canOnGroup(userId int, action Action, groupId int) (bool, error) {
+	required, ok := requiredGroupRoles[action]
+	if !ok {
+		return false, fmt.Errorf("unknown action %q on a group", action)
+	}
+	if userId == Anonymous {
+		return false, nil
+	}
+	role, err := store.GroupRole(groupId, userId)
+	if err != nil {
+		return false, err
+	}
+	return groupRoleRanks[role] > 0 && groupRoleRanks[role] >= groupRoleRanks[required], nil
+}
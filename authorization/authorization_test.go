@@ -0,0 +1,471 @@
+package authorization
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+)
+
+// fakeStore holds two inventories:
+//
+//	inventory 1: owner 1, editor 2, viewer 3; folders 10 (root) and 11; item 100 in folder 11
+//	inventory 2: owner 4; folder 20 (root) with item 200 and public item 203,
+//	             public folder 21 with items 201 and private 202,
+//	             below it private folder 22 and folder 23 inheriting
+//
+// group 7: admin 1, member 3
+//
+// user 5 isn't a member of anything
+type fakeStore struct {
+	roles   map[[2]int]string
+	groups  map[[2]int]string
+	folders map[int]fakeFolder
+	items   map[int]fakeItem
+	assets  map[string][]int
+	err     error
+}
+
+type fakeFolder struct {
+	inventory int
+	parent    int
+	public    sql.NullBool
+}
+
+type fakeItem struct {
+	folder int
+	public sql.NullBool
+}
+
+var (
+	public  = sql.NullBool{Bool: true, Valid: true}
+	private = sql.NullBool{Bool: false, Valid: true}
+)
+
+func (s *fakeStore) InventoryRole(inventoryId int, userId int) (string, error) {
+	return s.roles[[2]int{inventoryId, userId}], s.err
+}
+
+func (s *fakeStore) GroupRole(groupId int, userId int) (string, error) {
+	return s.groups[[2]int{groupId, userId}], s.err
+}
+
+func (s *fakeStore) FolderInventory(folderId int) (int, bool, error) {
+	folder, ok := s.folders[folderId]
+	return folder.inventory, ok, s.err
+}
+
+func (s *fakeStore) ItemFolder(itemId int) (int, bool, error) {
+	item, ok := s.items[itemId]
+	return item.folder, ok, s.err
+}
+
+func (s *fakeStore) FolderVisibility(folderId int) (sql.NullBool, int, bool, error) {
+	folder, ok := s.folders[folderId]
+	return folder.public, folder.parent, ok, s.err
+}
+
+func (s *fakeStore) ItemVisibility(itemId int) (sql.NullBool, int, bool, error) {
+	item, ok := s.items[itemId]
+	return item.public, item.folder, ok, s.err
+}
+
+func (s *fakeStore) AssetItems(hash string) ([]AssetItem, error) {
+	var items []AssetItem
+	for _, itemId := range s.assets[hash] {
+		inventoryId, _, _ := s.FolderInventory(s.items[itemId].folder)
+		items = append(items, AssetItem{ItemId: itemId, InventoryId: inventoryId})
+	}
+	return items, s.err
+}
+
+const (
+	owner    = 1
+	editor   = 2
+	viewer   = 3
+	outsider = 5
+)
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{
+		roles: map[[2]int]string{
+			{1, owner}:  RoleOwner,
+			{1, editor}: RoleEditor,
+			{1, viewer}: RoleViewer,
+			{2, 4}:      RoleOwner,
+		},
+		groups: map[[2]int]string{
+			{7, owner}:  GroupRoleAdmin,
+			{7, viewer}: GroupRoleMember,
+		},
+		folders: map[int]fakeFolder{
+			10: {inventory: 1, parent: -1},
+			11: {inventory: 1, parent: 10},
+			20: {inventory: 2, parent: -1},
+			21: {inventory: 2, parent: 20, public: public},
+			22: {inventory: 2, parent: 21, public: private},
+			23: {inventory: 2, parent: 21},
+		},
+		items: map[int]fakeItem{
+			100: {folder: 11},
+			200: {folder: 20},
+			201: {folder: 21},
+			202: {folder: 21, public: private},
+			203: {folder: 20, public: public},
+		},
+		assets: map[string][]int{
+			"sharedhash":     {200, 100},
+			"privatehash":    {200},
+			"publichash":     {201},
+			"publicitemhash": {203},
+			"overriddenhash": {202},
+		},
+	}
+}
+
+func useStore(t *testing.T, s Store) {
+	previous := store
+	store = s
+	t.Cleanup(func() { store = previous })
+}
+
+// Every endpoint with the resource it checks and the lowest role that passes, the action comes from
+// EndpointAction like in the handlers. Public resources pass for everyone, their minimum is empty.
+var endpoints = []struct {
+	endpoint string
+	resource Resource
+	minimum  string
+}{
+	{"GET /query/childFolders", Folder(11), RoleViewer},
+	{"GET /query/childItems", Folder(11), RoleViewer},
+	{"GET /query/folderContent", Folder(10), RoleViewer},
+	{"GET /query/inventoryRootFolder", Inventory(1), RoleViewer},
+	{"GET /query/search", Inventory(1), RoleViewer},
+	{"GET /query/inventoryMembers", Inventory(1), RoleViewer},
+	{"GET /query/catalog", Item(201), ""},
+	{"GET /api/inventory/rootFolder", Inventory(1), RoleViewer},
+	{"GET /folder", Folder(11), RoleViewer},
+	{"GET /assets/", Asset("publichash"), ""},
+	{"GET /assets/signed/", Asset("sharedhash"), RoleViewer},
+	{"POST /upload", Folder(11), RoleEditor},
+	{"POST /addFolder", Folder(10), RoleEditor},
+	{"POST /removeItem", Item(100), RoleEditor},
+	{"POST /removeFolder", Folder(11), RoleEditor},
+	{"POST /removeInventory", Inventory(1), RoleOwner},
+	{"POST /changeVisibility", Item(100), RoleEditor},
+	{"POST /changeFolderVisibility", Folder(11), RoleEditor},
+	{"POST /changeInventoryVisibility", Inventory(1), RoleEditor},
+	{"POST /renameItem", Item(100), RoleEditor},
+	{"POST /renameFolder", Folder(11), RoleEditor},
+	{"POST /renameInventory", Inventory(1), RoleOwner},
+	{"POST /moveItem", Item(100), RoleEditor},
+	{"POST /moveItem target", Folder(10), RoleEditor},
+	{"POST /moveFolder", Folder(11), RoleEditor},
+	{"POST /moveFolder target", Folder(10), RoleEditor},
+	{"POST /shareInventory", Inventory(1), RoleOwner},
+	{"POST /unshareInventory", Inventory(1), RoleOwner},
+	{"POST /unshareInventory self", Inventory(1), RoleViewer},
+	{"POST /shareLinks/create", Folder(11), RoleOwner},
+	{"GET /shareLinks/list", Folder(11), RoleOwner},
+	{"POST /shareLinks/revoke", Folder(11), RoleOwner},
+	{"POST /inbox/send", Item(100), RoleViewer},
+	{"POST /inbox/accept", Folder(11), RoleEditor},
+	{"POST /groups/addInventory inventory", Inventory(1), RoleOwner},
+	{"POST /groups/removeInventory inventory", Inventory(1), RoleOwner},
+}
+
+func TestEndpoints(t *testing.T) {
+	useStore(t, newFakeStore())
+	users := []struct {
+		name   string
+		userId int
+		role   string
+	}{
+		{"owner", owner, RoleOwner},
+		{"editor", editor, RoleEditor},
+		{"viewer", viewer, RoleViewer},
+		{"outsider", outsider, ""},
+		{"anonymous", Anonymous, ""},
+	}
+	for _, e := range endpoints {
+		for _, u := range users {
+			t.Run(e.endpoint+"/"+u.name, func(t *testing.T) {
+				want := e.minimum == "" || RoleAtLeast(u.role, e.minimum)
+				action := EndpointAction(e.endpoint)
+				got, err := Can(u.userId, action, e.resource)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if got != want {
+					t.Errorf("Can(%d, %s, %s) = %v, want %v", u.userId, action, e.resource, got, want)
+				}
+			})
+		}
+	}
+}
+
+// Group endpoints check the group role instead of an inventory role
+var groupEndpoints = []struct {
+	endpoint string
+	admin    bool
+}{
+	{"GET /groups/members", false},
+	{"GET /groups/inventories", false},
+	{"POST /groups/addMember", true},
+	{"POST /groups/removeMember", true},
+	{"POST /groups/removeMember self", false},
+	{"POST /groups/addInventory", true},
+	{"POST /groups/removeInventory", true},
+	{"POST /groups/delete", true},
+}
+
+func TestGroupEndpoints(t *testing.T) {
+	useStore(t, newFakeStore())
+	users := []struct {
+		name   string
+		userId int
+		member bool
+		admin  bool
+	}{
+		{"admin", owner, true, true},
+		{"member", viewer, true, false},
+		{"outsider", editor, false, false},
+		{"anonymous", Anonymous, false, false},
+	}
+	for _, e := range groupEndpoints {
+		for _, u := range users {
+			t.Run(e.endpoint+"/"+u.name, func(t *testing.T) {
+				want := u.member && (u.admin || !e.admin)
+				action := EndpointAction(e.endpoint)
+				got, err := Can(u.userId, action, Group(7))
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if got != want {
+					t.Errorf("Can(%d, %s, %s) = %v, want %v", u.userId, action, Group(7), got, want)
+				}
+			})
+		}
+	}
+}
+
+// Every endpoint handlers look up needs a row above, so no check goes untested
+func TestEndpointsCovered(t *testing.T) {
+	tested := map[string]bool{}
+	for _, e := range endpoints {
+		tested[e.endpoint] = true
+	}
+	for _, e := range groupEndpoints {
+		tested[e.endpoint] = true
+	}
+	for endpoint := range endpointActions {
+		if !tested[endpoint] {
+			t.Errorf("%s has no test row", endpoint)
+		}
+	}
+	if action := EndpointAction("POST /unknown"); action != "" {
+		t.Errorf("EndpointAction of an unknown endpoint = %q, want none", action)
+	}
+}
+
+func TestResources(t *testing.T) {
+	useStore(t, newFakeStore())
+	tests := []struct {
+		name     string
+		userId   int
+		action   Action
+		resource Resource
+		want     bool
+	}{
+		{"item in another inventory", owner, ActionRead, Item(200), false},
+		{"folder in another inventory", owner, ActionRead, Folder(20), false},
+		{"inventory of someone else", owner, ActionRead, Inventory(2), false},
+		{"owner of the other inventory", 4, ActionRemove, Item(200), true},
+		{"missing item", owner, ActionRead, Item(999), false},
+		{"missing folder", owner, ActionRead, Folder(999), false},
+		{"missing inventory", owner, ActionRead, Inventory(999), false},
+		{"private asset of another inventory", owner, ActionRead, Asset("privatehash"), false},
+		{"private asset for anonymous", Anonymous, ActionRead, Asset("privatehash"), false},
+		{"public asset for anonymous", Anonymous, ActionRead, Asset("publichash"), true},
+		{"public asset for outsider", outsider, ActionRead, Asset("publichash"), true},
+		{"unknown asset", owner, ActionRead, Asset("missinghash"), false},
+		{"assets can't be changed directly", owner, ActionRemove, Asset("sharedhash"), false},
+		{"asset of a public item in a private folder", Anonymous, ActionRead, Asset("publicitemhash"), true},
+		{"asset of a private item in a public folder", Anonymous, ActionRead, Asset("overriddenhash"), false},
+		{"public folder for anonymous", Anonymous, ActionRead, Folder(21), true},
+		{"public folder for outsider", outsider, ActionRead, Folder(21), true},
+		{"subfolder inheriting public", Anonymous, ActionRead, Folder(23), true},
+		{"private subfolder of a public folder", Anonymous, ActionRead, Folder(22), false},
+		{"parent of a public folder", Anonymous, ActionRead, Folder(20), false},
+		{"item inheriting public", Anonymous, ActionRead, Item(201), true},
+		{"private item in a public folder", Anonymous, ActionRead, Item(202), false},
+		{"public item in a private folder", Anonymous, ActionRead, Item(203), true},
+		{"public folder can't be changed by outsiders", outsider, ActionUpload, Folder(21), false},
+		{"public item can't be removed by outsiders", outsider, ActionRemove, Item(203), false},
+		{"public folder can't be renamed by outsiders", outsider, ActionRename, Folder(21), false},
+		{"public item can't be moved by outsiders", outsider, ActionMove, Item(201), false},
+		{"no moving into another user's inventory", owner, ActionUpload, Folder(20), false},
+		{"public folder is private to inventory actions", outsider, ActionRead, Inventory(2), false},
+		{"missing group", owner, ActionRead, Group(999), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Can(tt.userId, tt.action, tt.resource)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Can(%d, %s, %s) = %v, want %v", tt.userId, tt.action, tt.resource, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestErrors(t *testing.T) {
+	failing := newFakeStore()
+	failing.err = errors.New("database down")
+	useStore(t, failing)
+	tests := []struct {
+		name     string
+		action   Action
+		resource Resource
+	}{
+		{"unknown action", Action("fly"), Folder(10)},
+		{"inventory action on a group", ActionUpload, Group(7)},
+		{"store error on group", ActionRead, Group(7)},
+		{"store error on folder", ActionRead, Folder(10)},
+		{"store error on item", ActionRemove, Item(100)},
+		{"store error on asset", ActionRead, Asset("sharedhash")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowed, err := Can(owner, tt.action, tt.resource)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if allowed {
+				t.Error("a failed check must not allow the action")
+			}
+		})
+	}
+}
+
+func TestIsPublic(t *testing.T) {
+	useStore(t, newFakeStore())
+	tests := []struct {
+		resource Resource
+		want     bool
+	}{
+		{Folder(10), false},
+		{Folder(21), true},
+		{Folder(22), false},
+		{Folder(23), true},
+		{Item(100), false},
+		{Item(201), true},
+		{Item(202), false},
+		{Item(203), true},
+		{Item(999), false},
+		{Folder(999), false},
+		{Inventory(2), false},
+		{Asset("publichash"), false},
+	}
+	for _, tt := range tests {
+		got, err := IsPublic(tt.resource)
+		if err != nil {
+			t.Fatalf("IsPublic(%s): unexpected error: %v", tt.resource, err)
+		}
+		if got != tt.want {
+			t.Errorf("IsPublic(%s) = %v, want %v", tt.resource, got, tt.want)
+		}
+	}
+
+	failing := newFakeStore()
+	failing.err = errors.New("database down")
+	useStore(t, failing)
+	if public, err := Can(Anonymous, ActionRead, Folder(21)); err == nil || public {
+		t.Errorf("Can with a failing store = %v, %v, want false and an error", public, err)
+	}
+}
+
+func TestPublicItems(t *testing.T) {
+	useStore(t, newFakeStore())
+	tests := []struct {
+		hash string
+		want []int
+	}{
+		{"publichash", []int{201}},
+		{"publicitemhash", []int{203}},
+		{"sharedhash", nil},
+		{"overriddenhash", nil},
+		{"unknownhash", nil},
+	}
+	for _, tt := range tests {
+		got, err := PublicItems(tt.hash)
+		if err != nil {
+			t.Fatalf("PublicItems(%q): unexpected error: %v", tt.hash, err)
+		}
+		if len(got) != len(tt.want) || (len(got) > 0 && got[0] != tt.want[0]) {
+			t.Errorf("PublicItems(%q) = %v, want %v", tt.hash, got, tt.want)
+		}
+	}
+}
+
+func TestWalkAncestors(t *testing.T) {
+	parents := map[int]int{1: -1, 2: 1, 3: 2, 8: 9, 9: 8}
+	step := func(visited *[]int) func(int) (int, bool, error) {
+		return func(folderId int) (int, bool, error) {
+			*visited = append(*visited, folderId)
+			return parents[folderId], folderId != 2, nil
+		}
+	}
+
+	var visited []int
+	if err := WalkAncestors(3, step(&visited)); err != nil || len(visited) != 2 || visited[1] != 2 {
+		t.Errorf("WalkAncestors(3) visited %v, %v, want [3 2] and no error", visited, err)
+	}
+	visited = nil
+	if err := WalkAncestors(1, step(&visited)); err != nil || len(visited) != 1 {
+		t.Errorf("WalkAncestors(1) visited %v, %v, want [1] and no error", visited, err)
+	}
+	visited = nil
+	if err := WalkAncestors(8, step(&visited)); err != ErrFolderChainTooDeep || len(visited) != MaxFolderDepth {
+		t.Errorf("WalkAncestors on a loop = %v after %d folders, want ErrFolderChainTooDeep after %d", err, len(visited), MaxFolderDepth)
+	}
+}
+
+func TestRoleAtLeast(t *testing.T) {
+	tests := []struct {
+		role     string
+		required string
+		want     bool
+	}{
+		{RoleOwner, RoleViewer, true},
+		{RoleOwner, RoleOwner, true},
+		{RoleEditor, RoleOwner, false},
+		{RoleViewer, RoleEditor, false},
+		{"", RoleViewer, false},
+		{"admin", RoleViewer, false},
+	}
+	for _, tt := range tests {
+		if got := RoleAtLeast(tt.role, tt.required); got != tt.want {
+			t.Errorf("RoleAtLeast(%q, %q) = %v, want %v", tt.role, tt.required, got, tt.want)
+		}
+	}
+}
+
+func TestHighestRole(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want string
+	}{
+		{"", RoleViewer, RoleViewer},
+		{RoleEditor, RoleViewer, RoleEditor},
+		{RoleViewer, RoleOwner, RoleOwner},
+		{RoleOwner, "", RoleOwner},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		if got := HighestRole(tt.a, tt.b); got != tt.want {
+			t.Errorf("HighestRole(%q, %q) = %q, want %q", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package authorization
+
+// The action each endpoint checks. Endpoints running a second check, like the target folder of a move,
+// list it under the endpoint followed by what it is about.
+var endpointActions = map[string]Action{
+	"GET /query/childFolders":                ActionRead,
+	"GET /query/childItems":                  ActionRead,
+	"GET /query/folderContent":               ActionRead,
+	"GET /query/inventoryRootFolder":         ActionRead,
+	"GET /query/search":                      ActionRead,
+	"GET /query/inventoryMembers":            ActionRead,
+	"GET /query/catalog":                     ActionRead, // checked in SQL for anonymous users, see query.GetCatalog
+	"GET /api/inventory/rootFolder":          ActionRead,
+	"GET /folder":                            ActionRead,
+	"GET /assets/":                           ActionRead,
+	"GET /assets/signed/":                    ActionRead,
+	"POST /upload":                           ActionUpload,
+	"POST /addFolder":                        ActionCreateFolder,
+	"POST /removeItem":                       ActionRemove,
+	"POST /removeFolder":                     ActionRemove,
+	"POST /removeInventory":                  ActionDeleteInventory,
+	"POST /changeVisibility":                 ActionChangeVisibility,
+	"POST /changeFolderVisibility":           ActionChangeVisibility,
+	"POST /changeInventoryVisibility":        ActionChangeVisibility,
+	"POST /renameItem":                       ActionRename,
+	"POST /renameFolder":                     ActionRename,
+	"POST /renameInventory":                  ActionRenameInventory,
+	"POST /moveItem":                         ActionMove,
+	"POST /moveItem target":                  ActionUpload,
+	"POST /moveFolder":                       ActionMove,
+	"POST /moveFolder target":                ActionCreateFolder,
+	"POST /shareInventory":                   ActionShare,
+	"POST /unshareInventory":                 ActionShare,
+	"POST /unshareInventory self":            ActionRead,
+	"POST /shareLinks/create":                ActionShare,
+	"GET /shareLinks/list":                   ActionShare,
+	"POST /shareLinks/revoke":                ActionShare,
+	"POST /inbox/send":                       ActionRead,
+	"POST /inbox/accept":                     ActionUpload,
+	"GET /groups/members":                    ActionRead,
+	"GET /groups/inventories":                ActionRead,
+	"POST /groups/addMember":                 ActionShare,
+	"POST /groups/removeMember":              ActionShare,
+	"POST /groups/removeMember self":         ActionRead,
+	"POST /groups/addInventory":              ActionShare,
+	"POST /groups/addInventory inventory":    ActionShare,
+	"POST /groups/removeInventory":           ActionShare,
+	"POST /groups/removeInventory inventory": ActionShare,
+	"POST /groups/delete":                    ActionDeleteGroup,
+}
+
+// EndpointAction returns the action the handler of the endpoint checks, like "POST /upload".
+// Handlers take their action from here so the tests of this package cover what they really check.
+// An unknown endpoint gets no action, which Can refuses with an error.
+func EndpointAction(endpoint string) Action {
+	return endpointActions[endpoint]
+}
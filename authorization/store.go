@@ -0,0 +1,132 @@
+package authorization
+
+import (
+	"database/sql"
+	"resonite-file-provider/database"
+)
+
+// Store is everything Can needs to know about the database, tests replace it with fixed data
+type Store interface {
+	// InventoryRole returns the role of the user in the inventory, directly or through their groups,
+	// an empty string if they aren't a member
+	InventoryRole(inventoryId int, userId int) (string, error)
+	GroupRole(groupId int, userId int) (string, error)
+	FolderInventory(folderId int) (int, bool, error)
+	ItemFolder(itemId int) (int, bool, error)
+	// FolderVisibility returns the visibility set on the folder itself, invalid when it inherits it,
+	// and the parent folder to inherit from, -1 for root folders
+	FolderVisibility(folderId int) (sql.NullBool, int, bool, error)
+	// ItemVisibility returns the visibility set on the item itself and the folder it is in
+	ItemVisibility(itemId int) (sql.NullBool, int, bool, error)
+	// AssetItems returns the items using the asset
+	AssetItems(hash string) ([]AssetItem, error)
+}
+
+// AssetItem is an item using an asset and the inventory it is in
+type AssetItem struct {
+	ItemId      int
+	InventoryId int
+}
+
+var store Store = dbStore{}
+
+type dbStore struct{}
+
+func (dbStore) InventoryRole(inventoryId int, userId int) (string, error) {
+	rows, err := database.Db.Query(`
+		SELECT role FROM users_inventories WHERE inventory_id = ? AND user_id = ?
+		UNION ALL
+		SELECT gi.role
+		FROM groups_inventories gi
+		INNER JOIN group_members gm ON gm.group_id = gi.group_id
+		WHERE gi.inventory_id = ? AND gm.user_id = ?`, inventoryId, userId, inventoryId, userId)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	role := ""
+	for rows.Next() {
+		var granted string
+		if err := rows.Scan(&granted); err != nil {
+			return "", err
+		}
+		role = HighestRole(role, granted)
+	}
+	return role, rows.Err()
+}
+
+func (dbStore) GroupRole(groupId int, userId int) (string, error) {
+	var role string
+	err := database.Db.QueryRow("SELECT role FROM group_members WHERE group_id = ? AND user_id = ?", groupId, userId).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+func (dbStore) FolderInventory(folderId int) (int, bool, error) {
+	var inventoryId int
+	err := database.Db.QueryRow("SELECT inventory_id FROM Folders WHERE id = ?", folderId).Scan(&inventoryId)
+	if err == sql.ErrNoRows {
+		return -1, false, nil
+	} else if err != nil {
+		return -1, false, err
+	}
+	return inventoryId, true, nil
+}
+
+func (dbStore) ItemFolder(itemId int) (int, bool, error) {
+	var folderId int
+	err := database.Db.QueryRow("SELECT folder_id FROM Items WHERE id = ?", itemId).Scan(&folderId)
+	if err == sql.ErrNoRows {
+		return -1, false, nil
+	} else if err != nil {
+		return -1, false, err
+	}
+	return folderId, true, nil
+}
+
+func (dbStore) FolderVisibility(folderId int) (sql.NullBool, int, bool, error) {
+	var visibility sql.NullBool
+	var parentId int
+	err := database.Db.QueryRow("SELECT isPublic = 1, parent_folder_id FROM Folders WHERE id = ?", folderId).Scan(&visibility, &parentId)
+	if err == sql.ErrNoRows {
+		return visibility, -1, false, nil
+	} else if err != nil {
+		return visibility, -1, false, err
+	}
+	return visibility, parentId, true, nil
+}
+
+func (dbStore) ItemVisibility(itemId int) (sql.NullBool, int, bool, error) {
+	var visibility sql.NullBool
+	var folderId int
+	err := database.Db.QueryRow("SELECT isPublic = 1, folder_id FROM Items WHERE id = ?", itemId).Scan(&visibility, &folderId)
+	if err == sql.ErrNoRows {
+		return visibility, -1, false, nil
+	} else if err != nil {
+		return visibility, -1, false, err
+	}
+	return visibility, folderId, true, nil
+}
+
+func (dbStore) AssetItems(hash string) ([]AssetItem, error) {
+	rows, err := database.Db.Query(`
+		SELECT i.id, f.inventory_id
+		FROM Items i
+		INNER JOIN Folders f ON f.id = i.folder_id
+		WHERE i.url = ?`, hash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []AssetItem
+	for rows.Next() {
+		var item AssetItem
+		if err := rows.Scan(&item.ItemId, &item.InventoryId); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
@@ -5,8 +5,13 @@ import (
 )
 
 type Config struct {
-	Database DatabaseConfig
-	Server   ServerConfig
+	Database     DatabaseConfig
+	Server       ServerConfig
+	Auth         AuthConfig
+	RateLimit    RateLimitConfig
+	Registration RegistrationConfig
+	OIDC         OIDCConfig
+	Assets       AssetsConfig
 }
 
 type ServerConfig struct {
@@ -15,6 +20,45 @@ type ServerConfig struct {
 	AssetsPath string
 }
 
+type AuthConfig struct {
+	AccessTokenMinutes   int
+	RefreshTokenHours    int
+	JwtKeyGraceHours     int
+	PasswordResetMinutes int
+	// Argon2id cost of new password hashes, older hashes are upgraded on login
+	Argon2MemoryKiB   int
+	Argon2Iterations  int
+	Argon2Parallelism int
+}
+
+// Failed login and register attempts per username and per IP
+type RateLimitConfig struct {
+	MaxFailures          int
+	BaseLockoutSeconds   int
+	MaxLockoutSeconds    int
+	FailureWindowMinutes int
+}
+
+type RegistrationConfig struct {
+	// open, invite-only or closed
+	Mode string
+}
+
+// OpenID Connect login, disabled while Issuer is empty. The client secret is read from OIDC_CLIENT_SECRET.
+type OIDCConfig struct {
+	Issuer      string
+	ClientID    string
+	RedirectURL string
+	// Space separated, defaults to "openid profile"
+	Scopes      string
+	DisplayName string
+}
+
+type AssetsConfig struct {
+	// Lifetime of the signed asset URLs returned by listings, defaults to 60
+	SignedURLMinutes int
+}
+
 type DatabaseConfig struct {
 	User     string
 	Password string
@@ -2,14 +2,16 @@ module resonite-file-provider
 
 go 1.24.1
 
+require (
+	github.com/BurntSushi/toml v1.5.0
+	github.com/andybalholm/brotli v1.1.1
+	github.com/go-sql-driver/mysql v1.9.1
+	github.com/golang-jwt/jwt/v5 v5.2.2
+	go.mongodb.org/mongo-driver v1.17.3
+	golang.org/x/crypto v0.37.0
+)
+
 require (
 	filippo.io/edwards25519 v1.1.0 // indirect
-	github.com/BurntSushi/toml v1.5.0 // indirect
-	github.com/andybalholm/brotli v1.1.1 // indirect
-	github.com/go-sql-driver/mysql v1.9.1 // indirect
-	github.com/golang-jwt/jwt/v5 v5.2.2 // indirect
-	go.mongodb.org/mongo-driver v1.17.3 // indirect
-	golang.org/x/crypto v0.37.0 // indirect
-	golang.org/x/net v0.21.0 // indirect
-	golang.org/x/text v0.24.0 // indirect
+	golang.org/x/sys v0.32.0 // indirect
 )
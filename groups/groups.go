@@ -0,0 +1,314 @@
+// Package groups lets teams hold inventories together. Every member of a group gets the role the group
+// has in each of its inventories, group admins manage the members and which inventories the group holds.
+package groups
+
+import (
+	"database/sql"
+	"errors"
+	"resonite-file-provider/authorization"
+	"resonite-file-provider/database"
+	"strings"
+)
+
+const maxGroupNameLength = 64
+
+var (
+	errLastAdmin       = errors.New("a group needs at least one admin")
+	errLastOwner       = errors.New("an inventory needs at least one owner")
+	errSoleOwner       = errors.New("the group is the only owner of an inventory")
+	errInvalidName     = errors.New("group name must be between 1 and 64 characters long")
+	errNotGroupMember  = errors.New("user isn't a member of the group")
+	errAlreadyHasGroup = errors.New("the group already holds this inventory")
+)
+
+type Group struct {
+	ID      int
+	Name    string
+	Role    string
+	Members int
+}
+
+type Member struct {
+	UserId   int
+	Username string
+	Role     string
+}
+
+type GroupInventory struct {
+	InventoryId int
+	Name        string
+	Role        string
+}
+
+func ValidateGroupName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > maxGroupNameLength {
+		return "", errInvalidName
+	}
+	return name, nil
+}
+
+// CreateGroup creates a group with the user as its first admin
+func CreateGroup(name string, userId int) (int64, error) {
+	tx, err := database.Db.Begin()
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec("INSERT INTO `Groups` (`name`, `created_at`) VALUES (?, UTC_TIMESTAMP())", name)
+	if err != nil {
+		return -1, err
+	}
+	groupId, err := result.LastInsertId()
+	if err != nil {
+		return -1, err
+	}
+	if _, err := tx.Exec("INSERT INTO `group_members` (`group_id`, `user_id`, `role`) VALUES (?, ?, ?)", groupId, userId, authorization.GroupRoleAdmin); err != nil {
+		return -1, err
+	}
+	return groupId, tx.Commit()
+}
+
+// ListGroups returns the groups the user is a member of
+func ListGroups(userId int) ([]Group, error) {
+	rows, err := database.Db.Query(`
+		SELECT g.id, g.name, gm.role, (SELECT COUNT(*) FROM group_members c WHERE c.group_id = g.id)
+		FROM `+"`Groups`"+` g
+		INNER JOIN group_members gm ON gm.group_id = g.id
+		WHERE gm.user_id = ?
+		ORDER BY g.name`, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var groups []Group
+	for rows.Next() {
+		var group Group
+		if err := rows.Scan(&group.ID, &group.Name, &group.Role, &group.Members); err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+	return groups, rows.Err()
+}
+
+func ListMembers(groupId int) ([]Member, error) {
+	rows, err := database.Db.Query(`
+		SELECT u.id, u.username, gm.role
+		FROM group_members gm
+		INNER JOIN Users u ON u.id = gm.user_id
+		WHERE gm.group_id = ?
+		ORDER BY u.username`, groupId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var members []Member
+	for rows.Next() {
+		var member Member
+		if err := rows.Scan(&member.UserId, &member.Username, &member.Role); err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return members, rows.Err()
+}
+
+func ListInventories(groupId int) ([]GroupInventory, error) {
+	rows, err := database.Db.Query(`
+		SELECT i.id, i.name, gi.role
+		FROM groups_inventories gi
+		INNER JOIN Inventories i ON i.id = gi.inventory_id
+		WHERE gi.group_id = ?
+		ORDER BY i.id`, groupId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var inventories []GroupInventory
+	for rows.Next() {
+		var inventory GroupInventory
+		if err := rows.Scan(&inventory.InventoryId, &inventory.Name, &inventory.Role); err != nil {
+			return nil, err
+		}
+		inventories = append(inventories, inventory)
+	}
+	return inventories, rows.Err()
+}
+
+// adminCount counts the admins of the group, locking their rows until the transaction ends
+func adminCount(tx *sql.Tx, groupId int) (int, error) {
+	var count int
+	rows, err := tx.Query("SELECT id FROM group_members WHERE group_id = ? AND role = ? FOR UPDATE", groupId, authorization.GroupRoleAdmin)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		count++
+	}
+	return count, rows.Err()
+}
+
+func memberRole(tx *sql.Tx, groupId int, userId int) (string, error) {
+	var role string
+	err := tx.QueryRow("SELECT role FROM group_members WHERE group_id = ? AND user_id = ? FOR UPDATE", groupId, userId).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+// SetMember adds the user to the group or changes their role, the last admin can't be demoted
+func SetMember(groupId int, userId int, role string) error {
+	tx, err := database.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	admins, err := adminCount(tx, groupId)
+	if err != nil {
+		return err
+	}
+	current, err := memberRole(tx, groupId, userId)
+	if err != nil {
+		return err
+	}
+	if current == authorization.GroupRoleAdmin && role != authorization.GroupRoleAdmin && admins <= 1 {
+		return errLastAdmin
+	}
+	if current == "" {
+		_, err = tx.Exec("INSERT INTO group_members (group_id, user_id, role) VALUES (?, ?, ?)", groupId, userId, role)
+	} else {
+		_, err = tx.Exec("UPDATE group_members SET role = ? WHERE group_id = ? AND user_id = ?", role, groupId, userId)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RemoveMember removes the user from the group, the last admin can't leave
+func RemoveMember(groupId int, userId int) error {
+	tx, err := database.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	admins, err := adminCount(tx, groupId)
+	if err != nil {
+		return err
+	}
+	current, err := memberRole(tx, groupId, userId)
+	if err != nil {
+		return err
+	}
+	if current == "" {
+		return errNotGroupMember
+	}
+	if current == authorization.GroupRoleAdmin && admins <= 1 {
+		return errLastAdmin
+	}
+	if _, err := tx.Exec("DELETE FROM group_members WHERE group_id = ? AND user_id = ?", groupId, userId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// otherOwners counts the owners of the inventory besides the group, users and other groups alike
+func otherOwners(tx *sql.Tx, inventoryId int, groupId int) (int, error) {
+	var users, groups int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM users_inventories WHERE inventory_id = ? AND role = ?", inventoryId, authorization.RoleOwner).Scan(&users); err != nil {
+		return 0, err
+	}
+	if err := tx.QueryRow("SELECT COUNT(*) FROM groups_inventories WHERE inventory_id = ? AND role = ? AND group_id <> ?", inventoryId, authorization.RoleOwner, groupId).Scan(&groups); err != nil {
+		return 0, err
+	}
+	return users + groups, nil
+}
+
+// AddInventory gives the group a role in the inventory
+func AddInventory(groupId int, inventoryId int, role string) error {
+	var exists bool
+	err := database.Db.QueryRow("SELECT EXISTS(SELECT 1 FROM groups_inventories WHERE group_id = ? AND inventory_id = ?)", groupId, inventoryId).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errAlreadyHasGroup
+	}
+	_, err = database.Db.Exec("INSERT INTO groups_inventories (group_id, inventory_id, role) VALUES (?, ?, ?)", groupId, inventoryId, role)
+	return err
+}
+
+// RemoveInventory takes the inventory away from the group, unless nobody else would own it
+func RemoveInventory(groupId int, inventoryId int) error {
+	tx, err := database.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var role string
+	err = tx.QueryRow("SELECT role FROM groups_inventories WHERE group_id = ? AND inventory_id = ? FOR UPDATE", groupId, inventoryId).Scan(&role)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if role == authorization.RoleOwner {
+		owners, err := otherOwners(tx, inventoryId, groupId)
+		if err != nil {
+			return err
+		}
+		if owners == 0 {
+			return errLastOwner
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM groups_inventories WHERE group_id = ? AND inventory_id = ?", groupId, inventoryId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteGroup removes the group with its memberships. Inventories only the group owns have to be
+// handed over or removed first, otherwise nobody could reach them anymore.
+func DeleteGroup(groupId int) error {
+	tx, err := database.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query("SELECT inventory_id FROM groups_inventories WHERE group_id = ? AND role = ?", groupId, authorization.RoleOwner)
+	if err != nil {
+		return err
+	}
+	var owned []int
+	for rows.Next() {
+		var inventoryId int
+		if err := rows.Scan(&inventoryId); err != nil {
+			rows.Close()
+			return err
+		}
+		owned = append(owned, inventoryId)
+	}
+	rows.Close()
+	for _, inventoryId := range owned {
+		owners, err := otherOwners(tx, inventoryId, groupId)
+		if err != nil {
+			return err
+		}
+		if owners == 0 {
+			return errSoleOwner
+		}
+	}
+	for _, statement := range []string{
+		"DELETE FROM `groups_inventories` WHERE `group_id` = ?",
+		"DELETE FROM `group_members` WHERE `group_id` = ?",
+		"DELETE FROM `Groups` WHERE `id` = ?",
+	} {
+		if _, err := tx.Exec(statement, groupId); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
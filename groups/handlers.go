@@ -0,0 +1,441 @@
+package groups
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"resonite-file-provider/animxmaker"
+	"resonite-file-provider/authentication"
+	"resonite-file-provider/authorization"
+	"resonite-file-provider/database"
+	"resonite-file-provider/reply"
+	"strconv"
+	"strings"
+)
+
+func writeAnimation(w http.ResponseWriter, tracks []animxmaker.AnimationTrackWrapper) {
+	response := animxmaker.Animation{Tracks: tracks}
+	encodedResponse, err := response.EncodeAnimation("response")
+	if err != nil {
+		http.Error(w, "Error while encoding animx", http.StatusInternalServerError)
+		return
+	}
+	w.Write(encodedResponse)
+}
+
+// authorize runs the login and scope checks every group endpoint starts with
+func authorize(w http.ResponseWriter, r *http.Request, scope string, post bool) *authentication.Claims {
+	if post && r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return nil
+	}
+	claims := authentication.AuthCheck(w, r)
+	if claims == nil {
+		return nil
+	}
+	if !authentication.RequireScope(w, r, claims, scope) {
+		return nil
+	}
+	return claims
+}
+
+func intParam(w http.ResponseWriter, r *http.Request, name string) (int, bool) {
+	value, err := strconv.Atoi(r.URL.Query().Get(name))
+	if err != nil {
+		reply.Error(w, r, name+" missing or invalid", http.StatusBadRequest)
+		return -1, false
+	}
+	return value, true
+}
+
+// userParam looks up the user named by the username parameter
+func userParam(w http.ResponseWriter, r *http.Request) (int, string, bool) {
+	username := r.URL.Query().Get("username")
+	if username == "" {
+		reply.Error(w, r, "username missing", http.StatusBadRequest)
+		return -1, "", false
+	}
+	var userId int
+	err := database.Db.QueryRow("SELECT id, username FROM Users WHERE username = ?", username).Scan(&userId, &username)
+	if err == sql.ErrNoRows {
+		reply.Error(w, r, "User not found", http.StatusNotFound)
+		return -1, "", false
+	} else if err != nil {
+		reply.Error(w, r, "Server error", http.StatusInternalServerError)
+		fmt.Println("[GROUPS] Query error:", err)
+		return -1, "", false
+	}
+	return userId, username, true
+}
+
+func can(w http.ResponseWriter, r *http.Request, userId int, action authorization.Action, resource authorization.Resource, message string) bool {
+	if allowed, err := authorization.Can(userId, action, resource); err != nil || !allowed {
+		reply.Error(w, r, message, http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// handles POST /groups/create?name=, the creator becomes the first admin
+func createGroupHandler(w http.ResponseWriter, r *http.Request) {
+	claims := authorize(w, r, authentication.ScopeManage, true)
+	if claims == nil {
+		return
+	}
+	name, err := ValidateGroupName(r.URL.Query().Get("name"))
+	if err != nil {
+		reply.Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	groupId, err := CreateGroup(name, claims.UID)
+	if err != nil {
+		reply.Error(w, r, "Failed to create group", http.StatusInternalServerError)
+		fmt.Println("[GROUPS] Failed to create group:", err)
+		return
+	}
+	fmt.Println("[GROUPS]", claims.Username, "created group", name, "ID:", groupId)
+	if strings.HasPrefix(r.UserAgent(), "Resonite") {
+		w.Write([]byte(strconv.FormatInt(groupId, 10)))
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"success": true,
+			"id":      groupId,
+			"name":    name,
+		})
+	}
+}
+
+// handles GET /groups/list, the groups the user is a member of
+func listGroupsHandler(w http.ResponseWriter, r *http.Request) {
+	claims := authorize(w, r, authentication.ScopeRead, false)
+	if claims == nil {
+		return
+	}
+	groups, err := ListGroups(claims.UID)
+	if err != nil {
+		reply.Error(w, r, "Server error", http.StatusInternalServerError)
+		fmt.Println("[GROUPS] Query error:", err)
+		return
+	}
+	if strings.HasPrefix(r.UserAgent(), "Resonite") {
+		var ids, members []int
+		var names, roles []string
+		for _, group := range groups {
+			ids = append(ids, group.ID)
+			names = append(names, group.Name)
+			roles = append(roles, group.Role)
+			members = append(members, group.Members)
+		}
+		writeAnimation(w, []animxmaker.AnimationTrackWrapper{
+			animxmaker.ListTrack(ids, "groups", "id"),
+			animxmaker.ListTrack(names, "groups", "name"),
+			animxmaker.ListTrack(roles, "groups", "role"),
+			animxmaker.ListTrack(members, "groups", "members"),
+		})
+	} else {
+		var results []map[string]any
+		for _, group := range groups {
+			results = append(results, map[string]any{
+				"id":      group.ID,
+				"name":    group.Name,
+				"role":    group.Role,
+				"members": group.Members,
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"groups": results,
+		})
+	}
+}
+
+// handles GET /groups/members?groupId=
+func listMembersHandler(w http.ResponseWriter, r *http.Request) {
+	claims := authorize(w, r, authentication.ScopeRead, false)
+	if claims == nil {
+		return
+	}
+	groupId, ok := intParam(w, r, "groupId")
+	if !ok {
+		return
+	}
+	if !can(w, r, claims.UID, authorization.EndpointAction("GET /groups/members"), authorization.Group(groupId), "You aren't a member of this group") {
+		return
+	}
+	members, err := ListMembers(groupId)
+	if err != nil {
+		reply.Error(w, r, "Server error", http.StatusInternalServerError)
+		fmt.Println("[GROUPS] Query error:", err)
+		return
+	}
+	if strings.HasPrefix(r.UserAgent(), "Resonite") {
+		var ids []int
+		var usernames, roles []string
+		for _, member := range members {
+			ids = append(ids, member.UserId)
+			usernames = append(usernames, member.Username)
+			roles = append(roles, member.Role)
+		}
+		writeAnimation(w, []animxmaker.AnimationTrackWrapper{
+			animxmaker.ListTrack(ids, "members", "id"),
+			animxmaker.ListTrack(usernames, "members", "username"),
+			animxmaker.ListTrack(roles, "members", "role"),
+		})
+	} else {
+		var results []map[string]any
+		for _, member := range members {
+			results = append(results, map[string]any{
+				"id":       member.UserId,
+				"username": member.Username,
+				"role":     member.Role,
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"members": results,
+		})
+	}
+}
+
+// handles GET /groups/inventories?groupId=
+func listInventoriesHandler(w http.ResponseWriter, r *http.Request) {
+	claims := authorize(w, r, authentication.ScopeRead, false)
+	if claims == nil {
+		return
+	}
+	groupId, ok := intParam(w, r, "groupId")
+	if !ok {
+		return
+	}
+	if !can(w, r, claims.UID, authorization.EndpointAction("GET /groups/inventories"), authorization.Group(groupId), "You aren't a member of this group") {
+		return
+	}
+	inventories, err := ListInventories(groupId)
+	if err != nil {
+		reply.Error(w, r, "Server error", http.StatusInternalServerError)
+		fmt.Println("[GROUPS] Query error:", err)
+		return
+	}
+	if strings.HasPrefix(r.UserAgent(), "Resonite") {
+		var ids []int
+		var names, roles []string
+		for _, inventory := range inventories {
+			ids = append(ids, inventory.InventoryId)
+			names = append(names, inventory.Name)
+			roles = append(roles, inventory.Role)
+		}
+		writeAnimation(w, []animxmaker.AnimationTrackWrapper{
+			animxmaker.ListTrack(ids, "inventories", "id"),
+			animxmaker.ListTrack(names, "inventories", "name"),
+			animxmaker.ListTrack(roles, "inventories", "role"),
+		})
+	} else {
+		var results []map[string]any
+		for _, inventory := range inventories {
+			results = append(results, map[string]any{
+				"id":   inventory.InventoryId,
+				"name": inventory.Name,
+				"role": inventory.Role,
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"inventories": results,
+		})
+	}
+}
+
+// handles POST /groups/addMember?groupId=&username=&role=, role defaults to member.
+// Adding an existing member changes their role.
+func addMemberHandler(w http.ResponseWriter, r *http.Request) {
+	claims := authorize(w, r, authentication.ScopeManage, true)
+	if claims == nil {
+		return
+	}
+	groupId, ok := intParam(w, r, "groupId")
+	if !ok {
+		return
+	}
+	userId, username, ok := userParam(w, r)
+	if !ok {
+		return
+	}
+	role := r.URL.Query().Get("role")
+	if role == "" {
+		role = authorization.GroupRoleMember
+	}
+	if !authorization.IsValidGroupRole(role) {
+		reply.Error(w, r, "role must be member or admin", http.StatusBadRequest)
+		return
+	}
+	if !can(w, r, claims.UID, authorization.EndpointAction("POST /groups/addMember"), authorization.Group(groupId), "Only group admins can add members") {
+		return
+	}
+	err := SetMember(groupId, userId, role)
+	if err == errLastAdmin {
+		reply.Error(w, r, "A group needs at least one admin", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		reply.Error(w, r, "Failed to add member", http.StatusInternalServerError)
+		fmt.Println("[GROUPS] Failed to add member:", err)
+		return
+	}
+	fmt.Println("[GROUPS]", claims.Username, "added", username, "to group ID:", groupId, "as", role)
+	reply.Success(w, r, "Member added")
+}
+
+// handles POST /groups/removeMember?groupId=&username=. Admins can remove anyone,
+// every other member can only remove themselves to leave the group.
+func removeMemberHandler(w http.ResponseWriter, r *http.Request) {
+	claims := authorize(w, r, authentication.ScopeManage, true)
+	if claims == nil {
+		return
+	}
+	groupId, ok := intParam(w, r, "groupId")
+	if !ok {
+		return
+	}
+	userId, username, ok := userParam(w, r)
+	if !ok {
+		return
+	}
+	endpoint := "POST /groups/removeMember"
+	if userId == claims.UID {
+		endpoint += " self"
+	}
+	if !can(w, r, claims.UID, authorization.EndpointAction(endpoint), authorization.Group(groupId), "Only group admins can remove other members") {
+		return
+	}
+	err := RemoveMember(groupId, userId)
+	if err == errLastAdmin {
+		reply.Error(w, r, "A group needs at least one admin, delete the group instead", http.StatusBadRequest)
+		return
+	} else if err == errNotGroupMember {
+		reply.Error(w, r, "User isn't a member of the group", http.StatusNotFound)
+		return
+	} else if err != nil {
+		reply.Error(w, r, "Failed to remove member", http.StatusInternalServerError)
+		fmt.Println("[GROUPS] Failed to remove member:", err)
+		return
+	}
+	fmt.Println("[GROUPS]", claims.Username, "removed", username, "from group ID:", groupId)
+	reply.Success(w, r, "Member removed")
+}
+
+// handles POST /groups/addInventory?groupId=&inventoryId=&role=, role defaults to viewer.
+// The user has to be an admin of the group and an owner of the inventory.
+func addInventoryHandler(w http.ResponseWriter, r *http.Request) {
+	claims := authorize(w, r, authentication.ScopeManage, true)
+	if claims == nil {
+		return
+	}
+	groupId, ok := intParam(w, r, "groupId")
+	if !ok {
+		return
+	}
+	inventoryId, ok := intParam(w, r, "inventoryId")
+	if !ok {
+		return
+	}
+	role := r.URL.Query().Get("role")
+	if role == "" {
+		role = authorization.RoleViewer
+	}
+	if !authorization.IsValidRole(role) {
+		reply.Error(w, r, "role must be viewer, editor or owner", http.StatusBadRequest)
+		return
+	}
+	if !can(w, r, claims.UID, authorization.EndpointAction("POST /groups/addInventory"), authorization.Group(groupId), "Only group admins can add inventories") {
+		return
+	}
+	if !can(w, r, claims.UID, authorization.EndpointAction("POST /groups/addInventory inventory"), authorization.Inventory(inventoryId), "Only owners can share an inventory") {
+		return
+	}
+	err := AddInventory(groupId, inventoryId, role)
+	if err == errAlreadyHasGroup {
+		reply.Error(w, r, "The group already holds this inventory, remove it first to change the role", http.StatusConflict)
+		return
+	} else if err != nil {
+		reply.Error(w, r, "Failed to add inventory", http.StatusInternalServerError)
+		fmt.Println("[GROUPS] Failed to add inventory:", err)
+		return
+	}
+	fmt.Println("[GROUPS]", claims.Username, "shared inventory ID:", inventoryId, "with group ID:", groupId, "as", role)
+	reply.Success(w, r, "Inventory added")
+}
+
+// handles POST /groups/removeInventory?groupId=&inventoryId=, allowed for admins of the group and owners of the inventory
+func removeInventoryHandler(w http.ResponseWriter, r *http.Request) {
+	claims := authorize(w, r, authentication.ScopeManage, true)
+	if claims == nil {
+		return
+	}
+	groupId, ok := intParam(w, r, "groupId")
+	if !ok {
+		return
+	}
+	inventoryId, ok := intParam(w, r, "inventoryId")
+	if !ok {
+		return
+	}
+	groupAdmin, err := authorization.Can(claims.UID, authorization.EndpointAction("POST /groups/removeInventory"), authorization.Group(groupId))
+	if err != nil {
+		reply.Error(w, r, "Server error", http.StatusInternalServerError)
+		fmt.Println("[GROUPS] Authorization error:", err)
+		return
+	}
+	if !groupAdmin && !can(w, r, claims.UID, authorization.EndpointAction("POST /groups/removeInventory inventory"), authorization.Inventory(inventoryId), "Only group admins and inventory owners can remove an inventory from a group") {
+		return
+	}
+	err = RemoveInventory(groupId, inventoryId)
+	if err == errLastOwner {
+		reply.Error(w, r, "An inventory needs at least one owner, remove the inventory instead", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		reply.Error(w, r, "Failed to remove inventory", http.StatusInternalServerError)
+		fmt.Println("[GROUPS] Failed to remove inventory:", err)
+		return
+	}
+	fmt.Println("[GROUPS]", claims.Username, "removed inventory ID:", inventoryId, "from group ID:", groupId)
+	reply.Success(w, r, "Inventory removed")
+}
+
+// handles POST /groups/delete?groupId=
+func deleteGroupHandler(w http.ResponseWriter, r *http.Request) {
+	claims := authorize(w, r, authentication.ScopeManage, true)
+	if claims == nil {
+		return
+	}
+	groupId, ok := intParam(w, r, "groupId")
+	if !ok {
+		return
+	}
+	if !can(w, r, claims.UID, authorization.EndpointAction("POST /groups/delete"), authorization.Group(groupId), "Only group admins can delete a group") {
+		return
+	}
+	err := DeleteGroup(groupId)
+	if err == errSoleOwner {
+		reply.Error(w, r, "The group is the only owner of an inventory, give it another owner or remove it first", http.StatusConflict)
+		return
+	} else if err != nil {
+		reply.Error(w, r, "Failed to delete group", http.StatusInternalServerError)
+		fmt.Println("[GROUPS] Failed to delete group:", err)
+		return
+	}
+	fmt.Println("[GROUPS]", claims.Username, "deleted group ID:", groupId)
+	reply.Success(w, r, "Group deleted")
+}
+
+func AddGroupListeners() {
+	http.HandleFunc("/groups/create", createGroupHandler)
+	http.HandleFunc("/groups/list", listGroupsHandler)
+	http.HandleFunc("/groups/members", listMembersHandler)
+	http.HandleFunc("/groups/inventories", listInventoriesHandler)
+	http.HandleFunc("/groups/addMember", addMemberHandler)
+	http.HandleFunc("/groups/removeMember", removeMemberHandler)
+	http.HandleFunc("/groups/addInventory", addInventoryHandler)
+	http.HandleFunc("/groups/removeInventory", removeInventoryHandler)
+	http.HandleFunc("/groups/delete", deleteGroupHandler)
+}
@@ -0,0 +1,220 @@
+package inbox
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"resonite-file-provider/animxmaker"
+	"resonite-file-provider/assethost"
+	"resonite-file-provider/authentication"
+	"resonite-file-provider/authorization"
+	"resonite-file-provider/database"
+	"resonite-file-provider/reply"
+	"resonite-file-provider/upload"
+	"strconv"
+	"strings"
+)
+
+// pendingItem reads the itemId parameter and makes sure the item waits in the user's own inbox
+func pendingItem(w http.ResponseWriter, r *http.Request, userId int) (int, bool) {
+	itemId, err := strconv.Atoi(r.URL.Query().Get("itemId"))
+	if err != nil {
+		reply.Error(w, r, "itemId missing or invalid", http.StatusBadRequest)
+		return -1, false
+	}
+	recipientId, found, err := Recipient(itemId)
+	if err != nil {
+		reply.Error(w, r, "Server error", http.StatusInternalServerError)
+		fmt.Println("[INBOX] Query error:", err)
+		return -1, false
+	}
+	if !found || recipientId != userId {
+		reply.Error(w, r, "Item isn't waiting in your inbox", http.StatusNotFound)
+		return -1, false
+	}
+	return itemId, true
+}
+
+// handles POST /inbox/send?itemId=&username=
+func sendHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := authentication.AuthCheck(w, r)
+	if claims == nil {
+		return
+	}
+	if !authentication.RequireScope(w, r, claims, authentication.ScopeUpload) {
+		return
+	}
+	itemId, err := strconv.Atoi(r.URL.Query().Get("itemId"))
+	if err != nil {
+		reply.Error(w, r, "itemId missing or invalid", http.StatusBadRequest)
+		return
+	}
+	username := r.URL.Query().Get("username")
+	if username == "" {
+		reply.Error(w, r, "username missing", http.StatusBadRequest)
+		return
+	}
+	if allowed, err := authorization.Can(claims.UID, authorization.EndpointAction("POST /inbox/send"), authorization.Item(itemId)); err != nil || !allowed {
+		reply.Error(w, r, "You don't have access to this item", http.StatusForbidden)
+		return
+	}
+	var recipientId int
+	err = database.Db.QueryRow("SELECT id, username FROM Users WHERE username = ?", username).Scan(&recipientId, &username)
+	if err == sql.ErrNoRows {
+		reply.Error(w, r, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		reply.Error(w, r, "Server error", http.StatusInternalServerError)
+		fmt.Println("[INBOX] Query error:", err)
+		return
+	}
+	copyId, err := Send(itemId, claims.UID, recipientId)
+	if err == errNoInventory {
+		reply.Error(w, r, "The recipient has no inventory to receive items in", http.StatusConflict)
+		return
+	} else if err == errItemNotFound {
+		reply.Error(w, r, "You don't have access to this item", http.StatusForbidden)
+		return
+	} else if err != nil {
+		reply.Error(w, r, "Failed to send item", http.StatusInternalServerError)
+		fmt.Println("[INBOX] Failed to send item:", err)
+		return
+	}
+	fmt.Println("[INBOX]", claims.Username, "sent item ID:", itemId, "to", username, "as item ID:", copyId)
+	reply.Success(w, r, "Item sent")
+}
+
+// handles GET /inbox/list
+func listHandler(w http.ResponseWriter, r *http.Request) {
+	claims := authentication.AuthCheck(w, r)
+	if claims == nil {
+		return
+	}
+	if !authentication.RequireScope(w, r, claims, authentication.ScopeRead) {
+		return
+	}
+	deliveries, err := Pending(claims.UID)
+	if err != nil {
+		reply.Error(w, r, "Server error", http.StatusInternalServerError)
+		fmt.Println("[INBOX] Query error:", err)
+		return
+	}
+	for i := range deliveries {
+		deliveries[i].URL = assethost.SignedURL(claims.UID, filepath.Base(deliveries[i].URL))
+	}
+	if strings.HasPrefix(r.UserAgent(), "Resonite") {
+		var ids []int
+		var names, urls, senders, sentAt []string
+		for _, delivery := range deliveries {
+			ids = append(ids, delivery.ItemId)
+			names = append(names, delivery.Name)
+			urls = append(urls, delivery.URL)
+			senders = append(senders, delivery.Sender)
+			sentAt = append(sentAt, delivery.SentAt)
+		}
+		response := animxmaker.Animation{
+			Tracks: []animxmaker.AnimationTrackWrapper{
+				animxmaker.ListTrack(ids, "items", "id"),
+				animxmaker.ListTrack(names, "items", "name"),
+				animxmaker.ListTrack(urls, "items", "url"),
+				animxmaker.ListTrack(senders, "items", "sender"),
+				animxmaker.ListTrack(sentAt, "items", "sentAt"),
+			},
+		}
+		encodedResponse, err := response.EncodeAnimation("response")
+		if err != nil {
+			http.Error(w, "Error while encoding animx", http.StatusInternalServerError)
+			return
+		}
+		w.Write(encodedResponse)
+	} else {
+		var results []map[string]any
+		for _, delivery := range deliveries {
+			results = append(results, map[string]any{
+				"id":     delivery.ItemId,
+				"name":   delivery.Name,
+				"url":    delivery.URL,
+				"sender": delivery.Sender,
+				"sentAt": delivery.SentAt,
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"items": results,
+		})
+	}
+}
+
+// handles POST /inbox/accept?itemId=&folderId=, moves the item into a folder the user can upload to
+func acceptHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := authentication.AuthCheck(w, r)
+	if claims == nil {
+		return
+	}
+	if !authentication.RequireScope(w, r, claims, authentication.ScopeUpload) {
+		return
+	}
+	itemId, ok := pendingItem(w, r, claims.UID)
+	if !ok {
+		return
+	}
+	folderId, err := strconv.Atoi(r.URL.Query().Get("folderId"))
+	if err != nil {
+		reply.Error(w, r, "folderId missing or invalid", http.StatusBadRequest)
+		return
+	}
+	if allowed, err := authorization.Can(claims.UID, authorization.EndpointAction("POST /inbox/accept"), authorization.Folder(folderId)); err != nil || !allowed {
+		reply.Error(w, r, "You can't add items to this folder", http.StatusForbidden)
+		return
+	}
+	if err := Accept(itemId, folderId); err != nil {
+		reply.Error(w, r, "Failed to accept item", http.StatusInternalServerError)
+		fmt.Println("[INBOX] Failed to accept item:", err)
+		return
+	}
+	fmt.Println("[INBOX]", claims.Username, "accepted item ID:", itemId, "into folder ID:", folderId)
+	reply.Success(w, r, "Item accepted")
+}
+
+// handles POST /inbox/decline?itemId=, removes the copy, assets only go once nothing else uses them
+func declineHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := authentication.AuthCheck(w, r)
+	if claims == nil {
+		return
+	}
+	if !authentication.RequireScope(w, r, claims, authentication.ScopeUpload) {
+		return
+	}
+	itemId, ok := pendingItem(w, r, claims.UID)
+	if !ok {
+		return
+	}
+	if err := upload.RemoveItem(itemId); err != nil {
+		reply.Error(w, r, "Failed to decline item", http.StatusInternalServerError)
+		fmt.Println("[INBOX] Failed to decline item:", err)
+		return
+	}
+	fmt.Println("[INBOX]", claims.Username, "declined item ID:", itemId)
+	reply.Success(w, r, "Item declined")
+}
+
+func AddInboxListeners() {
+	http.HandleFunc("/inbox/send", sendHandler)
+	http.HandleFunc("/inbox/list", listHandler)
+	http.HandleFunc("/inbox/accept", acceptHandler)
+	http.HandleFunc("/inbox/decline", declineHandler)
+}
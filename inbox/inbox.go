@@ -0,0 +1,148 @@
+// Package inbox lets users send items to each other. A sent item is copied into the Inbox folder of the
+// recipient's default inventory, where it waits until the recipient accepts or declines it.
+package inbox
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"resonite-file-provider/authorization"
+	"resonite-file-provider/database"
+)
+
+const inboxFolderName = "Inbox"
+
+var (
+	errNoInventory  = errors.New("recipient has no inventory of their own")
+	errItemNotFound = errors.New("item not found")
+)
+
+type Delivery struct {
+	ItemId int
+	Name   string
+	URL    string
+	Sender string
+	SentAt string
+}
+
+// defaultInventory is the oldest inventory the user owns directly, shared and group inventories never receive items
+func defaultInventory(tx *sql.Tx, userId int) (int, error) {
+	var inventoryId int
+	err := tx.QueryRow("SELECT inventory_id FROM users_inventories WHERE user_id = ? AND role = ? ORDER BY inventory_id LIMIT 1", userId, authorization.RoleOwner).Scan(&inventoryId)
+	if err == sql.ErrNoRows {
+		return -1, errNoInventory
+	}
+	return inventoryId, err
+}
+
+// inboxFolder returns the Inbox folder of the inventory, creating it below the root folder the first time.
+// It is always private so waiting items don't show up in a public inventory.
+func inboxFolder(tx *sql.Tx, inventoryId int) (int64, error) {
+	var folderId int64
+	err := tx.QueryRow("SELECT id FROM Folders WHERE inventory_id = ? AND isInbox = 1 ORDER BY id LIMIT 1 FOR UPDATE", inventoryId).Scan(&folderId)
+	if err != sql.ErrNoRows {
+		return folderId, err
+	}
+	var rootId int
+	if err := tx.QueryRow("SELECT id FROM Folders WHERE inventory_id = ? AND parent_folder_id = -1", inventoryId).Scan(&rootId); err != nil {
+		return -1, err
+	}
+	result, err := tx.Exec("INSERT INTO Folders (name, parent_folder_id, inventory_id, isPublic, isInbox) VALUES (?, ?, ?, b'0', b'1')", inboxFolderName, rootId, inventoryId)
+	if err != nil {
+		return -1, err
+	}
+	return result.LastInsertId()
+}
+
+// Send copies the item into the recipient's Inbox folder. The copy shares the assets of the original
+// through new hash-usage rows, no files are duplicated.
+func Send(itemId int, senderId int, recipientId int) (int64, error) {
+	tx, err := database.Db.Begin()
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback()
+	inventoryId, err := defaultInventory(tx, recipientId)
+	if err != nil {
+		return -1, err
+	}
+	folderId, err := inboxFolder(tx, inventoryId)
+	if err != nil {
+		return -1, err
+	}
+	result, err := tx.Exec(`
+		INSERT INTO Items (name, folder_id, url, uploaded_by, created_at)
+		SELECT name, ?, url, uploaded_by, UTC_TIMESTAMP() FROM Items WHERE id = ?`, folderId, itemId)
+	if err != nil {
+		return -1, err
+	}
+	if copied, err := result.RowsAffected(); err != nil {
+		return -1, err
+	} else if copied == 0 {
+		return -1, errItemNotFound
+	}
+	copyId, err := result.LastInsertId()
+	if err != nil {
+		return -1, err
+	}
+	if _, err := tx.Exec("INSERT INTO `hash-usage` (`asset_id`, `item_id`) SELECT `asset_id`, ? FROM `hash-usage` WHERE `item_id` = ?", copyId, itemId); err != nil {
+		return -1, err
+	}
+	if _, err := tx.Exec("INSERT INTO Deliveries (item_id, sender_id, recipient_id, sent_at) VALUES (?, ?, ?, UTC_TIMESTAMP())", copyId, senderId, recipientId); err != nil {
+		return -1, err
+	}
+	return copyId, tx.Commit()
+}
+
+// Pending lists the items waiting in the user's inbox, newest first
+func Pending(userId int) ([]Delivery, error) {
+	rows, err := database.Db.Query(`
+		SELECT i.id, i.name, i.url, COALESCE(u.username, ''), d.sent_at
+		FROM Deliveries d
+		INNER JOIN Items i ON i.id = d.item_id
+		LEFT JOIN Users u ON u.id = d.sender_id
+		WHERE d.recipient_id = ?
+		ORDER BY d.sent_at DESC, d.id DESC`, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var deliveries []Delivery
+	for rows.Next() {
+		var delivery Delivery
+		if err := rows.Scan(&delivery.ItemId, &delivery.Name, &delivery.URL, &delivery.Sender, &delivery.SentAt); err != nil {
+			return nil, err
+		}
+		delivery.URL = filepath.Join("assets", delivery.URL)
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+// Recipient returns who a pending item was sent to, found is false for items that aren't waiting in an inbox
+func Recipient(itemId int) (int, bool, error) {
+	var recipientId int
+	err := database.Db.QueryRow("SELECT recipient_id FROM Deliveries WHERE item_id = ?", itemId).Scan(&recipientId)
+	if err == sql.ErrNoRows {
+		return -1, false, nil
+	} else if err != nil {
+		return -1, false, err
+	}
+	return recipientId, true, nil
+}
+
+// Accept moves a pending item out of the inbox into the folder, after which it is an ordinary item
+func Accept(itemId int, folderId int) error {
+	tx, err := database.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("UPDATE Items SET folder_id = ? WHERE id = ?", folderId, itemId); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM Deliveries WHERE item_id = ?", itemId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
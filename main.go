@@ -6,11 +6,15 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"resonite-file-provider/admin"
 	"resonite-file-provider/assethost"
 	"resonite-file-provider/authentication"
 	"resonite-file-provider/database"
 	"resonite-file-provider/environment"
+	"resonite-file-provider/groups"
+	"resonite-file-provider/inbox"
 	"resonite-file-provider/query"
+	"resonite-file-provider/sharelink"
 	"resonite-file-provider/upload"
 )
 
@@ -23,6 +27,10 @@ func main() {
 	authentication.AddAuthListeners()
 	assethost.AddAssetListeners()
 	upload.AddListeners()
+	admin.AddAdminListeners()
+	sharelink.AddShareLinkListeners()
+	groups.AddGroupListeners()
+	inbox.AddInboxListeners()
 
 	addr := fmt.Sprintf(":%d", 5819)
 
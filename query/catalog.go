@@ -0,0 +1,196 @@
+package query
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"resonite-file-provider/animxmaker"
+	"resonite-file-provider/database"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultCatalogPageSize = 25
+	maxCatalogPageSize     = 100
+)
+
+// How the catalog can be sorted, ties go to the newer item
+var catalogOrders = map[string]string{
+	"newest":    "i.created_at DESC, i.id DESC",
+	"downloads": "i.downloads DESC, i.id DESC",
+}
+
+type CatalogItem struct {
+	ID        int
+	Name      string
+	URL       string
+	Uploader  string
+	CreatedAt string
+	Downloads int
+}
+
+type CatalogQuery struct {
+	Search   string
+	Uploader string
+	Sort     string
+	Page     int
+	PageSize int
+}
+
+// GetCatalog lists one page of public items across all inventories and reports whether more pages follow.
+// The visible_folders CTE resolves folder visibility the same way authorization.IsPublic does,
+// a folder without a visibility of its own takes the one of its parent and root folders default to private.
+func GetCatalog(q CatalogQuery) ([]CatalogItem, bool, error) {
+	order, ok := catalogOrders[q.Sort]
+	if !ok {
+		return nil, false, fmt.Errorf("unknown sort %q", q.Sort)
+	}
+	statement := `
+		WITH RECURSIVE visible_folders (id, public) AS (
+			SELECT id, COALESCE(isPublic = 1, 0) FROM Folders WHERE parent_folder_id = -1
+			UNION ALL
+			SELECT f.id, COALESCE(f.isPublic = 1, vf.public)
+			FROM Folders f
+			INNER JOIN visible_folders vf ON f.parent_folder_id = vf.id
+		)
+		SELECT i.id, i.name, i.url, COALESCE(u.username, ''), COALESCE(i.created_at, ''), i.downloads
+		FROM Items i
+		INNER JOIN visible_folders vf ON vf.id = i.folder_id
+		LEFT JOIN Users u ON u.id = i.uploaded_by
+		WHERE COALESCE(i.isPublic = 1, vf.public) = 1`
+	var args []any
+	if q.Search != "" {
+		statement += " AND INSTR(i.name, ?)"
+		args = append(args, q.Search)
+	}
+	if q.Uploader != "" {
+		statement += " AND u.username = ?"
+		args = append(args, q.Uploader)
+	}
+	// One row more than the page holds tells whether there is a next page
+	statement += " ORDER BY " + order + " LIMIT ? OFFSET ?"
+	args = append(args, q.PageSize+1, (q.Page-1)*q.PageSize)
+	rows, err := database.Db.Query(statement, args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+	var items []CatalogItem
+	for rows.Next() {
+		var item CatalogItem
+		if err := rows.Scan(&item.ID, &item.Name, &item.URL, &item.Uploader, &item.CreatedAt, &item.Downloads); err != nil {
+			return nil, false, err
+		}
+		item.URL = filepath.Join("assets", item.URL)
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+	if len(items) > q.PageSize {
+		return items[:q.PageSize], true, nil
+	}
+	return items, false, nil
+}
+
+// parseCatalogQuery reads the catalog parameters, falling back to the first page of the newest items
+func parseCatalogQuery(r *http.Request) (CatalogQuery, error) {
+	q := CatalogQuery{
+		Search:   strings.TrimSpace(r.URL.Query().Get("query")),
+		Uploader: strings.TrimSpace(r.URL.Query().Get("uploader")),
+		Sort:     r.URL.Query().Get("sort"),
+		Page:     1,
+		PageSize: defaultCatalogPageSize,
+	}
+	if q.Sort == "" {
+		q.Sort = "newest"
+	}
+	if _, ok := catalogOrders[q.Sort]; !ok {
+		return q, fmt.Errorf("sort must be newest or downloads")
+	}
+	if param := r.URL.Query().Get("page"); param != "" {
+		page, err := strconv.Atoi(param)
+		if err != nil || page < 1 {
+			return q, fmt.Errorf("page is invalid")
+		}
+		q.Page = page
+	}
+	if param := r.URL.Query().Get("pageSize"); param != "" {
+		pageSize, err := strconv.Atoi(param)
+		if err != nil || pageSize < 1 || pageSize > maxCatalogPageSize {
+			return q, fmt.Errorf("pageSize must be between 1 and %d", maxCatalogPageSize)
+		}
+		q.PageSize = pageSize
+	}
+	return q, nil
+}
+
+// handles GET /query/catalog?query=&uploader=&sort=&page=&pageSize=, open to everyone
+func listCatalog(w http.ResponseWriter, r *http.Request) {
+	q, err := parseCatalogQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	items, hasMore, err := GetCatalog(q)
+	if err != nil {
+		http.Error(w, "Failed to query the database", http.StatusInternalServerError)
+		fmt.Println("[CATALOG] Query error:", err)
+		return
+	}
+	if strings.HasPrefix(r.UserAgent(), "Resonite") {
+		var ids, downloads []int
+		var names, urls, uploaders, createdAt []string
+		for _, item := range items {
+			ids = append(ids, item.ID)
+			names = append(names, item.Name)
+			urls = append(urls, item.URL)
+			uploaders = append(uploaders, item.Uploader)
+			createdAt = append(createdAt, item.CreatedAt)
+			downloads = append(downloads, item.Downloads)
+		}
+		more := 0
+		if hasMore {
+			more = 1
+		}
+		response := animxmaker.Animation{
+			Tracks: []animxmaker.AnimationTrackWrapper{
+				animxmaker.ListTrack(ids, "items", "id"),
+				animxmaker.ListTrack(names, "items", "name"),
+				animxmaker.ListTrack(urls, "items", "url"),
+				animxmaker.ListTrack(uploaders, "items", "uploader"),
+				animxmaker.ListTrack(createdAt, "items", "createdAt"),
+				animxmaker.ListTrack(downloads, "items", "downloads"),
+				animxmaker.ListTrack([]int{q.Page}, "page", "page"),
+				animxmaker.ListTrack([]int{more}, "page", "hasMore"),
+			},
+		}
+		encodedResponse, err := response.EncodeAnimation("response")
+		if err != nil {
+			http.Error(w, "Error while encoding animx", http.StatusInternalServerError)
+			return
+		}
+		w.Write(encodedResponse)
+	} else {
+		var results []map[string]any
+		for _, item := range items {
+			results = append(results, map[string]any{
+				"id":        item.ID,
+				"name":      item.Name,
+				"url":       item.URL,
+				"uploader":  item.Uploader,
+				"createdAt": item.CreatedAt,
+				"downloads": item.Downloads,
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"items":    results,
+			"page":     q.Page,
+			"pageSize": q.PageSize,
+			"hasMore":  hasMore,
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"resonite-file-provider/authentication"
+	"resonite-file-provider/authorization"
 	"resonite-file-provider/database"
 	"strconv"
 )
@@ -74,16 +75,12 @@ func getInventoryRootFolderAPI(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "[FolderContents] Failed Auth", http.StatusUnauthorized)
 		return
 	}
+	if !authentication.RequireScope(w, r, claims, authentication.ScopeRead) {
+		return
+	}
     
     // Check if user has access to this inventory
-    var hasAccess bool
-    err = database.Db.QueryRow(`
-        SELECT EXISTS(
-            SELECT 1 
-            FROM users_inventories 
-            WHERE user_id = ? AND inventory_id = ?
-        )
-    `, claims.UID, inventoryId).Scan(&hasAccess)
+    hasAccess, err := authorization.Can(claims.UID, authorization.EndpointAction("GET /api/inventory/rootFolder"), authorization.Inventory(inventoryId))
     
     if err != nil {
         http.Error(w, "Error checking access: "+err.Error(), http.StatusInternalServerError)
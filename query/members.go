@@ -0,0 +1,86 @@
+package query
+
+import (
+	"encoding/json"
+	"net/http"
+	"resonite-file-provider/animxmaker"
+	"resonite-file-provider/authentication"
+	"resonite-file-provider/authorization"
+	"resonite-file-provider/database"
+	"strconv"
+	"strings"
+)
+
+// handles /query/inventoryMembers
+func listInventoryMembers(w http.ResponseWriter, r *http.Request) {
+	inventoryId, err := strconv.Atoi(r.URL.Query().Get("inventoryId"))
+	if err != nil {
+		http.Error(w, "inventoryId is either not specified or is invalid", http.StatusBadRequest)
+		return
+	}
+	claims := authentication.AuthCheck(w, r)
+	if claims == nil {
+		http.Error(w, "[InventoryMembers] Failed Auth", http.StatusUnauthorized)
+		return
+	}
+	if !authentication.RequireScope(w, r, claims, authentication.ScopeRead) {
+		return
+	}
+	if allowed, err := authorization.Can(claims.UID, authorization.EndpointAction("GET /query/inventoryMembers"), authorization.Inventory(inventoryId)); !allowed || err != nil {
+		http.Error(w, "You don't have access to this inventory", http.StatusForbidden)
+		return
+	}
+	rows, err := database.Db.Query(`
+		SELECT u.id, u.username, ui.role
+		FROM users_inventories ui
+		INNER JOIN Users u ON u.id = ui.user_id
+		WHERE ui.inventory_id = ?
+		ORDER BY u.username`, inventoryId)
+	if err != nil {
+		http.Error(w, "Failed to query the database", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	var userIds []int
+	var usernames []string
+	var roles []string
+	for rows.Next() {
+		var id int
+		var username, role string
+		if err := rows.Scan(&id, &username, &role); err != nil {
+			http.Error(w, "Failed to query the database", http.StatusInternalServerError)
+			return
+		}
+		userIds = append(userIds, id)
+		usernames = append(usernames, username)
+		roles = append(roles, role)
+	}
+	if strings.HasPrefix(r.UserAgent(), "Resonite") {
+		response := animxmaker.Animation{
+			Tracks: []animxmaker.AnimationTrackWrapper{
+				animxmaker.ListTrack(userIds, "members", "id"),
+				animxmaker.ListTrack(usernames, "members", "username"),
+				animxmaker.ListTrack(roles, "members", "role"),
+			},
+		}
+		encodedResponse, err := response.EncodeAnimation("response")
+		if err != nil {
+			http.Error(w, "Error while encoding animx", http.StatusInternalServerError)
+			return
+		}
+		w.Write(encodedResponse)
+	} else {
+		var members []map[string]any
+		for i := range userIds {
+			members = append(members, map[string]any{
+				"id":       userIds[i],
+				"username": usernames[i],
+				"role":     roles[i],
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"members": members,
+		})
+	}
+}
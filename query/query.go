@@ -6,14 +6,26 @@ import (
 	"net/http"
 	"path/filepath"
 	"resonite-file-provider/animxmaker"
+	"resonite-file-provider/assethost"
 	"resonite-file-provider/authentication"
+	"resonite-file-provider/authorization"
 	"resonite-file-provider/database"
 	"strconv"
 	"strings"
 )
 
-func GetChildFolders(folderId int) ([]int, []string, int, error) {
-	childFolders, err := database.Db.Query("SELECT id, name FROM Folders where parent_folder_id = ?", folderId)
+// visibleOnly filters the children of a public folder down to the ones visitors may see,
+// everything without a visibility of its own inherits the public one of the folder
+const visibleOnly = " AND (isPublic IS NULL OR isPublic = 1)"
+
+// GetChildFolders lists the subfolders of a folder, publicOnly leaves out the ones made private
+// for visitors of a public folder who aren't members of its inventory
+func GetChildFolders(folderId int, publicOnly bool) ([]int, []string, int, error) {
+	statement := "SELECT id, name FROM Folders where parent_folder_id = ?"
+	if publicOnly {
+		statement += visibleOnly
+	}
+	childFolders, err := database.Db.Query(statement, folderId)
 	if err != nil {
 		return nil, nil, -1, err
 	}
@@ -38,8 +50,13 @@ func GetChildFolders(folderId int) ([]int, []string, int, error) {
 	return childFoldersIds, childFoldersNames, parentFolderId, nil
 }
 
-func GetChildItems(folderId int) ([]int, []string, []string, error) {
-	items, err := database.Db.Query("SELECT id, name, url FROM Items where folder_id = ?", folderId)
+// GetChildItems lists the items of a folder, publicOnly leaves out the ones made private
+func GetChildItems(folderId int, publicOnly bool) ([]int, []string, []string, error) {
+	statement := "SELECT id, name, url FROM Items where folder_id = ?"
+	if publicOnly {
+		statement += visibleOnly
+	}
+	items, err := database.Db.Query(statement, folderId)
 	if err != nil {
 		return nil, nil, nil, err
 	}
@@ -93,26 +110,42 @@ func GetSearchResults(query string, inventoryId int) ([]int, []string, []string,
 	return itemsIds, itemsNames, itemsUrls, nil
 }
 
-func IsFolderOwner(folderId int, userId int) (bool, error) {
-	rows, err := database.Db.Query("SELECT id from Users WHERE id = (SELECT user_id from users_inventories where inventory_id = (SELECT inventory_id FROM Folders WHERE id = ?))", folderId)
-	if err != nil {
-		return false, err
+// signItemUrls replaces the asset paths of items with URLs signed for the user
+func signItemUrls(userId int, urls []string) {
+	for i, url := range urls {
+		urls[i] = assethost.SignedURL(userId, filepath.Base(url))
 	}
-	for rows.Next() {
-		var currectUserId int
-		if err := rows.Scan(&currectUserId); err != nil {
-			return false, err
-		}
-		if currectUserId == userId {
-			return true, nil
-		}
+}
+
+// reader authenticates the request when it carries a token, public folders can also be listed
+// without one. ok is false when the response was already written.
+func reader(w http.ResponseWriter, r *http.Request) (int, bool) {
+	claims, ok := authentication.OptionalAuthCheck(w, r)
+	if !ok {
+		return -1, false
+	}
+	if claims == nil {
+		return authorization.Anonymous, true
 	}
-	return false, nil
+	if !authentication.RequireScope(w, r, claims, authentication.ScopeRead) {
+		return -1, false
+	}
+	return claims.UID, true
 }
 
-func IsInventoryOwner(inventoryId int, userId int) (bool, error) {
-	// TODO
-	return true, nil
+// readFolder checks the user may read the folder and reports whether they only see it because it
+// is public, in which case its private children have to be left out
+func readFolder(w http.ResponseWriter, endpoint string, userId int, folderId int) (bool, bool) {
+	if allowed, err := authorization.Can(userId, authorization.EndpointAction(endpoint), authorization.Folder(folderId)); !allowed || err != nil {
+		http.Error(w, "You don't have access to this folder", http.StatusForbidden)
+		return false, false
+	}
+	role, err := authorization.Role(userId, authorization.Folder(folderId))
+	if err != nil {
+		http.Error(w, "Failed to query the database", http.StatusInternalServerError)
+		return false, false
+	}
+	return role == "", true
 }
 
 // handles GET /query/childfolders
@@ -122,16 +155,15 @@ func listFolders(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "folderId is either not specified or is invalid", http.StatusBadRequest)
 		return
 	}
-	claims := authentication.AuthCheck(w, r)
-	if claims == nil {
-		http.Error(w, "[FolderContents] Failed Auth", http.StatusUnauthorized)
+	userId, ok := reader(w, r)
+	if !ok {
 		return
 	}
-	if allowed, err := IsFolderOwner(folderId, claims.UID); !allowed || err != nil {
-		http.Error(w, "You don't have access to this folder", http.StatusForbidden)
+	publicOnly, ok := readFolder(w, "GET /query/childFolders", userId, folderId)
+	if !ok {
 		return
 	}
-	ids, names, parentID, err := GetChildFolders(folderId)
+	ids, names, parentID, err := GetChildFolders(folderId, publicOnly)
 	if strings.HasPrefix(r.UserAgent(), "Resonite") {
 		animation := animxmaker.Animation{
 			Tracks: []animxmaker.AnimationTrackWrapper{
@@ -187,16 +219,16 @@ func listItems(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		http.Error(w, "folderId is either not specified or is invalid", http.StatusBadRequest)
 	}
-	claims := authentication.AuthCheck(w, r)
-	if claims == nil {
-		http.Error(w, "[ChildItems] Failed Auth", http.StatusUnauthorized)
+	userId, ok := reader(w, r)
+	if !ok {
 		return
 	}
-	if allowed, err := IsFolderOwner(folderId, claims.UID); !allowed || err != nil {
-		http.Error(w, "You don't have access to this folder", http.StatusForbidden)
+	publicOnly, ok := readFolder(w, "GET /query/childItems", userId, folderId)
+	if !ok {
 		return
 	}
-	ids, names, urls, err := GetChildItems(folderId)
+	ids, names, urls, err := GetChildItems(folderId, publicOnly)
+	signItemUrls(userId, urls)
 	if strings.HasPrefix(r.UserAgent(), "Resonite") {
 		animation := animxmaker.Animation{
 			Tracks: []animxmaker.AnimationTrackWrapper{
@@ -236,24 +268,70 @@ func listInventories(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "[Inventories] Failed Auth", http.StatusUnauthorized)
 		return
 	}
-	result, err := database.Db.Query("SELECT name, id FROM `Inventories` WHERE id in (SELECT id FROM users_inventories WHERE user_id = ?)", claims.UID)
+	if !authentication.RequireScope(w, r, claims, authentication.ScopeRead) {
+		return
+	}
+	// Inventories reached directly and through groups, a user in several of them gets the highest role
+	result, err := database.Db.Query(`
+		SELECT i.name, i.id, ui.role, ''
+		FROM Inventories i
+		INNER JOIN users_inventories ui ON ui.inventory_id = i.id
+		WHERE ui.user_id = ?
+		UNION ALL
+		SELECT i.name, i.id, gi.role, g.name
+		FROM Inventories i
+		INNER JOIN groups_inventories gi ON gi.inventory_id = i.id
+		INNER JOIN group_members gm ON gm.group_id = gi.group_id
+		INNER JOIN `+"`Groups`"+` g ON g.id = gi.group_id
+		WHERE gm.user_id = ?
+		ORDER BY 2`, claims.UID, claims.UID)
 	if err != nil {
 		http.Error(w, "Failed to query the database", http.StatusInternalServerError)
+		return
 	}
+	defer result.Close()
 	var inventoryIds []int
 	var inventoryNames []string
+	var inventoryRoles []string
+	// Name of the group the inventory comes from, empty for direct memberships
+	var inventoryGroups []string
+	positions := make(map[int]int)
 	for result.Next() {
 		var name string
 		var id int
-		result.Scan(&name, &id)
+		var role string
+		var group string
+		result.Scan(&name, &id, &role, &group)
+		if i, seen := positions[id]; seen {
+			if authorization.HighestRole(inventoryRoles[i], role) != inventoryRoles[i] {
+				inventoryRoles[i] = role
+				inventoryGroups[i] = group
+			}
+			continue
+		}
+		positions[id] = len(inventoryIds)
 		inventoryIds = append(inventoryIds, id)
 		inventoryNames = append(inventoryNames, name)
+		inventoryRoles = append(inventoryRoles, role)
+		inventoryGroups = append(inventoryGroups, group)
+	}
+	// Inventories the user doesn't own were shared with them by someone else
+	var inventoryShared []int
+	for _, role := range inventoryRoles {
+		if role == authorization.RoleOwner {
+			inventoryShared = append(inventoryShared, 0)
+		} else {
+			inventoryShared = append(inventoryShared, 1)
+		}
 	}
 	if strings.HasPrefix(r.UserAgent(), "Resonite") {
 		response := animxmaker.Animation{
 			Tracks: []animxmaker.AnimationTrackWrapper{
 				animxmaker.ListTrack(inventoryIds, "results", "id"),
 				animxmaker.ListTrack(inventoryNames, "results", "name"),
+				animxmaker.ListTrack(inventoryRoles, "results", "role"),
+				animxmaker.ListTrack(inventoryShared, "results", "shared"),
+				animxmaker.ListTrack(inventoryGroups, "results", "group"),
 			},
 		}
 		encodedResponse, err := response.EncodeAnimation("response")
@@ -266,8 +344,11 @@ func listInventories(w http.ResponseWriter, r *http.Request) {
 		var items []map[string]any
 		for i := 0; i < len(inventoryNames) && i < len(inventoryIds); i++ {
 			items = append(items, map[string]any{
-				"name": inventoryNames[i],
-				"id":   inventoryIds[i],
+				"name":   inventoryNames[i],
+				"id":     inventoryIds[i],
+				"role":   inventoryRoles[i],
+				"shared": inventoryShared[i] == 1,
+				"group":  inventoryGroups[i],
 			})
 		}
 		data := map[string]any{
@@ -284,21 +365,21 @@ func listFolderContents(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		http.Error(w, "folderId is either not specified or is invalid", http.StatusBadRequest)
 	}
-	claims := authentication.AuthCheck(w, r)
-	if claims == nil {
-		http.Error(w, "[FolderContents] Failed Auth", http.StatusUnauthorized)
+	userId, ok := reader(w, r)
+	if !ok {
 		return
 	}
-	if allowed, err := IsFolderOwner(folderId, claims.UID); !allowed || err != nil {
-		http.Error(w, "You don't have access to this folder", http.StatusForbidden)
+	publicOnly, ok := readFolder(w, "GET /query/folderContent", userId, folderId)
+	if !ok {
 		return
 	}
-	itemIdsTrack, itemNamesTrack, itemUrlsTrack, err := GetChildItems(folderId)
+	itemIdsTrack, itemNamesTrack, itemUrlsTrack, err := GetChildItems(folderId, publicOnly)
 	if err != nil {
 		http.Error(w, "Error while getting items", http.StatusInternalServerError)
 		return
 	}
-	folderIdsTrack, folderNamesTrack, parentFolder, err := GetChildFolders(folderId)
+	signItemUrls(userId, itemUrlsTrack)
+	folderIdsTrack, folderNamesTrack, parentFolder, err := GetChildFolders(folderId, publicOnly)
 	if err != nil {
 		http.Error(w, "Error while getting folders", http.StatusInternalServerError)
 		return
@@ -374,7 +455,10 @@ func getInventoryRootFolder(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "[RootFolder] Failed Auth", http.StatusUnauthorized)
 		return
 	}
-	if allowed, err := IsInventoryOwner(inventoryId, claims.UID); !allowed || err != nil {
+	if !authentication.RequireScope(w, r, claims, authentication.ScopeRead) {
+		return
+	}
+	if allowed, err := authorization.Can(claims.UID, authorization.EndpointAction("GET /query/inventoryRootFolder"), authorization.Inventory(inventoryId)); !allowed || err != nil {
 		http.Error(w, "You don't have access to this inventory", http.StatusForbidden)
 		return
 	}
@@ -402,11 +486,15 @@ func searchInventory(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "[SearchInventory] Failed Auth", http.StatusUnauthorized)
 		return
 	}
-	if allowed, err := IsInventoryOwner(inventoryId, claims.UID); !allowed || err != nil {
+	if !authentication.RequireScope(w, r, claims, authentication.ScopeRead) {
+		return
+	}
+	if allowed, err := authorization.Can(claims.UID, authorization.EndpointAction("GET /query/search"), authorization.Inventory(inventoryId)); !allowed || err != nil {
 		http.Error(w, "You don't have access to this inventory", http.StatusForbidden)
 		return
 	}
 	itemIds, itemNames, itemUrls, err := GetSearchResults(query, inventoryId)
+	signItemUrls(claims.UID, itemUrls)
 	if strings.HasPrefix(r.UserAgent(), "Resonite") {
 		response := animxmaker.Animation{
 			Tracks: []animxmaker.AnimationTrackWrapper{
@@ -444,4 +532,6 @@ func AddSearchListeners() {
 	http.HandleFunc("/query/inventories", listInventories)
 	http.HandleFunc("/query/inventoryRootFolder", getInventoryRootFolder)
 	http.HandleFunc("/query/search", searchInventory)
+	http.HandleFunc("/query/inventoryMembers", listInventoryMembers)
+	http.HandleFunc("/query/catalog", listCatalog)
 }
@@ -0,0 +1,33 @@
+// Package reply writes the plain responses every endpoint shares. Resonite gets the message as text,
+// other clients get JSON with a success flag.
+package reply
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+func Error(w http.ResponseWriter, r *http.Request, message string, status int) {
+	if strings.HasPrefix(r.UserAgent(), "Resonite") {
+		http.Error(w, message, status)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   message,
+		})
+	}
+}
+
+func Success(w http.ResponseWriter, r *http.Request, message string) {
+	if strings.HasPrefix(r.UserAgent(), "Resonite") {
+		w.Write([]byte(message))
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+		})
+	}
+}
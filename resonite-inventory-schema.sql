@@ -23,6 +23,26 @@ SET time_zone = "+00:00";
 
 -- --------------------------------------------------------
 
+--
+-- Table structure for table `ApiKeys`
+--
+
+CREATE TABLE `ApiKeys` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `user_id` int(11) NOT NULL,
+  `name` text NOT NULL,
+  `key_hash` char(64) NOT NULL,
+  `prefix` varchar(16) NOT NULL,
+  `scopes` varchar(64) NOT NULL,
+  `created_at` datetime NOT NULL,
+  `expires_at` datetime DEFAULT NULL,
+  `last_used_at` datetime DEFAULT NULL,
+  `revoked` BIT NOT NULL DEFAULT b'0',
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
+
+-- --------------------------------------------------------
+
 --
 -- Table structure for table `Assets`
 --
@@ -45,6 +65,21 @@ CREATE TABLE `asset_tags` (
 
 -- --------------------------------------------------------
 
+--
+-- Table structure for table `Deliveries`
+--
+
+CREATE TABLE `Deliveries` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `item_id` int(11) NOT NULL,
+  `sender_id` int(11) DEFAULT NULL,
+  `recipient_id` int(11) NOT NULL,
+  `sent_at` datetime NOT NULL,
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
+
+-- --------------------------------------------------------
+
 --
 -- Table structure for table `Folders`
 --
@@ -54,6 +89,49 @@ CREATE TABLE `Folders` (
   `name` text NOT NULL,
   `parent_folder_id` int(11) NOT NULL,
   `inventory_id` int(11) NOT NULL,
+  `isPublic` BIT DEFAULT NULL,
+  `isInbox` BIT NOT NULL DEFAULT b'0',
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
+
+-- --------------------------------------------------------
+
+--
+-- Table structure for table `Groups`
+--
+
+CREATE TABLE `Groups` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `name` varchar(64) NOT NULL,
+  `created_at` datetime NOT NULL,
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
+
+-- --------------------------------------------------------
+
+--
+-- Table structure for table `group_members`
+--
+
+CREATE TABLE `group_members` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `group_id` int(11) NOT NULL,
+  `user_id` int(11) NOT NULL,
+  `role` varchar(16) NOT NULL DEFAULT 'member',
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
+
+-- --------------------------------------------------------
+
+--
+-- Table structure for table `groups_inventories`
+--
+
+CREATE TABLE `groups_inventories` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `group_id` int(11) NOT NULL,
+  `inventory_id` int(11) NOT NULL,
+  `role` varchar(16) NOT NULL DEFAULT 'owner',
   PRIMARY KEY (`id`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
 
@@ -82,6 +160,24 @@ CREATE TABLE `Inventories` (
 
 -- --------------------------------------------------------
 
+--
+-- Table structure for table `InviteCodes`
+--
+
+CREATE TABLE `InviteCodes` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `code_hash` char(64) NOT NULL,
+  `created_by` int(11) NOT NULL,
+  `created_at` datetime NOT NULL,
+  `expires_at` datetime DEFAULT NULL,
+  `max_uses` int(11) NOT NULL DEFAULT 1,
+  `uses` int(11) NOT NULL DEFAULT 0,
+  `revoked` BIT NOT NULL DEFAULT b'0',
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
+
+-- --------------------------------------------------------
+
 --
 -- Table structure for table `Items`
 --
@@ -92,6 +188,9 @@ CREATE TABLE `Items` (
   `folder_id` int(11) NOT NULL,
   `url` text NOT NULL,
   `isPublic` BIT,
+  `uploaded_by` int(11) DEFAULT NULL,
+  `created_at` datetime DEFAULT NULL,
+  `downloads` int(11) NOT NULL DEFAULT 0,
   PRIMARY KEY (`id`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
 
@@ -110,6 +209,90 @@ CREATE TABLE `item_tags` (
 
 -- --------------------------------------------------------
 
+--
+-- Table structure for table `PasswordResets`
+--
+
+CREATE TABLE `PasswordResets` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `user_id` int(11) NOT NULL,
+  `token_hash` char(64) NOT NULL,
+  `created_by` int(11) NOT NULL,
+  `created_at` datetime NOT NULL,
+  `expires_at` datetime NOT NULL,
+  `used` BIT NOT NULL DEFAULT b'0',
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
+
+-- --------------------------------------------------------
+
+--
+-- Table structure for table `RecoveryCodes`
+--
+
+CREATE TABLE `RecoveryCodes` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `user_id` int(11) NOT NULL,
+  `code_hash` char(64) NOT NULL,
+  `used` BIT NOT NULL DEFAULT b'0',
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
+
+-- --------------------------------------------------------
+
+--
+-- Table structure for table `RefreshTokens`
+--
+
+CREATE TABLE `RefreshTokens` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `session_id` char(32) NOT NULL,
+  `token_hash` char(64) NOT NULL,
+  `expires_at` datetime NOT NULL,
+  `used` BIT NOT NULL DEFAULT b'0',
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
+
+-- --------------------------------------------------------
+
+--
+-- Table structure for table `Sessions`
+--
+
+CREATE TABLE `Sessions` (
+  `id` char(32) NOT NULL,
+  `user_id` int(11) NOT NULL,
+  `created_at` datetime NOT NULL,
+  `expires_at` datetime NOT NULL,
+  `revoked` BIT NOT NULL DEFAULT b'0',
+  `user_agent` varchar(255) DEFAULT NULL,
+  `ip` varchar(45) DEFAULT NULL,
+  `last_seen_at` datetime DEFAULT NULL,
+  `last_seen_user_agent` varchar(255) DEFAULT NULL,
+  `last_seen_ip` varchar(45) DEFAULT NULL,
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
+
+-- --------------------------------------------------------
+
+--
+-- Table structure for table `ShareLinks`
+--
+
+CREATE TABLE `ShareLinks` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `token_hash` char(64) NOT NULL,
+  `folder_id` int(11) NOT NULL,
+  `created_by` int(11) NOT NULL,
+  `created_at` datetime NOT NULL,
+  `expires_at` datetime DEFAULT NULL,
+  `password_hash` varchar(256) DEFAULT NULL,
+  `revoked` BIT NOT NULL DEFAULT b'0',
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
+
+-- --------------------------------------------------------
+
 --
 -- Table structure for table `Tags`
 --
@@ -122,14 +305,45 @@ CREATE TABLE `Tags` (
 
 -- --------------------------------------------------------
 
+--
+-- Table structure for table `TwoFactor`
+--
+
+CREATE TABLE `TwoFactor` (
+  `user_id` int(11) NOT NULL,
+  `secret` varchar(64) NOT NULL,
+  `enabled` BIT NOT NULL DEFAULT b'0',
+  `last_used_step` bigint(20) DEFAULT NULL,
+  PRIMARY KEY (`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
+
+-- --------------------------------------------------------
+
+--
+-- Table structure for table `UserIdentities`
+--
+
+CREATE TABLE `UserIdentities` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `user_id` int(11) NOT NULL,
+  `issuer` varchar(255) NOT NULL,
+  `subject` varchar(255) NOT NULL,
+  `created_at` datetime NOT NULL,
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
+
+-- --------------------------------------------------------
+
 --
 -- Table structure for table `Users`
 --
 
 CREATE TABLE `Users` (
   `id` int(11) NOT NULL AUTO_INCREMENT,
-  `username` text NOT NULL,
+  `username` varchar(64) COLLATE utf8_general_ci NOT NULL,
   `auth` varchar(256) NOT NULL,
+  `role` varchar(16) NOT NULL DEFAULT 'user',
+  `disabled` BIT NOT NULL DEFAULT b'0',
   PRIMARY KEY (`id`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
 
@@ -143,6 +357,7 @@ CREATE TABLE `users_inventories` (
   `id` int(11) NOT NULL AUTO_INCREMENT,
   `user_id` int(11) NOT NULL,
   `inventory_id` int(11) NOT NULL,
+  `role` varchar(16) NOT NULL DEFAULT 'owner',
   PRIMARY KEY (`id`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
 
@@ -150,6 +365,13 @@ CREATE TABLE `users_inventories` (
 -- Indexes for dumped tables
 --
 
+--
+-- Indexes for table `ApiKeys`
+--
+ALTER TABLE `ApiKeys`
+  ADD UNIQUE KEY `key_hash` (`key_hash`),
+  ADD KEY `user_id` (`user_id`);
+
 --
 -- Indexes for table `Assets`
 --
@@ -163,12 +385,34 @@ ALTER TABLE `asset_tags`
   ADD KEY `asset_id` (`asset_id`),
   ADD KEY `tag_id` (`tag_id`);
 
+--
+-- Indexes for table `Deliveries`
+--
+ALTER TABLE `Deliveries`
+  ADD UNIQUE KEY `item_id` (`item_id`),
+  ADD KEY `sender_id` (`sender_id`),
+  ADD KEY `recipient_id` (`recipient_id`);
+
 --
 -- Indexes for table `Folders`
 --
 ALTER TABLE `Folders`
   ADD KEY `inventoryId` (`inventory_id`);
 
+--
+-- Indexes for table `group_members`
+--
+ALTER TABLE `group_members`
+  ADD UNIQUE KEY `group_user` (`group_id`,`user_id`),
+  ADD KEY `user_id` (`user_id`);
+
+--
+-- Indexes for table `groups_inventories`
+--
+ALTER TABLE `groups_inventories`
+  ADD UNIQUE KEY `group_inventory` (`group_id`,`inventory_id`),
+  ADD KEY `inventory_id` (`inventory_id`);
+
 --
 -- Indexes for table `hash-usage`
 --
@@ -176,11 +420,19 @@ ALTER TABLE `hash-usage`
   ADD KEY `asset_id` (`asset_id`),
   ADD KEY `item_id` (`item_id`);
 
+--
+-- Indexes for table `InviteCodes`
+--
+ALTER TABLE `InviteCodes`
+  ADD UNIQUE KEY `code_hash` (`code_hash`),
+  ADD KEY `created_by` (`created_by`);
+
 --
 -- Indexes for table `Items`
 --
 ALTER TABLE `Items`
-  ADD KEY `Items_ibfk_1` (`folder_id`);
+  ADD KEY `Items_ibfk_1` (`folder_id`),
+  ADD KEY `uploaded_by` (`uploaded_by`);
 
 --
 -- Indexes for table `item_tags`
@@ -189,16 +441,64 @@ ALTER TABLE `item_tags`
   ADD KEY `item_id` (`item_id`),
   ADD KEY `tag_id` (`tag_id`);
 
+--
+-- Indexes for table `PasswordResets`
+--
+ALTER TABLE `PasswordResets`
+  ADD UNIQUE KEY `token_hash` (`token_hash`),
+  ADD KEY `user_id` (`user_id`);
+
+--
+-- Indexes for table `RecoveryCodes`
+--
+ALTER TABLE `RecoveryCodes`
+  ADD KEY `user_id` (`user_id`);
+
+--
+-- Indexes for table `RefreshTokens`
+--
+ALTER TABLE `RefreshTokens`
+  ADD UNIQUE KEY `token_hash` (`token_hash`),
+  ADD KEY `session_id` (`session_id`);
+
+--
+-- Indexes for table `Sessions`
+--
+ALTER TABLE `Sessions`
+  ADD KEY `user_id` (`user_id`);
+
+--
+-- Indexes for table `ShareLinks`
+--
+ALTER TABLE `ShareLinks`
+  ADD UNIQUE KEY `token_hash` (`token_hash`),
+  ADD KEY `folder_id` (`folder_id`),
+  ADD KEY `created_by` (`created_by`);
+
 --
 -- Indexes for table `Tags`
 --
 ALTER TABLE `Tags`
   ADD PRIMARY KEY (`id`);
 
+--
+-- Indexes for table `UserIdentities`
+--
+ALTER TABLE `UserIdentities`
+  ADD UNIQUE KEY `issuer_subject` (`issuer`, `subject`),
+  ADD KEY `user_id` (`user_id`);
+
+--
+-- Indexes for table `Users`
+--
+ALTER TABLE `Users`
+  ADD UNIQUE KEY `username` (`username`);
+
 --
 -- Indexes for table `users_inventories`
 --
 ALTER TABLE `users_inventories`
+  ADD UNIQUE KEY `user_inventory` (`user_id`,`inventory_id`),
   ADD KEY `inventory_id` (`inventory_id`),
   ADD KEY `user_id` (`user_id`);
 
@@ -206,6 +506,12 @@ ALTER TABLE `users_inventories`
 -- Constraints for dumped tables
 --
 
+--
+-- Constraints for table `ApiKeys`
+--
+ALTER TABLE `ApiKeys`
+  ADD CONSTRAINT `ApiKeys_ibfk_1` FOREIGN KEY (`user_id`) REFERENCES `Users` (`id`);
+
 --
 -- Constraints for table `asset_tags`
 --
@@ -213,12 +519,34 @@ ALTER TABLE `asset_tags`
   ADD CONSTRAINT `asset_tags_ibfk_1` FOREIGN KEY (`asset_id`) REFERENCES `Assets` (`id`),
   ADD CONSTRAINT `asset_tags_ibfk_2` FOREIGN KEY (`tag_id`) REFERENCES `item_tags` (`id`);
 
+--
+-- Constraints for table `Deliveries`
+--
+ALTER TABLE `Deliveries`
+  ADD CONSTRAINT `Deliveries_ibfk_1` FOREIGN KEY (`item_id`) REFERENCES `Items` (`id`),
+  ADD CONSTRAINT `Deliveries_ibfk_2` FOREIGN KEY (`sender_id`) REFERENCES `Users` (`id`),
+  ADD CONSTRAINT `Deliveries_ibfk_3` FOREIGN KEY (`recipient_id`) REFERENCES `Users` (`id`);
+
 --
 -- Constraints for table `Folders`
 --
 ALTER TABLE `Folders`
   ADD CONSTRAINT `Folders_ibfk_1` FOREIGN KEY (`inventory_id`) REFERENCES `Inventories` (`id`);
 
+--
+-- Constraints for table `group_members`
+--
+ALTER TABLE `group_members`
+  ADD CONSTRAINT `group_members_ibfk_1` FOREIGN KEY (`group_id`) REFERENCES `Groups` (`id`),
+  ADD CONSTRAINT `group_members_ibfk_2` FOREIGN KEY (`user_id`) REFERENCES `Users` (`id`);
+
+--
+-- Constraints for table `groups_inventories`
+--
+ALTER TABLE `groups_inventories`
+  ADD CONSTRAINT `groups_inventories_ibfk_1` FOREIGN KEY (`group_id`) REFERENCES `Groups` (`id`),
+  ADD CONSTRAINT `groups_inventories_ibfk_2` FOREIGN KEY (`inventory_id`) REFERENCES `Inventories` (`id`);
+
 --
 -- Constraints for table `hash-usage`
 --
@@ -226,6 +554,12 @@ ALTER TABLE `hash-usage`
   ADD CONSTRAINT `hash-usage_ibfk_1` FOREIGN KEY (`asset_id`) REFERENCES `Assets` (`id`),
   ADD CONSTRAINT `hash-usage_ibfk_2` FOREIGN KEY (`item_id`) REFERENCES `Items` (`id`);
 
+--
+-- Constraints for table `InviteCodes`
+--
+ALTER TABLE `InviteCodes`
+  ADD CONSTRAINT `InviteCodes_ibfk_1` FOREIGN KEY (`created_by`) REFERENCES `Users` (`id`);
+
 --
 -- Constraints for table `Items`
 --
@@ -239,6 +573,49 @@ ALTER TABLE `item_tags`
   ADD CONSTRAINT `item_tags_ibfk_1` FOREIGN KEY (`item_id`) REFERENCES `Items` (`id`),
   ADD CONSTRAINT `item_tags_ibfk_2` FOREIGN KEY (`tag_id`) REFERENCES `Tags` (`id`);
 
+--
+-- Constraints for table `PasswordResets`
+--
+ALTER TABLE `PasswordResets`
+  ADD CONSTRAINT `PasswordResets_ibfk_1` FOREIGN KEY (`user_id`) REFERENCES `Users` (`id`);
+
+--
+-- Constraints for table `RecoveryCodes`
+--
+ALTER TABLE `RecoveryCodes`
+  ADD CONSTRAINT `RecoveryCodes_ibfk_1` FOREIGN KEY (`user_id`) REFERENCES `Users` (`id`);
+
+--
+-- Constraints for table `RefreshTokens`
+--
+ALTER TABLE `RefreshTokens`
+  ADD CONSTRAINT `RefreshTokens_ibfk_1` FOREIGN KEY (`session_id`) REFERENCES `Sessions` (`id`);
+
+--
+-- Constraints for table `Sessions`
+--
+ALTER TABLE `Sessions`
+  ADD CONSTRAINT `Sessions_ibfk_1` FOREIGN KEY (`user_id`) REFERENCES `Users` (`id`);
+
+--
+-- Constraints for table `ShareLinks`
+--
+ALTER TABLE `ShareLinks`
+  ADD CONSTRAINT `ShareLinks_ibfk_1` FOREIGN KEY (`folder_id`) REFERENCES `Folders` (`id`),
+  ADD CONSTRAINT `ShareLinks_ibfk_2` FOREIGN KEY (`created_by`) REFERENCES `Users` (`id`);
+
+--
+-- Constraints for table `TwoFactor`
+--
+ALTER TABLE `TwoFactor`
+  ADD CONSTRAINT `TwoFactor_ibfk_1` FOREIGN KEY (`user_id`) REFERENCES `Users` (`id`);
+
+--
+-- Constraints for table `UserIdentities`
+--
+ALTER TABLE `UserIdentities`
+  ADD CONSTRAINT `UserIdentities_ibfk_1` FOREIGN KEY (`user_id`) REFERENCES `Users` (`id`);
+
 --
 -- Constraints for table `users_inventories`
 --
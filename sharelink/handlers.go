@@ -0,0 +1,416 @@
+package sharelink
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"resonite-file-provider/animxmaker"
+	"resonite-file-provider/assethost"
+	"resonite-file-provider/authentication"
+	"resonite-file-provider/authorization"
+	"resonite-file-provider/query"
+	"resonite-file-provider/reply"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// handles POST /shareLinks/create?folderId=&expiresInHours=, the optional password is the request body
+func createLinkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := authentication.AuthCheck(w, r)
+	if claims == nil {
+		return
+	}
+	if !authentication.RequireScope(w, r, claims, authentication.ScopeManage) {
+		return
+	}
+	folderId, err := strconv.Atoi(r.URL.Query().Get("folderId"))
+	if err != nil {
+		reply.Error(w, r, "folderId missing or invalid", http.StatusBadRequest)
+		return
+	}
+	var expiresAt *time.Time
+	if hours := r.URL.Query().Get("expiresInHours"); hours != "" {
+		expiresInHours, err := strconv.Atoi(hours)
+		if err != nil || expiresInHours <= 0 {
+			reply.Error(w, r, "expiresInHours is invalid", http.StatusBadRequest)
+			return
+		}
+		expires := time.Now().Add(time.Duration(expiresInHours) * time.Hour)
+		expiresAt = &expires
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1024))
+	if err != nil {
+		reply.Error(w, r, "Failed to read body", http.StatusBadRequest)
+		return
+	}
+	password := strings.TrimSpace(string(body))
+	if allowed, err := authorization.Can(claims.UID, authorization.EndpointAction("POST /shareLinks/create"), authorization.Folder(folderId)); err != nil || !allowed {
+		reply.Error(w, r, "Only owners can create share links", http.StatusForbidden)
+		return
+	}
+	linkId, token, err := Create(folderId, claims.UID, expiresAt, password)
+	if err != nil {
+		reply.Error(w, r, "Failed to create share link", http.StatusInternalServerError)
+		fmt.Println("[SHARELINK] Failed to create share link:", err)
+		return
+	}
+	fmt.Println("[SHARELINK]", claims.Username, "created share link", linkId, "for folder ID:", folderId)
+	if strings.HasPrefix(r.UserAgent(), "Resonite") {
+		w.Write([]byte(token))
+	} else {
+		response := map[string]interface{}{
+			"success":     true,
+			"id":          linkId,
+			"token":       token,
+			"url":         "/share/" + token + "/folderContent",
+			"hasPassword": password != "",
+		}
+		if expiresAt != nil {
+			response["expiresAt"] = expiresAt.UTC().Format(time.RFC3339)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// handles GET /shareLinks/list?folderId=, without folderId it lists the links the user created
+func listLinksHandler(w http.ResponseWriter, r *http.Request) {
+	claims := authentication.AuthCheck(w, r)
+	if claims == nil {
+		return
+	}
+	if !authentication.RequireScope(w, r, claims, authentication.ScopeManage) {
+		return
+	}
+	folderId := -1
+	if param := r.URL.Query().Get("folderId"); param != "" {
+		parsed, err := strconv.Atoi(param)
+		if err != nil {
+			reply.Error(w, r, "folderId is invalid", http.StatusBadRequest)
+			return
+		}
+		if allowed, err := authorization.Can(claims.UID, authorization.EndpointAction("GET /shareLinks/list"), authorization.Folder(parsed)); err != nil || !allowed {
+			reply.Error(w, r, "Only owners can see the share links of a folder", http.StatusForbidden)
+			return
+		}
+		folderId = parsed
+	}
+	links, err := List(folderId, claims.UID)
+	if err != nil {
+		reply.Error(w, r, "Server error", http.StatusInternalServerError)
+		fmt.Println("[SHARELINK] Query error:", err)
+		return
+	}
+	if strings.HasPrefix(r.UserAgent(), "Resonite") {
+		var ids, folderIds, hasPassword, revoked []int
+		var folderNames, expiresAt []string
+		for _, link := range links {
+			ids = append(ids, link.ID)
+			folderIds = append(folderIds, link.FolderId)
+			folderNames = append(folderNames, link.FolderName)
+			expiresAt = append(expiresAt, link.ExpiresAt.String)
+			if link.HasPassword {
+				hasPassword = append(hasPassword, 1)
+			} else {
+				hasPassword = append(hasPassword, 0)
+			}
+			if link.Revoked {
+				revoked = append(revoked, 1)
+			} else {
+				revoked = append(revoked, 0)
+			}
+		}
+		response := animxmaker.Animation{
+			Tracks: []animxmaker.AnimationTrackWrapper{
+				animxmaker.ListTrack(ids, "links", "id"),
+				animxmaker.ListTrack(folderIds, "links", "folderId"),
+				animxmaker.ListTrack(folderNames, "links", "folderName"),
+				animxmaker.ListTrack(expiresAt, "links", "expiresAt"),
+				animxmaker.ListTrack(hasPassword, "links", "hasPassword"),
+				animxmaker.ListTrack(revoked, "links", "revoked"),
+			},
+		}
+		encodedResponse, err := response.EncodeAnimation("response")
+		if err != nil {
+			http.Error(w, "Error while encoding animx", http.StatusInternalServerError)
+			return
+		}
+		w.Write(encodedResponse)
+	} else {
+		var results []map[string]any
+		for _, link := range links {
+			entry := map[string]any{
+				"id":          link.ID,
+				"folderId":    link.FolderId,
+				"folderName":  link.FolderName,
+				"createdBy":   link.CreatedBy,
+				"createdAt":   link.CreatedAt,
+				"hasPassword": link.HasPassword,
+				"revoked":     link.Revoked,
+			}
+			if link.ExpiresAt.Valid {
+				entry["expiresAt"] = link.ExpiresAt.String
+			}
+			results = append(results, entry)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"links": results,
+		})
+	}
+}
+
+// handles POST /shareLinks/revoke?id=, allowed for owners of the folder and whoever created the link
+func revokeLinkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := authentication.AuthCheck(w, r)
+	if claims == nil {
+		return
+	}
+	if !authentication.RequireScope(w, r, claims, authentication.ScopeManage) {
+		return
+	}
+	linkId, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		reply.Error(w, r, "id missing or invalid", http.StatusBadRequest)
+		return
+	}
+	folderId, createdBy, found, err := LinkFolder(linkId)
+	if err != nil {
+		reply.Error(w, r, "Server error", http.StatusInternalServerError)
+		fmt.Println("[SHARELINK] Query error:", err)
+		return
+	}
+	allowed := found && createdBy == claims.UID
+	if found && !allowed {
+		allowed, err = authorization.Can(claims.UID, authorization.EndpointAction("POST /shareLinks/revoke"), authorization.Folder(folderId))
+	}
+	if err != nil || !allowed {
+		reply.Error(w, r, "Share link not found", http.StatusNotFound)
+		return
+	}
+	if err := Revoke(linkId); err != nil {
+		reply.Error(w, r, "Server error", http.StatusInternalServerError)
+		fmt.Println("[SHARELINK] Failed to revoke share link:", err)
+		return
+	}
+	fmt.Println("[SHARELINK]", claims.Username, "revoked share link", linkId)
+	if strings.HasPrefix(r.UserAgent(), "Resonite") {
+		w.Write([]byte("Share link revoked"))
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+		})
+	}
+}
+
+// handles everything below /share/<token>/, the token takes the place of a login:
+//
+//	GET|POST /share/<token>/folderContent?folderId=                       lists a folder of the link, the shared folder by default
+//	GET      /share/<token>/assets/<hash>.brson                           downloads an item inside the shared folder
+//	GET      /share/<token>/assets/signed/<expires>/<signature>/<hash>.brson  the same for links with a password
+//
+// The password of a link is sent in the X-Share-Password header, or as the body of a POST. It is never
+// part of the URL, which ends up in logs and in the worlds the links are spawned in.
+func handleShare(w http.ResponseWriter, r *http.Request) {
+	token, rest, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/share/"), "/")
+	if !ok || token == "" {
+		http.Error(w, "Share link not found", http.StatusNotFound)
+		return
+	}
+	switch {
+	case rest == "folderContent":
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodPost {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+		shareFolderContent(w, r, token)
+	case strings.HasPrefix(rest, "assets/"):
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+		shareAsset(w, r, token, strings.TrimPrefix(rest, "assets/"))
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// sharePassword reads the link password from the X-Share-Password header or the body of a POST
+func sharePassword(r *http.Request) string {
+	if password := r.Header.Get("X-Share-Password"); password != "" {
+		return password
+	}
+	if r.Method != http.MethodPost {
+		return ""
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, 1024))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(body))
+}
+
+// resolveRequest checks the token and password of a request, writing the error response when they don't hold.
+// It also reports whether the link has a password.
+func resolveRequest(w http.ResponseWriter, r *http.Request, token string) (int, bool, bool) {
+	rootId, hasPassword, err := resolve(token, sharePassword(r))
+	switch err {
+	case nil:
+		return rootId, hasPassword, true
+	case errLinkNotFound:
+		reply.Error(w, r, "Share link not found, expired or revoked", http.StatusNotFound)
+	case errPasswordInvalid:
+		reply.Error(w, r, "This share link needs a password", http.StatusUnauthorized)
+	default:
+		reply.Error(w, r, "Server error", http.StatusInternalServerError)
+		fmt.Println("[SHARELINK] Query error:", err)
+	}
+	return -1, false, false
+}
+
+func shareFolderContent(w http.ResponseWriter, r *http.Request, token string) {
+	rootId, hasPassword, ok := resolveRequest(w, r, token)
+	if !ok {
+		return
+	}
+	folderId := rootId
+	if param := r.URL.Query().Get("folderId"); param != "" {
+		parsed, err := strconv.Atoi(param)
+		if err != nil {
+			reply.Error(w, r, "folderId is invalid", http.StatusBadRequest)
+			return
+		}
+		folderId = parsed
+	}
+	inside, err := inSubtree(rootId, folderId)
+	if err != nil {
+		reply.Error(w, r, "Server error", http.StatusInternalServerError)
+		fmt.Println("[SHARELINK] Query error:", err)
+		return
+	}
+	if !inside {
+		reply.Error(w, r, "This folder isn't part of the share link", http.StatusForbidden)
+		return
+	}
+	itemIds, itemNames, itemUrls, err := query.GetChildItems(folderId, false)
+	if err != nil {
+		reply.Error(w, r, "Error while getting items", http.StatusInternalServerError)
+		return
+	}
+	folderIds, folderNames, parentFolder, err := query.GetChildFolders(folderId, false)
+	if err != nil {
+		reply.Error(w, r, "Error while getting folders", http.StatusInternalServerError)
+		return
+	}
+	for i := range itemUrls {
+		itemUrls[i] = linkAssetURL(token, itemUrls[i], hasPassword)
+	}
+	// Nothing above the shared folder is visible through the link
+	if folderId == rootId {
+		parentFolder = -1
+	}
+	if strings.HasPrefix(r.UserAgent(), "Resonite") {
+		response := animxmaker.Animation{
+			Tracks: []animxmaker.AnimationTrackWrapper{
+				animxmaker.ListTrack(itemIds, "items", "id"),
+				animxmaker.ListTrack(itemNames, "items", "name"),
+				animxmaker.ListTrack(itemUrls, "items", "url"),
+				animxmaker.ListTrack(folderIds, "folders", "id"),
+				animxmaker.ListTrack(folderNames, "folders", "name"),
+				animxmaker.ListTrack([]int{parentFolder}, "folders", "parentFolder"),
+			},
+		}
+		encodedResponse, err := response.EncodeAnimation("response")
+		if err != nil {
+			http.Error(w, "Error while encoding animx", http.StatusInternalServerError)
+			return
+		}
+		w.Write(encodedResponse)
+	} else {
+		var items []map[string]any
+		var folders []map[string]any
+		for i := range itemIds {
+			items = append(items, map[string]any{
+				"id":   itemIds[i],
+				"name": itemNames[i],
+				"url":  itemUrls[i],
+			})
+		}
+		for i := range folderIds {
+			folders = append(folders, map[string]any{
+				"id":   folderIds[i],
+				"name": folderNames[i],
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"folderId":     folderId,
+			"parentFolder": parentFolder,
+			"items":        items,
+			"folders":      folders,
+		})
+	}
+}
+
+// Asset hashes can be known from elsewhere, so downloads of a link with a password need the password
+// as well, or a signed URL from a listing that had it.
+func shareAsset(w http.ResponseWriter, r *http.Request, token string, name string) {
+	var rootId int
+	if signedPath, signed := strings.CutPrefix(name, "signed/"); signed {
+		var err error
+		name, err = assethost.VerifyPath(linkSubject(token), signedPath)
+		if err != nil {
+			http.Error(w, "Invalid or expired asset URL", http.StatusForbidden)
+			return
+		}
+		// The signature stands in for the password, the link itself must still be usable
+		rootId, _, err = activeLink(token)
+		if err == errLinkNotFound {
+			http.Error(w, "Share link not found, expired or revoked", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			fmt.Println("[SHARELINK] Query error:", err)
+			return
+		}
+	} else {
+		var ok bool
+		rootId, _, ok = resolveRequest(w, r, token)
+		if !ok {
+			return
+		}
+	}
+	if name == "" || strings.Contains(name, "/") {
+		http.Error(w, "Bad filename", http.StatusBadRequest)
+		return
+	}
+	inside, err := assetInSubtree(rootId, strings.TrimSuffix(name, ".brson"))
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		fmt.Println("[SHARELINK] Query error:", err)
+		return
+	}
+	if !inside {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	http.ServeFile(w, r, assetPath(name))
+}
+
+func AddShareLinkListeners() {
+	http.HandleFunc("/shareLinks/create", createLinkHandler)
+	http.HandleFunc("/shareLinks/list", listLinksHandler)
+	http.HandleFunc("/shareLinks/revoke", revokeLinkHandler)
+	http.HandleFunc("/share/", handleShare)
+}
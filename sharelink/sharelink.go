@@ -0,0 +1,225 @@
+// Package sharelink lets owners hand out read-only links to a folder and everything below it.
+// Holders of a link don't need an account, the random token in the link is their only credential.
+package sharelink
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"path/filepath"
+	"resonite-file-provider/assethost"
+	"resonite-file-provider/authentication"
+	"resonite-file-provider/authorization"
+	"resonite-file-provider/config"
+	"resonite-file-provider/database"
+	"strings"
+	"time"
+)
+
+var (
+	errLinkNotFound    = errors.New("share link not found, expired or revoked")
+	errPasswordInvalid = errors.New("share link password missing or wrong")
+)
+
+type Link struct {
+	ID          int
+	FolderId    int
+	FolderName  string
+	CreatedBy   string
+	CreatedAt   string
+	ExpiresAt   sql.NullString
+	HasPassword bool
+	Revoked     bool
+}
+
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+func newToken() (string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
+}
+
+// Create stores a new link to the folder and returns its ID and token. The token is only known to
+// the caller, the database keeps its hash. A nil expiresAt never expires, an empty password means none.
+func Create(folderId int, createdBy int, expiresAt *time.Time, password string) (int64, string, error) {
+	token, err := newToken()
+	if err != nil {
+		return -1, "", err
+	}
+	var passwordHash any
+	if password != "" {
+		passwordHash, err = authentication.HashSecret(password)
+		if err != nil {
+			return -1, "", err
+		}
+	}
+	var expires any
+	if expiresAt != nil {
+		expires = expiresAt.UTC()
+	}
+	result, err := database.Db.Exec(
+		"INSERT INTO `ShareLinks` (`token_hash`, `folder_id`, `created_by`, `created_at`, `expires_at`, `password_hash`) VALUES (?, ?, ?, UTC_TIMESTAMP(), ?, ?)",
+		hashToken(token), folderId, createdBy, expires, passwordHash,
+	)
+	if err != nil {
+		return -1, "", err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return -1, "", err
+	}
+	return id, token, nil
+}
+
+// List returns the links to the folder, or every link the user created when folderId is -1
+func List(folderId int, createdBy int) ([]Link, error) {
+	filter, arg := "s.folder_id = ?", folderId
+	if folderId == -1 {
+		filter, arg = "s.created_by = ?", createdBy
+	}
+	rows, err := database.Db.Query(`
+		SELECT s.id, s.folder_id, f.name, u.username, s.created_at, s.expires_at, s.password_hash IS NOT NULL, s.revoked = 1
+		FROM ShareLinks s
+		INNER JOIN Folders f ON f.id = s.folder_id
+		INNER JOIN Users u ON u.id = s.created_by
+		WHERE `+filter+`
+		ORDER BY s.created_at DESC`, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var links []Link
+	for rows.Next() {
+		var link Link
+		if err := rows.Scan(&link.ID, &link.FolderId, &link.FolderName, &link.CreatedBy, &link.CreatedAt, &link.ExpiresAt, &link.HasPassword, &link.Revoked); err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+// LinkFolder returns the folder and creator of a link, found is false for unknown IDs
+func LinkFolder(linkId int) (int, int, bool, error) {
+	var folderId, createdBy int
+	err := database.Db.QueryRow("SELECT folder_id, created_by FROM ShareLinks WHERE id = ?", linkId).Scan(&folderId, &createdBy)
+	if err == sql.ErrNoRows {
+		return -1, -1, false, nil
+	} else if err != nil {
+		return -1, -1, false, err
+	}
+	return folderId, createdBy, true, nil
+}
+
+func Revoke(linkId int) error {
+	_, err := database.Db.Exec("UPDATE `ShareLinks` SET `revoked` = b'1' WHERE `id` = ?", linkId)
+	return err
+}
+
+// activeLink returns the root folder and password hash of a link that is neither revoked nor expired
+func activeLink(token string) (int, sql.NullString, error) {
+	var folderId int
+	var passwordHash sql.NullString
+	err := database.Db.QueryRow(`
+		SELECT folder_id, password_hash
+		FROM ShareLinks
+		WHERE token_hash = ? AND revoked = 0 AND (expires_at IS NULL OR expires_at > UTC_TIMESTAMP())`,
+		hashToken(token),
+	).Scan(&folderId, &passwordHash)
+	if err == sql.ErrNoRows {
+		return -1, passwordHash, errLinkNotFound
+	}
+	return folderId, passwordHash, err
+}
+
+// resolve returns the root folder of a usable link and whether it has a password, checking the password if so
+func resolve(token string, password string) (int, bool, error) {
+	folderId, passwordHash, err := activeLink(token)
+	if err != nil {
+		return -1, false, err
+	}
+	if passwordHash.Valid {
+		valid, err := authentication.CheckSecret(passwordHash.String, password)
+		if err != nil {
+			return -1, true, err
+		}
+		if !valid {
+			return -1, true, errPasswordInvalid
+		}
+	}
+	return folderId, passwordHash.Valid, nil
+}
+
+// inSubtree reports whether folderId is rootId or one of its descendants, broken chains count as outside
+func inSubtree(rootId int, folderId int) (bool, error) {
+	inside := false
+	err := authorization.WalkAncestors(folderId, func(current int) (int, bool, error) {
+		if current == rootId {
+			inside = true
+			return -1, false, nil
+		}
+		var parentId int
+		err := database.Db.QueryRow("SELECT parent_folder_id FROM Folders WHERE id = ?", current).Scan(&parentId)
+		if err == sql.ErrNoRows {
+			return -1, false, nil
+		}
+		return parentId, err == nil, err
+	})
+	if err == authorization.ErrFolderChainTooDeep {
+		return false, nil
+	}
+	return inside, err
+}
+
+// assetInSubtree reports whether an item below the root uses the asset as its main record
+func assetInSubtree(rootId int, hash string) (bool, error) {
+	rows, err := database.Db.Query("SELECT folder_id FROM Items WHERE url = ?", hash)
+	if err != nil {
+		return false, err
+	}
+	var folders []int
+	for rows.Next() {
+		var folderId int
+		if err := rows.Scan(&folderId); err != nil {
+			rows.Close()
+			return false, err
+		}
+		folders = append(folders, folderId)
+	}
+	rows.Close()
+	for _, folderId := range folders {
+		inside, err := inSubtree(rootId, folderId)
+		if err != nil || inside {
+			return inside, err
+		}
+	}
+	return false, nil
+}
+
+func assetPath(name string) string {
+	return filepath.Join(config.GetConfig().Server.AssetsPath, filepath.Base(name))
+}
+
+// linkSubject is what asset URLs of a link are signed for, a signature never works with another link
+func linkSubject(token string) string {
+	return "share:" + hashToken(token)
+}
+
+// linkAssetURL points the asset URLs of items at the share link instead of the asset host. Links with a
+// password get short-lived signed URLs, so downloads don't have to send the password again.
+func linkAssetURL(token string, url string, signed bool) string {
+	if signed {
+		hash := strings.TrimPrefix(strings.TrimPrefix(url, "/"), "assets/")
+		return "share/" + token + "/assets/signed/" + assethost.SignPath(linkSubject(token), hash)
+	}
+	return "share/" + token + "/" + strings.TrimPrefix(url, "/")
+}
@@ -216,7 +216,7 @@ document.addEventListener('DOMContentLoaded', () => {
                         <div class="item-icon"><i class="fas fa-cube"></i></div>
                         <div class="item-name">${item.name}</div>
                         <div class="item-actions">
-                            <a href="${item.url}?auth=${token}" class="item-link" target="_blank">
+                            <a href="${item.url}" class="item-link" target="_blank">
                                 <i class="fas fa-eye"></i>
                             </a>
                             <button class="delete-item" data-id="${item.id}" data-name="${item.name}">
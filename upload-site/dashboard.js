@@ -184,7 +184,7 @@ document.addEventListener('DOMContentLoaded', () => {
             itemElement.innerHTML = `
                 <i class="fas fa-file-alt"></i>
                 <div class="item-name">${data.name[i]}</div>
-                <a href="${data.url[i]}?auth=${authToken}" class="item-link" target="_blank">View</a>
+                <a href="${data.url[i]}" class="item-link" target="_blank">View</a>
             `;
             
             elements.itemsContainer.appendChild(itemElement);
@@ -35,14 +35,38 @@ document.addEventListener('DOMContentLoaded', () => {
             elements.loginMessage.textContent = 'Logging in...';
             elements.loginMessage.className = 'message';
             
-            const response = await fetch('/auth/login', {
+            // JSON bodies allow any character in passwords, Resonite sends username\npassword instead
+            let response = await fetch('/auth/login', {
                 method: 'POST',
                 headers: {
-                    'Content-Type': 'text/plain'
+                    'Content-Type': 'application/json'
                 },
-                body: `${username}\n${password}`
+                body: JSON.stringify({ username, password })
             });
             
+            // Accounts with two-factor authentication need a code as the third line
+            if (response.status === 401 && (response.headers.get('Content-Type') || '').includes('application/json')) {
+                const data = await response.json();
+                if (!data.twoFactorRequired) {
+                    throw new Error(data.error || 'Login failed');
+                }
+                const code = window.prompt('Enter the code from your authenticator app or a recovery code');
+                if (!code) {
+                    throw new Error(data.error);
+                }
+                response = await fetch('/auth/login', {
+                    method: 'POST',
+                    headers: {
+                        'Content-Type': 'application/json'
+                    },
+                    body: JSON.stringify({ username, password, code })
+                });
+                if (!response.ok) {
+                    const retry = await response.json().catch(() => ({}));
+                    throw new Error(retry.error || 'Login failed');
+                }
+            }
+            
             if (!response.ok) {
                 throw new Error(await response.text() || 'Login failed');
             }
@@ -77,6 +101,7 @@ document.addEventListener('DOMContentLoaded', () => {
         const username = document.getElementById('register-username').value;
         const password = document.getElementById('register-password').value;
         const confirm = document.getElementById('register-confirm').value;
+        const invite = document.getElementById('register-invite').value.trim();
         
         if (password !== confirm) {
             elements.registerMessage.textContent = 'Passwords do not match';
@@ -91,9 +116,9 @@ document.addEventListener('DOMContentLoaded', () => {
             const response = await fetch('/auth/register', {
                 method: 'POST',
                 headers: {
-                    'Content-Type': 'text/plain'
+                    'Content-Type': 'application/json'
                 },
-                body: `${username}\n${password}`
+                body: JSON.stringify({ username, password, invite })
             });
             
             if (!response.ok) {
@@ -113,6 +138,45 @@ document.addEventListener('DOMContentLoaded', () => {
         }
     });
 
+    // A single sign-on login of an account with two-factor authentication comes back here for the code
+    async function finishSingleSignOn() {
+        while (true) {
+            const code = window.prompt('Enter the code from your authenticator app or a recovery code');
+            if (!code) {
+                elements.loginMessage.textContent = 'Login cancelled';
+                elements.loginMessage.className = 'message error';
+                return;
+            }
+            const response = await fetch(`/auth/oidc/twoFactor?code=${encodeURIComponent(code)}`, {
+                method: 'POST'
+            });
+            if (response.ok) {
+                window.location.replace('/dashboard');
+                return;
+            }
+            const data = await response.json().catch(() => ({}));
+            if (!data.twoFactorRequired) {
+                elements.loginMessage.textContent = data.error || 'Login failed, please try again';
+                elements.loginMessage.className = 'message error';
+                return;
+            }
+        }
+    }
+    if (new URLSearchParams(window.location.search).get('twoFactor') === 'oidc') {
+        finishSingleSignOn();
+    }
+
+    // Show the single sign-on button when the server has an identity provider configured
+    fetch('/auth/oidc/info')
+        .then(response => response.json())
+        .then(info => {
+            if (!info.enabled) return;
+            const button = document.getElementById('oidc-login');
+            document.getElementById('oidc-name').textContent = `Log in with ${info.name}`;
+            button.style.display = '';
+        })
+        .catch(() => {});
+
     // Check if we're already on the dashboard
     if (window.location.pathname === '/dashboard') {
         return; // Already on dashboard, don't redirect
@@ -37,11 +37,32 @@ document.addEventListener('DOMContentLoaded', () => {
         return null;
     };
 
+    // Renew the short-lived access token using the refresh_token cookie,
+    // then schedule the next renewal shortly before the new token expires
+    async function refreshSession() {
+        try {
+            const response = await fetch('/auth/refresh', {
+                method: 'POST',
+                credentials: 'include'
+            });
+            if (!response.ok) {
+                return false;
+            }
+            const data = await response.json();
+            setTimeout(refreshSession, data.expiresIn * 800);
+            return true;
+        } catch (error) {
+            console.error("Session refresh failed:", error);
+            return false;
+        }
+    }
+
     // Check if user is authenticated
-    function checkAuth() {
+    async function checkAuth() {
         console.log("Dashboard checkAuth running");
         console.log("Cookies available:", document.cookie);
         
+        await refreshSession();
         const token = getCookie('auth_token');
         console.log("Auth token from cookie:", token ? "Present (length: " + token.length + ")" : "Not found");
         
@@ -155,7 +176,11 @@ document.addEventListener('DOMContentLoaded', () => {
                 inventoryElement.className = 'inventory';
                 inventoryElement.dataset.id = inventory.id;
                 //inventoryElement.dataset.rootFolderId = inventory.rootFolderId;
-                inventoryElement.innerHTML = `<i class="fas fa-box"></i> ${inventory.name}  <div><button class="btn-small side-btn-danger delete-item-side" data-id="${inventory.id}"><i class="fas fa-trash"></i></button></div>`;     
+                // Shared inventories get their own icon, only owners can rename or delete an inventory
+                const icon = inventory.shared ? `<i class="fas fa-user-friends" title="Shared with you (${inventory.role})"></i>` : '<i class="fas fa-box"></i>';
+                const deleteButtonHtml = inventory.role === 'owner' ? `<button class="btn-small side-btn-danger delete-item-side" data-id="${inventory.id}"><i class="fas fa-trash"></i></button>` : '';
+                const renameButtonHtml = inventory.role === 'owner' ? `<button class="btn-small rename-item-side" data-id="${inventory.id}"><i class="fas fa-pen"></i></button>` : '';
+                inventoryElement.innerHTML = `${icon} ${inventory.name}  <div>${renameButtonHtml}${deleteButtonHtml}</div>`;
                 inventoryElement.addEventListener('click', () => {
                     currentInventoryId = inventory.id;
                     loadRootFolder(inventory.id);
@@ -175,6 +200,13 @@ document.addEventListener('DOMContentLoaded', () => {
                         showDeleteConfirmation(inventory.id, inventory.name, 'inventory');
                     });
                 }
+                const renameButton = inventoryElement.querySelector('.rename-item-side');
+                if (renameButton) {
+                    renameButton.addEventListener('click', (e) => {
+                        e.stopPropagation();
+                        renameEntry(inventory.id, inventory.name, 'inventory');
+                    });
+                }
                 
                 elements.inventoryTree.appendChild(inventoryElement);
             });
@@ -370,6 +402,7 @@ document.addEventListener('DOMContentLoaded', () => {
                 folderElement.dataset.id = folder.id;
                 folderElement.innerHTML = `
                     <button class="btn-small side-btn-danger delete-item-side" data-id="${folder.id}"><i class="fas fa-trash"></i></button>
+                    <button class="btn-small rename-item-side" data-id="${folder.id}"><i class="fas fa-pen"></i></button>
                     <div class="folder-icon">
                     <i class="fas fa-folder"></i></div>
                     <div class="folder-name">${folder.name}</div>
@@ -383,6 +416,13 @@ document.addEventListener('DOMContentLoaded', () => {
                         showDeleteConfirmation(folder.id, folder.name, 'folder');
                     });
                 }
+                const renameButton = folderElement.querySelector('.rename-item-side');
+                if (renameButton) {
+                    renameButton.addEventListener('click', (e) => {
+                        e.stopPropagation();
+                        renameEntry(folder.id, folder.name, 'folder');
+                    });
+                }
                 folderElement.addEventListener('click', () => {
                     loadFolderContents(folder.id, true);
                 });
@@ -425,6 +465,9 @@ document.addEventListener('DOMContentLoaded', () => {
                     <a href="${item.url}.brson" class="btn btn-small" target="_blank">
                         <i class="fas fa-download"></i> Download
                     </a>
+                    <button class="btn btn-small rename-item" data-id="${item.id}">
+                        <i class="fas fa-pen"></i>
+                    </button>
                     <button class="btn btn-small btn-danger delete-item" data-id="${item.id}">
                         <i class="fas fa-trash"></i>
                     </button>
@@ -440,6 +483,13 @@ document.addEventListener('DOMContentLoaded', () => {
                     showDeleteConfirmation(item.id, item.name, 'item');
                 });
             }
+            const renameButton = itemElement.querySelector('.rename-item');
+            if (renameButton) {
+                renameButton.addEventListener('click', (e) => {
+                    e.stopPropagation();
+                    renameEntry(item.id, item.name, 'item');
+                });
+            }
             
             elements.itemsContainer.appendChild(itemElement);
         });
@@ -496,6 +546,35 @@ document.addEventListener('DOMContentLoaded', () => {
         }
     }
     
+    // Ask for a new name and rename an item, folder or inventory
+    async function renameEntry(id, name, type) {
+        const newName = prompt(`Rename ${type}`, name);
+        if (newName === null || newName.trim() === '' || newName.trim() === name) return;
+        const urls = {
+            item: `/renameItem?itemId=${id}`,
+            folder: `/renameFolder?folderId=${id}`,
+            inventory: `/renameInventory?inventoryId=${id}`
+        };
+        try {
+            const response = await fetch(`${urls[type]}&name=${encodeURIComponent(newName)}`, {
+                method: 'POST',
+                credentials: 'include'
+            });
+            const data = await response.json();
+            if (!response.ok || !data.success) {
+                throw new Error(data.error || `Failed to rename ${type}`);
+            }
+            if (type === 'inventory') {
+                loadInventories();
+            } else if (currentFolderId) {
+                loadFolderContents(currentFolderId);
+            }
+        } catch (error) {
+            console.error(`Error renaming ${type}:`, error);
+            alert(`Error renaming ${type}: ${error.message}`);
+        }
+    }
+
     // Show delete confirmation dialog
     function showDeleteConfirmation(id, name, type) {
         if (!elements.deleteConfirmModal) return;
@@ -661,6 +740,112 @@ document.addEventListener('DOMContentLoaded', () => {
             });
         }
         
+        // Sessions, every device the user is logged in on can be logged out separately
+        const sessionsBtn = document.getElementById('sessions-btn');
+        const sessionsModal = document.getElementById('sessions-modal');
+        const sessionsList = document.getElementById('sessions-list');
+        async function loadSessions() {
+            try {
+                const response = await fetch('/auth/sessions/list', { credentials: 'same-origin' });
+                const data = await response.json();
+                if (!data.success) {
+                    throw new Error(data.error || 'Failed to load sessions');
+                }
+                sessionsList.innerHTML = '';
+                (data.sessions || []).forEach(session => {
+                    const row = document.createElement('div');
+                    row.className = 'session-item';
+                    const details = document.createElement('div');
+                    const device = document.createElement('strong');
+                    device.textContent = (session.userAgent || 'Unknown device') + (session.current ? ' (this device)' : '');
+                    const info = document.createElement('small');
+                    info.textContent = ` ${session.ip || ''} - logged in ${session.createdAt} UTC, last seen ${session.lastSeenAt || 'never'} UTC`;
+                    if (session.lastSeenIp && session.lastSeenIp !== session.ip) {
+                        info.textContent += ` from ${session.lastSeenIp}`;
+                    }
+                    details.appendChild(device);
+                    details.appendChild(info);
+                    row.appendChild(details);
+                    const revokeButton = document.createElement('button');
+                    revokeButton.className = 'btn btn-small btn-danger';
+                    revokeButton.innerHTML = '<i class="fas fa-sign-out-alt"></i> Log out';
+                    revokeButton.addEventListener('click', async () => {
+                        const result = await fetch(`/auth/sessions/revoke?id=${encodeURIComponent(session.id)}`, {
+                            method: 'POST',
+                            credentials: 'same-origin'
+                        });
+                        if (!result.ok) {
+                            alert(await result.text() || 'Failed to revoke session');
+                            return;
+                        }
+                        if (session.current) {
+                            window.location.replace('/logout');
+                            return;
+                        }
+                        loadSessions();
+                    });
+                    row.appendChild(revokeButton);
+                    sessionsList.appendChild(row);
+                });
+            } catch (error) {
+                handleApiError(error, sessionsList, 'Failed to load sessions');
+            }
+        }
+        if (sessionsBtn && sessionsModal && sessionsList) {
+            sessionsBtn.addEventListener('click', () => {
+                toggleModal(sessionsModal, true);
+                loadSessions();
+            });
+        }
+        
+        // Account deletion, the password is asked again and the export is downloaded before leaving
+        const deleteAccountBtn = document.getElementById('delete-account-btn');
+        const deleteAccountModal = document.getElementById('delete-account-modal');
+        const deleteAccountForm = document.getElementById('delete-account-form');
+        if (deleteAccountBtn && deleteAccountModal && deleteAccountForm) {
+            deleteAccountBtn.addEventListener('click', () => {
+                toggleModal(deleteAccountModal, true);
+            });
+            deleteAccountForm.addEventListener('submit', async (e) => {
+                e.preventDefault();
+                const message = document.getElementById('delete-account-message');
+                const password = document.getElementById('delete-account-password').value;
+                const code = document.getElementById('delete-account-code').value.trim();
+                const withExport = document.getElementById('delete-account-export').checked;
+                try {
+                    message.textContent = 'Deleting account...';
+                    message.className = 'message';
+                    const response = await fetch(`/account/delete${withExport ? '?export=1' : ''}`, {
+                        method: 'POST',
+                        credentials: 'same-origin',
+                        headers: {
+                            'Content-Type': 'text/plain'
+                        },
+                        body: code ? `${password}\n${code}` : password
+                    });
+                    if (!response.ok) {
+                        throw new Error(await response.text() || 'Failed to delete account');
+                    }
+                    if (withExport) {
+                        const blob = await response.blob();
+                        const link = document.createElement('a');
+                        link.href = URL.createObjectURL(blob);
+                        link.download = 'account-export.zip';
+                        document.body.appendChild(link);
+                        link.click();
+                        link.remove();
+                    }
+                    localStorage.removeItem('username');
+                    setTimeout(() => {
+                        window.location.replace('/login');
+                    }, 1000);
+                } catch (error) {
+                    message.textContent = error.message;
+                    message.className = 'message error';
+                }
+            });
+        }
+        
         // New Folder form submission
         const newFolderForm = document.getElementById('new-folder-form');
         if (newFolderForm) {
@@ -0,0 +1,290 @@
+package upload
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"resonite-file-provider/authentication"
+	"resonite-file-provider/config"
+	"resonite-file-provider/database"
+	"strings"
+	"time"
+)
+
+// Accounts without a password confirm their deletion by having logged in this recently
+const recentLoginWindow = 10 * time.Minute
+
+type exportItem struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+type exportFolder struct {
+	ID             int          `json:"id"`
+	Name           string       `json:"name"`
+	ParentFolderId int          `json:"parentFolderId"`
+	Items          []exportItem `json:"items"`
+}
+
+type exportInventory struct {
+	ID      int            `json:"id"`
+	Name    string         `json:"name"`
+	Folders []exportFolder `json:"folders"`
+}
+
+type accountExport struct {
+	Username    string            `json:"username"`
+	ExportedAt  string            `json:"exportedAt"`
+	Inventories []exportInventory `json:"inventories"`
+}
+
+// collectExport reads the inventories, folders and items of the user and the hashes of every asset they use
+func collectExport(userId int, username string) (*accountExport, []string, error) {
+	export := &accountExport{Username: username, ExportedAt: time.Now().UTC().Format(time.RFC3339)}
+	rows, err := database.Db.Query(`
+		SELECT i.id, i.name
+		FROM Inventories i
+		INNER JOIN users_inventories ui ON ui.inventory_id = i.id
+		WHERE ui.user_id = ?
+		ORDER BY i.id`, userId)
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		var inventory exportInventory
+		if err := rows.Scan(&inventory.ID, &inventory.Name); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		export.Inventories = append(export.Inventories, inventory)
+	}
+	rows.Close()
+	for i := range export.Inventories {
+		inventory := &export.Inventories[i]
+		folders, err := database.Db.Query("SELECT id, name, parent_folder_id FROM Folders WHERE inventory_id = ? ORDER BY id", inventory.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		for folders.Next() {
+			var folder exportFolder
+			if err := folders.Scan(&folder.ID, &folder.Name, &folder.ParentFolderId); err != nil {
+				folders.Close()
+				return nil, nil, err
+			}
+			inventory.Folders = append(inventory.Folders, folder)
+		}
+		folders.Close()
+		for j := range inventory.Folders {
+			folder := &inventory.Folders[j]
+			items, err := database.Db.Query("SELECT id, name, url FROM Items WHERE folder_id = ? ORDER BY id", folder.ID)
+			if err != nil {
+				return nil, nil, err
+			}
+			for items.Next() {
+				var item exportItem
+				if err := items.Scan(&item.ID, &item.Name, &item.URL); err != nil {
+					items.Close()
+					return nil, nil, err
+				}
+				folder.Items = append(folder.Items, item)
+			}
+			items.Close()
+		}
+	}
+	hashRows, err := database.Db.Query(`
+		SELECT DISTINCT a.hash
+		FROM users_inventories ui
+		INNER JOIN Folders f ON f.inventory_id = ui.inventory_id
+		INNER JOIN Items i ON i.folder_id = f.id
+		INNER JOIN `+"`hash-usage`"+` h ON h.item_id = i.id
+		INNER JOIN Assets a ON a.id = h.asset_id
+		WHERE ui.user_id = ?`, userId)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer hashRows.Close()
+	var hashes []string
+	for hashRows.Next() {
+		var hash string
+		if err := hashRows.Scan(&hash); err != nil {
+			return nil, nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+	return export, hashes, nil
+}
+
+// writeExport writes account.json and the asset files of the user into a zip archive
+func writeExport(w io.Writer, userId int, username string) error {
+	export, hashes, err := collectExport(userId, username)
+	if err != nil {
+		return err
+	}
+	archive := zip.NewWriter(w)
+	manifest, err := archive.Create("account.json")
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(manifest)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(export); err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		for _, name := range []string{hash, hash + ".brson"} {
+			data, err := os.ReadFile(filepath.Join(config.GetConfig().Server.AssetsPath, name))
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return err
+			}
+			file, err := archive.Create("assets/" + name)
+			if err != nil {
+				return err
+			}
+			if _, err := file.Write(data); err != nil {
+				return err
+			}
+		}
+	}
+	return archive.Close()
+}
+
+func serveExport(w http.ResponseWriter, archive io.Reader, username string) {
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", username+"-export.zip"))
+	io.Copy(w, archive)
+}
+
+// handles GET /account/export, downloads everything the user uploaded as a zip
+func handleAccountExport(w http.ResponseWriter, r *http.Request) {
+	claims := authentication.AuthCheck(w, r)
+	if claims == nil || !authentication.RequireSession(w, r, claims) {
+		return
+	}
+	archive, err := os.CreateTemp("", "account-export-*.zip")
+	if err != nil {
+		http.Error(w, "Failed to create export", http.StatusInternalServerError)
+		fmt.Println("[ACCOUNT] Failed to create export file:", err)
+		return
+	}
+	defer os.Remove(archive.Name())
+	defer archive.Close()
+	if err := writeExport(archive, claims.UID, claims.Username); err != nil {
+		http.Error(w, "Failed to create export", http.StatusInternalServerError)
+		fmt.Println("[ACCOUNT] Failed to export account:", err)
+		return
+	}
+	archive.Seek(0, io.SeekStart)
+	fmt.Println("[ACCOUNT] Exported account of user:", claims.Username)
+	serveExport(w, archive, claims.Username)
+}
+
+// handles POST /account/delete, the body is the password and, with two-factor enabled, a code on the second line.
+// Accounts without a password leave the first line empty and have to log in again shortly before.
+// With ?export=1 the response is the export of the account, taken right before it was deleted.
+func handleAccountDelete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := authentication.AuthCheck(w, r)
+	if claims == nil || !authentication.RequireSession(w, r, claims) {
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read body", http.StatusBadRequest)
+		return
+	}
+	password, code, _ := strings.Cut(string(body), "\n")
+	hasPassword, err := authentication.HasPassword(claims.UID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		fmt.Println("[ACCOUNT] Query error:", err)
+		return
+	}
+	if hasPassword {
+		valid, err := authentication.CheckPassword(claims.UID, password)
+		if err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			fmt.Println("[ACCOUNT] Query error:", err)
+			return
+		}
+		if !valid {
+			http.Error(w, "Invalid password", http.StatusUnauthorized)
+			return
+		}
+	} else {
+		// Without a password to ask for, a fresh login through the provider is the confirmation
+		recent, err := authentication.IsRecentLogin(claims.ID, recentLoginWindow)
+		if err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			fmt.Println("[ACCOUNT] Query error:", err)
+			return
+		}
+		if !recent {
+			http.Error(w, "Please log in again right before deleting your account", http.StatusUnauthorized)
+			return
+		}
+	}
+	twoFactor, err := authentication.IsTwoFactorEnabled(claims.UID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		fmt.Println("[ACCOUNT] Query error:", err)
+		return
+	}
+	if twoFactor {
+		valid, err := authentication.VerifySecondFactor(claims.UID, strings.TrimSpace(code))
+		if err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			fmt.Println("[ACCOUNT] Two-factor error:", err)
+			return
+		}
+		if !valid {
+			http.Error(w, "Invalid two-factor code", http.StatusUnauthorized)
+			return
+		}
+	}
+	var archive *os.File
+	if r.URL.Query().Get("export") == "1" {
+		// The export is written before anything is deleted, a failed export leaves the account untouched
+		archive, err = os.CreateTemp("", "account-export-*.zip")
+		if err == nil {
+			defer os.Remove(archive.Name())
+			defer archive.Close()
+			err = writeExport(archive, claims.UID, claims.Username)
+		}
+		if err != nil {
+			http.Error(w, "Failed to create export, the account was not deleted", http.StatusInternalServerError)
+			fmt.Println("[ACCOUNT] Failed to export account:", err)
+			return
+		}
+	}
+	if err := RemoveUser(claims.UID); err != nil {
+		http.Error(w, "Failed to delete account", http.StatusInternalServerError)
+		fmt.Println("[ACCOUNT] Failed to delete account:", err)
+		return
+	}
+	fmt.Println("[ACCOUNT] Deleted account of user:", claims.Username)
+	http.SetCookie(w, &http.Cookie{Name: "auth_token", Value: "", Path: "/", MaxAge: -1})
+	http.SetCookie(w, &http.Cookie{Name: "refresh_token", Value: "", Path: "/", MaxAge: -1})
+	if archive != nil {
+		archive.Seek(0, io.SeekStart)
+		serveExport(w, archive, claims.Username)
+		return
+	}
+	if strings.HasPrefix(r.UserAgent(), "Resonite") {
+		w.Write([]byte("Account deleted"))
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+		})
+	}
+}
@@ -1,15 +1,17 @@
 package upload
 
 import (
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
 	"path/filepath"
 	"resonite-file-provider/authentication"
+	"resonite-file-provider/authorization"
 	"resonite-file-provider/config"
 	"resonite-file-provider/database"
-	"resonite-file-provider/query"
+	"resonite-file-provider/reply"
 	"strconv"
 	"strings"
 )
@@ -52,6 +54,9 @@ func handleAddFolder(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	if !authentication.RequireScope(w, r, claims, authentication.ScopeUpload) {
+		return
+	}
 	folderId, err := strconv.Atoi(r.URL.Query().Get("folderId"))
 	if err != nil {
 		if strings.HasPrefix(r.UserAgent(), "Resonite") {
@@ -66,7 +71,7 @@ func handleAddFolder(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
-	if allowed, err := query.IsFolderOwner(folderId, claims.UID); err != nil || !allowed {
+	if allowed, err := authorization.Can(claims.UID, authorization.EndpointAction("POST /addFolder"), authorization.Folder(folderId)); err != nil || !allowed {
 		if strings.HasPrefix(r.UserAgent(), "Resonite") {
 			http.Error(w, "Forbidden", http.StatusForbidden)
 		} else {
@@ -143,7 +148,7 @@ func AddInventory(userID int, inventoryName string) (int64, int64, error) {
 	if err != nil {
 		return -1, -1, err
 	}
-	_, err = database.Db.Exec(`INSERT INTO users_inventories (user_id, inventory_id) VALUES (?, ?)`, userID, invID)
+	_, err = database.Db.Exec(`INSERT INTO users_inventories (user_id, inventory_id, role) VALUES (?, ?, ?)`, userID, invID, authorization.RoleOwner)
 	if err != nil {
 		return -1, -1, err
 	}
@@ -188,6 +193,9 @@ func handleAddInventory(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	if !authentication.RequireScope(w, r, claims, authentication.ScopeManage) {
+		return
+	}
 
 	inventoryName := r.URL.Query().Get("inventoryName")
 	if inventoryName == "" {
@@ -257,6 +265,7 @@ func RemoveItem(itemId int) error {
 		}
 	}
 	_, err = database.Db.Exec("DELETE FROM `hash-usage` WHERE item_id = ?", itemId)
+	_, err = database.Db.Exec("DELETE FROM Deliveries WHERE item_id = ?", itemId)
 	_, err = database.Db.Exec("DELETE FROM Items WHERE id = ?", itemId)
 	for _, affectedId := range affectedAssetIds {
 		var assetHash string
@@ -304,6 +313,9 @@ func handleRemoveItem(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	if !authentication.RequireScope(w, r, claims, authentication.ScopeManage) {
+		return
+	}
 
 	itemId, err := strconv.Atoi(r.URL.Query().Get("itemId"))
 	if err != nil {
@@ -319,17 +331,15 @@ func handleRemoveItem(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
-	var folderId int
-	database.Db.QueryRow("SELECT folder_id FROM Items WHERE id = ?", itemId).Scan(&folderId)
-	if allowed, err := query.IsFolderOwner(folderId, claims.UID); err != nil || !allowed {
+	if allowed, err := authorization.Can(claims.UID, authorization.EndpointAction("POST /removeItem"), authorization.Item(itemId)); err != nil || !allowed {
 		if strings.HasPrefix(r.UserAgent(), "Resonite") {
 			http.Error(w, "Forbidden", http.StatusForbidden)
 		} else {
-			fmt.Println("[ITEM] Error finding item in database:", err.Error())
+			fmt.Println("[ITEM] Access denied to item ID:", itemId, "for user:", claims.Username)
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(map[string]interface{}{
 				"success": false,
-				"error":   "Item not found: " + err.Error(),
+				"error":   "You don't have permission to remove this item",
 			})
 		}
 		return
@@ -395,6 +405,10 @@ func RemoveFolder(folderId int) error {
 		}
 	}
 	for _, folder := range affectedFolders {
+		_, err = database.Db.Exec("DELETE FROM ShareLinks WHERE folder_id = ?", folder)
+		if err != nil {
+			return err
+		}
 		_, err = database.Db.Exec("DELETE FROM Folders WHERE id = ?", folder)
 		if err != nil {
 			return err
@@ -428,6 +442,9 @@ func handleRemoveFolder(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	if !authentication.RequireScope(w, r, claims, authentication.ScopeManage) {
+		return
+	}
 
 	folderId, err := strconv.Atoi(r.URL.Query().Get("folderId"))
 	if err != nil {
@@ -442,14 +459,14 @@ func handleRemoveFolder(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
-	if allowed, err := query.IsFolderOwner(folderId, claims.UID); err != nil || !allowed {
+	if allowed, err := authorization.Can(claims.UID, authorization.EndpointAction("POST /removeFolder"), authorization.Folder(folderId)); err != nil || !allowed {
 		if strings.HasPrefix(r.UserAgent(), "Resonite") {
 			http.Error(w, "Forbidden", http.StatusForbidden)
 		} else {
-			fmt.Println("[FOLDER] Error finding folder in database:", err.Error())
+			fmt.Println("[FOLDER] Access denied to folder ID:", folderId, "for user:", claims.Username)
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(map[string]interface{}{
-				"error": "Folder not found: " + err.Error(),
+				"error": "You don't have permission to remove this folder",
 			})
 		}
 		return
@@ -471,42 +488,136 @@ func handleRemoveFolder(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// RemoveInventory deletes the inventory with everything in it in one transaction
 func RemoveInventory(inventoryId int) error {
-	folders, err := database.Db.Query("SELECT id FROM Folders WHERE inventory_id = ?", inventoryId)
+	tx, err := database.Db.Begin()
 	if err != nil {
 		return err
 	}
-	var affectedFolders []int
-	for folders.Next() {
-		var id int
-		folders.Scan(&id)
-		affectedFolders = append(affectedFolders, id)
+	defer tx.Rollback()
+	orphaned, err := removeInventory(tx, inventoryId)
+	if err != nil {
+		return err
 	}
-	for _, folder := range affectedFolders {
-		var affectedItems []int
-		items, err := database.Db.Query("SELECT id FROM Items where folder_id = ?", folder)
-		if err != nil {
-			return err
-		}
-		for items.Next() {
-			var itemId int
-			items.Scan(&itemId)
-			affectedItems = append(affectedItems, itemId)
-		}
-		for _, item := range affectedItems {
-			err := RemoveItem(item)
-			if err != nil {
-				return err
-			}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	removeAssetFiles(orphaned)
+	return nil
+}
+
+// queryIds runs a query selecting one int column inside the transaction
+func queryIds(tx *sql.Tx, statement string, args ...any) ([]int, error) {
+	rows, err := tx.Query(statement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
 		}
+		ids = append(ids, id)
 	}
-	for _, folder := range affectedFolders {
-		_, err = database.Db.Exec("DELETE FROM Folders WHERE id = ?", folder)
+	return ids, rows.Err()
+}
+
+// removeInventory deletes the inventory with its folders, items and share links inside the transaction.
+// It returns the hashes of the assets nothing uses anymore, their files may only go once the transaction committed.
+func removeInventory(tx *sql.Tx, inventoryId int) ([]string, error) {
+	assetIds, err := queryIds(tx, "SELECT DISTINCT hu.asset_id FROM `hash-usage` hu INNER JOIN Items i ON i.id = hu.item_id INNER JOIN Folders f ON f.id = i.folder_id WHERE f.inventory_id = ?", inventoryId)
+	if err != nil {
+		return nil, err
+	}
+	statements := []string{
+		"DELETE hu FROM `hash-usage` hu INNER JOIN Items i ON i.id = hu.item_id INNER JOIN Folders f ON f.id = i.folder_id WHERE f.inventory_id = ?",
+		"DELETE d FROM Deliveries d INNER JOIN Items i ON i.id = d.item_id INNER JOIN Folders f ON f.id = i.folder_id WHERE f.inventory_id = ?",
+		"DELETE i FROM Items i INNER JOIN Folders f ON f.id = i.folder_id WHERE f.inventory_id = ?",
+		"DELETE s FROM ShareLinks s INNER JOIN Folders f ON f.id = s.folder_id WHERE f.inventory_id = ?",
+		"DELETE FROM Folders WHERE inventory_id = ?",
+		"DELETE FROM users_inventories WHERE inventory_id = ?",
+		"DELETE FROM groups_inventories WHERE inventory_id = ?",
+		"DELETE FROM Inventories WHERE id = ?",
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement, inventoryId); err != nil {
+			return nil, err
+		}
+	}
+	var orphaned []string
+	for _, assetId := range assetIds {
+		var hash string
+		err := tx.QueryRow("SELECT hash FROM `Assets` WHERE id = ? AND NOT EXISTS(SELECT 1 FROM `hash-usage` WHERE `asset_id` = ?)", assetId, assetId).Scan(&hash)
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec("DELETE FROM `Assets` WHERE id = ?", assetId); err != nil {
+			return nil, err
+		}
+		orphaned = append(orphaned, hash)
+	}
+	return orphaned, nil
+}
+
+// removeAssetFiles deletes the stored files of assets removed from the database
+func removeAssetFiles(hashes []string) {
+	for _, hash := range hashes {
+		os.Remove(filepath.Join(config.GetConfig().Server.AssetsPath, hash))
+		os.Remove(filepath.Join(config.GetConfig().Server.AssetsPath, hash) + ".brson")
+	}
+}
+
+// RemoveUser removes every inventory the user is the only owner of with its items, then the account itself,
+// all in one transaction so a failure leaves the account as it was.
+// Inventories shared with the user or co-owned by someone else or a group with other members stay, only the membership goes.
+func RemoveUser(userId int) error {
+	tx, err := database.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// Inventories the user owns, directly or through a group, that nobody would own afterwards.
+	// A group only counts as another owner while someone besides the user is in it.
+	inventories, err := queryIds(tx, `
+		SELECT owned.inventory_id
+		FROM (
+			SELECT ui.inventory_id FROM users_inventories ui WHERE ui.user_id = ? AND ui.role = ?
+			UNION
+			SELECT gi.inventory_id
+			FROM groups_inventories gi
+			INNER JOIN group_members gm ON gm.group_id = gi.group_id
+			WHERE gm.user_id = ? AND gi.role = ?
+		) owned
+		WHERE NOT EXISTS (
+			SELECT 1 FROM users_inventories o
+			WHERE o.inventory_id = owned.inventory_id AND o.role = ? AND o.user_id <> ?
+		) AND NOT EXISTS (
+			SELECT 1 FROM groups_inventories g
+			INNER JOIN group_members m ON m.group_id = g.group_id
+			WHERE g.inventory_id = owned.inventory_id AND g.role = ? AND m.user_id <> ?
+		)`, userId, authorization.RoleOwner, userId, authorization.RoleOwner, authorization.RoleOwner, userId, authorization.RoleOwner, userId)
+	if err != nil {
+		return err
+	}
+	var orphaned []string
+	for _, inventoryId := range inventories {
+		hashes, err := removeInventory(tx, inventoryId)
 		if err != nil {
 			return err
 		}
+		orphaned = append(orphaned, hashes...)
+	}
+	if err := authentication.RemoveUserData(tx, userId); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
 	}
-	_, err = database.Db.Exec("DELETE FROM Inventories WHERE id = ?", inventoryId)
+	removeAssetFiles(orphaned)
 	return nil
 }
 func handleRemoveInventory(w http.ResponseWriter, r *http.Request) {
@@ -535,6 +646,9 @@ func handleRemoveInventory(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	if !authentication.RequireScope(w, r, claims, authentication.ScopeManage) {
+		return
+	}
 
 	inventoryId, err := strconv.Atoi(r.URL.Query().Get("inventoryId"))
 	if err != nil {
@@ -549,14 +663,14 @@ func handleRemoveInventory(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
-	if allowed, err := query.IsFolderOwner(inventoryId, claims.UID); err != nil || !allowed {
+	if allowed, err := authorization.Can(claims.UID, authorization.EndpointAction("POST /removeInventory"), authorization.Inventory(inventoryId)); err != nil || !allowed {
 		if strings.HasPrefix(r.UserAgent(), "Resonite") {
 			http.Error(w, "Forbidden", http.StatusForbidden)
 		} else {
-			fmt.Println("[INVENTORY] Error finding inventory in database:", err.Error())
+			fmt.Println("[INVENTORY] Access denied to inventory ID:", inventoryId, "for user:", claims.Username)
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(map[string]interface{}{
-				"error": "Inventory not found: " + err.Error(),
+				"error": "Only owners can remove an inventory",
 			})
 		}
 		return
@@ -577,49 +691,122 @@ func handleRemoveInventory(w http.ResponseWriter, r *http.Request) {
 	fmt.Println("[INVENTORY] Successfully removed folder ID:", inventoryId)
 }
 
-func MakeAssetPublic(itemId int) error {
-       _, err := database.Db.Exec("UPDATE `Items` SET `isPublic` = b'1' WHERE `id` = ?;", itemId)
-       return err;
+// parseVisibility reads the public parameter of the visibility endpoints. inherit clears the
+// visibility so it comes from the folder above again, for root folders that means private.
+func parseVisibility(value string) (sql.NullBool, error) {
+	if value == "inherit" {
+		return sql.NullBool{}, nil
+	}
+	public, err := strconv.ParseBool(value)
+	if err != nil {
+		return sql.NullBool{}, err
+	}
+	return sql.NullBool{Bool: public, Valid: true}, nil
+}
+
+func SetItemVisibility(itemId int, visibility sql.NullBool) error {
+	_, err := database.Db.Exec("UPDATE `Items` SET `isPublic` = ? WHERE `id` = ?;", visibility, itemId)
+	return err
 }
 
-func MakeAssetPrivate(itemId int) error {
-       _, err := database.Db.Exec("UPDATE `Items` SET `isPublic` = b'0' WHERE `id` = ?;", itemId)
-       return err;
+func SetFolderVisibility(folderId int, visibility sql.NullBool) error {
+	_, err := database.Db.Exec("UPDATE `Folders` SET `isPublic` = ? WHERE `id` = ?;", visibility, folderId)
+	return err
+}
+
+// handles POST /changeVisibility?itemId=&public=, public is true, false or inherit
+func HandleChangeItemVisibility(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := authentication.AuthCheck(w, r)
+	if claims == nil {
+		return
+	}
+	if !authentication.RequireScope(w, r, claims, authentication.ScopeManage) {
+		return
+	}
+	itemId, err := strconv.Atoi(r.URL.Query().Get("itemId"))
+	if err != nil {
+		http.Error(w, "itemId missing or invalid", http.StatusBadRequest)
+		return
+	}
+	visibility, err := parseVisibility(r.URL.Query().Get("public"))
+	if err != nil {
+		http.Error(w, "visibility is missing or invalid (Can be 1/0, true/false etc. or inherit)", http.StatusBadRequest)
+		return
+	}
+	if allowed, err := authorization.Can(claims.UID, authorization.EndpointAction("POST /changeVisibility"), authorization.Item(itemId)); err != nil || !allowed {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if err := SetItemVisibility(itemId, visibility); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		fmt.Println("[INVENTORY] ", err)
+		return
+	}
+	fmt.Println("[INVENTORY]", claims.Username, "changed visibility of item ID:", itemId, "to", r.URL.Query().Get("public"))
+	reply.Success(w, r, "Visibility changed")
 }
-func HandleChangeItemVisibility(w http.ResponseWriter, r *http.Request){
-       if r.Method != http.MethodPost {
-               http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
-               return
-       }
-       auth := r.URL.Query().Get("auth")
-       claims, err := authentication.ParseToken(auth)
-       if err != nil {
-               http.Error(w, "Auth token missing or invalid", http.StatusUnauthorized)
-       }
-       itemId, err := strconv.Atoi(r.URL.Query().Get("itemId"))
-       if err != nil {
-               http.Error(w, "itemId missing or invalid", http.StatusBadRequest)
-               return
-       }
-       visibility, err:= strconv.ParseBool(r.URL.Query().Get("public"))
-       if err != nil{
-               http.Error(w, "visibility is missing or invalid (Can be 1/0, true/false etc.)", http.StatusBadRequest)
-               return
-       }
-       var folderId int
-       database.Db.QueryRow("SELECT folder_id FROM Items WHERE id = ?", itemId).Scan(&folderId)
-       if allowed, err := query.IsFolderOwner(folderId, claims.UID); err != nil || !allowed {
-               http.Error(w, "Forbidden", http.StatusForbidden)
-               return
-       }
-       if visibility{
-               err = MakeAssetPublic(itemId)
-       }else{
-               err = MakeAssetPrivate(itemId)
-       }
-       if err != nil {
-               http.Error(w, "Internal server error", http.StatusInternalServerError)
-	       fmt.Println("[INVENTORY] ", err)
-               return
-       }
+
+// handles POST /changeFolderVisibility?folderId=&public= and /changeInventoryVisibility?inventoryId=&public=.
+// Subfolders and items without a visibility of their own follow the folder, a whole inventory is
+// made public through its root folder.
+func handleChangeFolderVisibility(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := authentication.AuthCheck(w, r)
+	if claims == nil {
+		return
+	}
+	if !authentication.RequireScope(w, r, claims, authentication.ScopeManage) {
+		return
+	}
+	visibility, err := parseVisibility(r.URL.Query().Get("public"))
+	if err != nil {
+		reply.Error(w, r, "public is missing or invalid (Can be 1/0, true/false etc. or inherit)", http.StatusBadRequest)
+		return
+	}
+	var resource authorization.Resource
+	var folderId int
+	endpoint := "POST /changeFolderVisibility"
+	if param := r.URL.Query().Get("inventoryId"); param != "" {
+		endpoint = "POST /changeInventoryVisibility"
+		inventoryId, err := strconv.Atoi(param)
+		if err != nil {
+			reply.Error(w, r, "inventoryId is invalid", http.StatusBadRequest)
+			return
+		}
+		resource = authorization.Inventory(inventoryId)
+		err = database.Db.QueryRow("SELECT id FROM Folders WHERE `inventory_id` = ? AND parent_folder_id = -1", inventoryId).Scan(&folderId)
+		if err == sql.ErrNoRows {
+			reply.Error(w, r, "Forbidden", http.StatusForbidden)
+			return
+		} else if err != nil {
+			reply.Error(w, r, "Internal server error", http.StatusInternalServerError)
+			fmt.Println("[INVENTORY] ", err)
+			return
+		}
+	} else {
+		folderId, err = strconv.Atoi(r.URL.Query().Get("folderId"))
+		if err != nil {
+			reply.Error(w, r, "folderId missing or invalid", http.StatusBadRequest)
+			return
+		}
+		resource = authorization.Folder(folderId)
+	}
+	if allowed, err := authorization.Can(claims.UID, authorization.EndpointAction(endpoint), resource); err != nil || !allowed {
+		reply.Error(w, r, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if err := SetFolderVisibility(folderId, visibility); err != nil {
+		reply.Error(w, r, "Internal server error", http.StatusInternalServerError)
+		fmt.Println("[INVENTORY] ", err)
+		return
+	}
+	fmt.Println("[INVENTORY]", claims.Username, "changed visibility of", resource, "to", r.URL.Query().Get("public"))
+	reply.Success(w, r, "Visibility changed")
 }
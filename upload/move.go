@@ -0,0 +1,228 @@
+package upload
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"resonite-file-provider/authentication"
+	"resonite-file-provider/authorization"
+	"resonite-file-provider/database"
+	"resonite-file-provider/reply"
+	"strconv"
+	"strings"
+)
+
+var (
+	errMoveIntoItself = errors.New("a folder can't be moved into itself or one of its subfolders")
+	errMoveRoot       = errors.New("the root folder of an inventory can't be moved")
+	errMoveInbox      = errors.New("the inbox folder can't be moved")
+)
+
+// MoveItem puts the item into another folder, possibly in another inventory. An item moved out of
+// an inbox counts as accepted.
+func MoveItem(itemId int, folderId int) error {
+	tx, err := database.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec("UPDATE Items SET folder_id = ? WHERE id = ?", folderId, itemId)
+	if err != nil {
+		return err
+	}
+	// MySQL doesn't count an item that already is in the folder, then there is nothing to do
+	if affected, err := result.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		var exists bool
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM Items WHERE id = ?)", itemId).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return errNotFound
+		}
+		return nil
+	}
+	if _, err := tx.Exec("DELETE FROM Deliveries WHERE item_id = ?", itemId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// MoveFolder moves the folder with everything below it into the target folder. When the target is in
+// another inventory every folder of the subtree moves along, all in one transaction. Share links into the
+// subtree are revoked then, they were handed out by the old inventory and its new owners never agreed to them.
+func MoveFolder(folderId int, targetId int) error {
+	tx, err := database.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var parentId, inventoryId int
+	var inbox bool
+	err = tx.QueryRow("SELECT parent_folder_id, inventory_id, isInbox = 1 FROM Folders WHERE id = ? FOR UPDATE", folderId).Scan(&parentId, &inventoryId, &inbox)
+	if err == sql.ErrNoRows {
+		return errNotFound
+	} else if err != nil {
+		return err
+	}
+	if parentId == -1 {
+		return errMoveRoot
+	}
+	if inbox {
+		return errMoveInbox
+	}
+	var targetInventoryId int
+	err = tx.QueryRow("SELECT inventory_id FROM Folders WHERE id = ? FOR UPDATE", targetId).Scan(&targetInventoryId)
+	if err == sql.ErrNoRows {
+		return errNotFound
+	} else if err != nil {
+		return err
+	}
+	// Walking up from the target must never pass the folder, otherwise it would end up inside itself
+	err = authorization.WalkAncestors(targetId, func(current int) (int, bool, error) {
+		if current == folderId {
+			return -1, false, errMoveIntoItself
+		}
+		var parentId int
+		err := tx.QueryRow("SELECT parent_folder_id FROM Folders WHERE id = ? FOR UPDATE", current).Scan(&parentId)
+		return parentId, err == nil, err
+	})
+	if err == authorization.ErrFolderChainTooDeep {
+		return errMoveIntoItself
+	} else if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE Folders SET parent_folder_id = ? WHERE id = ?", targetId, folderId); err != nil {
+		return err
+	}
+	if targetInventoryId != inventoryId {
+		subtree, err := subtreeFolders(tx, folderId)
+		if err != nil {
+			return err
+		}
+		for _, id := range subtree {
+			if _, err := tx.Exec("UPDATE Folders SET inventory_id = ? WHERE id = ?", targetInventoryId, id); err != nil {
+				return err
+			}
+			if _, err := tx.Exec("UPDATE ShareLinks SET revoked = b'1' WHERE folder_id = ?", id); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// subtreeFolders returns the folder and all folders below it
+func subtreeFolders(tx *sql.Tx, folderId int) ([]int, error) {
+	subtree := []int{folderId}
+	for i := 0; i < len(subtree); i++ {
+		rows, err := tx.Query("SELECT id FROM Folders WHERE parent_folder_id = ? FOR UPDATE", subtree[i])
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			subtree = append(subtree, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return subtree, nil
+}
+
+// moveRequest reads the parameters of the move endpoints and checks the user may take the source
+// out of its folder and put it into the target folder
+func moveRequest(w http.ResponseWriter, r *http.Request, endpoint string, param string, resource func(int) authorization.Resource) (int, int, *authentication.Claims, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return -1, -1, nil, false
+	}
+	claims := authentication.AuthCheck(w, r)
+	if claims == nil {
+		return -1, -1, nil, false
+	}
+	if !authentication.RequireScope(w, r, claims, authentication.ScopeUpload) {
+		return -1, -1, nil, false
+	}
+	sourceId, err := strconv.Atoi(r.URL.Query().Get(param))
+	if err != nil {
+		reply.Error(w, r, param+" missing or invalid", http.StatusBadRequest)
+		return -1, -1, nil, false
+	}
+	targetId, err := strconv.Atoi(r.URL.Query().Get("targetFolderId"))
+	if err != nil {
+		reply.Error(w, r, "targetFolderId missing or invalid", http.StatusBadRequest)
+		return -1, -1, nil, false
+	}
+	if allowed, err := authorization.Can(claims.UID, authorization.EndpointAction(endpoint), resource(sourceId)); err != nil || !allowed {
+		reply.Error(w, r, "Forbidden", http.StatusForbidden)
+		return -1, -1, nil, false
+	}
+	if allowed, err := authorization.Can(claims.UID, authorization.EndpointAction(endpoint+" target"), authorization.Folder(targetId)); err != nil || !allowed {
+		reply.Error(w, r, "You can't add to the target folder", http.StatusForbidden)
+		return -1, -1, nil, false
+	}
+	return sourceId, targetId, claims, true
+}
+
+func writeMoved(w http.ResponseWriter, r *http.Request, targetId int) {
+	if strings.HasPrefix(r.UserAgent(), "Resonite") {
+		w.Write([]byte("Moved"))
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":        true,
+			"targetFolderId": targetId,
+		})
+	}
+}
+
+// handles POST /moveItem?itemId=&targetFolderId=
+func handleMoveItem(w http.ResponseWriter, r *http.Request) {
+	itemId, targetId, claims, ok := moveRequest(w, r, "POST /moveItem", "itemId", authorization.Item)
+	if !ok {
+		return
+	}
+	err := MoveItem(itemId, targetId)
+	if err == errNotFound {
+		reply.Error(w, r, "Forbidden", http.StatusForbidden)
+		return
+	} else if err != nil {
+		reply.Error(w, r, "Internal server error", http.StatusInternalServerError)
+		fmt.Println("[MOVE] Failed to move item:", err)
+		return
+	}
+	fmt.Println("[MOVE]", claims.Username, "moved item ID:", itemId, "to folder ID:", targetId)
+	writeMoved(w, r, targetId)
+}
+
+// handles POST /moveFolder?folderId=&targetFolderId=
+func handleMoveFolder(w http.ResponseWriter, r *http.Request) {
+	folderId, targetId, claims, ok := moveRequest(w, r, "POST /moveFolder", "folderId", authorization.Folder)
+	if !ok {
+		return
+	}
+	err := MoveFolder(folderId, targetId)
+	if err == errMoveIntoItself || err == errMoveRoot || err == errMoveInbox {
+		reply.Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	} else if err == errNotFound {
+		reply.Error(w, r, "Forbidden", http.StatusForbidden)
+		return
+	} else if err != nil {
+		reply.Error(w, r, "Internal server error", http.StatusInternalServerError)
+		fmt.Println("[MOVE] Failed to move folder:", err)
+		return
+	}
+	fmt.Println("[MOVE]", claims.Username, "moved folder ID:", folderId, "to folder ID:", targetId)
+	writeMoved(w, r, targetId)
+}
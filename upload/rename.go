@@ -0,0 +1,122 @@
+package upload
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"resonite-file-provider/authentication"
+	"resonite-file-provider/authorization"
+	"resonite-file-provider/database"
+	"resonite-file-provider/reply"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const maxNameLength = 128
+
+var errNotFound = errors.New("not found")
+
+// ValidateName trims a new item, folder or inventory name and checks it isn't empty,
+// too long or hiding control characters
+func ValidateName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", errors.New("name must not be empty")
+	}
+	if utf8.RuneCountInString(name) > maxNameLength {
+		return "", fmt.Errorf("name must be at most %d characters long", maxNameLength)
+	}
+	for _, c := range name {
+		if unicode.IsControl(c) {
+			return "", errors.New("name must not contain control characters")
+		}
+	}
+	return name, nil
+}
+
+// rename sets the name column of the row, errNotFound when there is no such row
+func rename(table string, id int, name string) error {
+	result, err := database.Db.Exec("UPDATE `"+table+"` SET `name` = ? WHERE `id` = ?", name, id)
+	if err != nil {
+		return err
+	}
+	// MySQL doesn't count rows that already had the name, so check whether the row exists
+	if affected, err := result.RowsAffected(); err != nil || affected > 0 {
+		return err
+	}
+	var exists bool
+	if err := database.Db.QueryRow("SELECT EXISTS(SELECT 1 FROM `"+table+"` WHERE `id` = ?)", id).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return errNotFound
+	}
+	return nil
+}
+
+func RenameItem(itemId int, name string) error {
+	return rename("Items", itemId, name)
+}
+
+func RenameFolder(folderId int, name string) error {
+	return rename("Folders", folderId, name)
+}
+
+func RenameInventory(inventoryId int, name string) error {
+	return rename("Inventories", inventoryId, name)
+}
+
+// renameHandler builds the handlers of POST /renameItem?itemId=&name=, /renameFolder?folderId=&name=
+// and /renameInventory?inventoryId=&name=, which only differ in what they rename and the scope it takes
+func renameHandler(endpoint string, param string, resource func(int) authorization.Resource, scope string, renameFunc func(int, string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+		claims := authentication.AuthCheck(w, r)
+		if claims == nil {
+			return
+		}
+		if !authentication.RequireScope(w, r, claims, scope) {
+			return
+		}
+		id, err := strconv.Atoi(r.URL.Query().Get(param))
+		if err != nil {
+			reply.Error(w, r, param+" missing or invalid", http.StatusBadRequest)
+			return
+		}
+		name, err := ValidateName(r.URL.Query().Get("name"))
+		if err != nil {
+			reply.Error(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		target := resource(id)
+		if allowed, err := authorization.Can(claims.UID, authorization.EndpointAction(endpoint), target); err != nil || !allowed {
+			reply.Error(w, r, "Forbidden", http.StatusForbidden)
+			return
+		}
+		err = renameFunc(id, name)
+		if err == errNotFound {
+			reply.Error(w, r, "Forbidden", http.StatusForbidden)
+			return
+		} else if err != nil {
+			reply.Error(w, r, "Internal server error", http.StatusInternalServerError)
+			fmt.Println("[RENAME] Failed to rename", target, err)
+			return
+		}
+		fmt.Println("[RENAME]", claims.Username, "renamed", target, "to", name)
+		if strings.HasPrefix(r.UserAgent(), "Resonite") {
+			w.Write([]byte(name))
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": true,
+				"name":    name,
+			})
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package upload
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"resonite-file-provider/authentication"
+	"resonite-file-provider/authorization"
+	"resonite-file-provider/database"
+	"resonite-file-provider/reply"
+	"strconv"
+)
+
+var errLastOwner = errors.New("an inventory needs at least one owner")
+
+// ownerCount counts the users and groups owning the inventory, locking their rows until the transaction ends
+func ownerCount(tx *sql.Tx, inventoryId int) (int, error) {
+	count := 0
+	for _, table := range []string{"users_inventories", "groups_inventories"} {
+		rows, err := tx.Query("SELECT id FROM "+table+" WHERE inventory_id = ? AND role = ? FOR UPDATE", inventoryId, authorization.RoleOwner)
+		if err != nil {
+			return 0, err
+		}
+		for rows.Next() {
+			count++
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+	}
+	return count, nil
+}
+
+// ShareInventory adds the user to the inventory with the given role, or changes the role of an existing member
+func ShareInventory(inventoryId int, userId int, role string) error {
+	tx, err := database.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	owners, err := ownerCount(tx, inventoryId)
+	if err != nil {
+		return err
+	}
+	current, err := memberRole(tx, inventoryId, userId)
+	if err != nil {
+		return err
+	}
+	if current == authorization.RoleOwner && role != authorization.RoleOwner && owners <= 1 {
+		return errLastOwner
+	}
+	if current == "" {
+		_, err = tx.Exec("INSERT INTO users_inventories (user_id, inventory_id, role) VALUES (?, ?, ?)", userId, inventoryId, role)
+	} else {
+		_, err = tx.Exec("UPDATE users_inventories SET role = ? WHERE user_id = ? AND inventory_id = ?", role, userId, inventoryId)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UnshareInventory removes the user from the inventory, the last owner can't be removed
+func UnshareInventory(inventoryId int, userId int) error {
+	tx, err := database.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	owners, err := ownerCount(tx, inventoryId)
+	if err != nil {
+		return err
+	}
+	current, err := memberRole(tx, inventoryId, userId)
+	if err != nil {
+		return err
+	}
+	if current == authorization.RoleOwner && owners <= 1 {
+		return errLastOwner
+	}
+	if _, err := tx.Exec("DELETE FROM users_inventories WHERE user_id = ? AND inventory_id = ?", userId, inventoryId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func memberRole(tx *sql.Tx, inventoryId int, userId int) (string, error) {
+	var role string
+	err := tx.QueryRow("SELECT role FROM users_inventories WHERE inventory_id = ? AND user_id = ? FOR UPDATE", inventoryId, userId).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+// shareTarget reads the inventoryId and username parameters shared by both endpoints
+func shareTarget(w http.ResponseWriter, r *http.Request) (int, int, string, bool) {
+	inventoryId, err := strconv.Atoi(r.URL.Query().Get("inventoryId"))
+	if err != nil {
+		reply.Error(w, r, "inventoryId missing or invalid", http.StatusBadRequest)
+		return -1, -1, "", false
+	}
+	username := r.URL.Query().Get("username")
+	if username == "" {
+		reply.Error(w, r, "username missing", http.StatusBadRequest)
+		return -1, -1, "", false
+	}
+	var userId int
+	err = database.Db.QueryRow("SELECT id, username FROM Users WHERE username = ?", username).Scan(&userId, &username)
+	if err == sql.ErrNoRows {
+		reply.Error(w, r, "User not found", http.StatusNotFound)
+		return -1, -1, "", false
+	} else if err != nil {
+		reply.Error(w, r, "Server error", http.StatusInternalServerError)
+		fmt.Println("[SHARE] Query error:", err)
+		return -1, -1, "", false
+	}
+	return inventoryId, userId, username, true
+}
+
+// handles POST /shareInventory?inventoryId=&username=&role=, role defaults to viewer
+func handleShareInventory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := authentication.AuthCheck(w, r)
+	if claims == nil {
+		return
+	}
+	if !authentication.RequireScope(w, r, claims, authentication.ScopeManage) {
+		return
+	}
+	inventoryId, userId, username, ok := shareTarget(w, r)
+	if !ok {
+		return
+	}
+	role := r.URL.Query().Get("role")
+	if role == "" {
+		role = authorization.RoleViewer
+	}
+	if !authorization.IsValidRole(role) {
+		reply.Error(w, r, "role must be viewer, editor or owner", http.StatusBadRequest)
+		return
+	}
+	if allowed, err := authorization.Can(claims.UID, authorization.EndpointAction("POST /shareInventory"), authorization.Inventory(inventoryId)); err != nil || !allowed {
+		reply.Error(w, r, "Only owners can share an inventory", http.StatusForbidden)
+		return
+	}
+	err := ShareInventory(inventoryId, userId, role)
+	if err == errLastOwner {
+		reply.Error(w, r, "An inventory needs at least one owner", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		reply.Error(w, r, "Failed to share inventory", http.StatusInternalServerError)
+		fmt.Println("[SHARE] Failed to share inventory:", err)
+		return
+	}
+	fmt.Println("[SHARE]", claims.Username, "shared inventory ID:", inventoryId, "with", username, "as", role)
+	reply.Success(w, r, "Inventory shared")
+}
+
+// handles POST /unshareInventory?inventoryId=&username=. Owners can remove anyone,
+// every other member can only remove themselves to leave a shared inventory.
+func handleUnshareInventory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := authentication.AuthCheck(w, r)
+	if claims == nil {
+		return
+	}
+	if !authentication.RequireScope(w, r, claims, authentication.ScopeManage) {
+		return
+	}
+	inventoryId, userId, username, ok := shareTarget(w, r)
+	if !ok {
+		return
+	}
+	endpoint := "POST /unshareInventory"
+	if userId == claims.UID {
+		endpoint += " self"
+	}
+	if allowed, err := authorization.Can(claims.UID, authorization.EndpointAction(endpoint), authorization.Inventory(inventoryId)); err != nil || !allowed {
+		reply.Error(w, r, "Only owners can remove other members", http.StatusForbidden)
+		return
+	}
+	err := UnshareInventory(inventoryId, userId)
+	if err == errLastOwner {
+		reply.Error(w, r, "An inventory needs at least one owner, remove the inventory instead", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		reply.Error(w, r, "Failed to unshare inventory", http.StatusInternalServerError)
+		fmt.Println("[SHARE] Failed to unshare inventory:", err)
+		return
+	}
+	fmt.Println("[SHARE]", claims.Username, "removed", username, "from inventory ID:", inventoryId)
+	reply.Success(w, r, "Inventory unshared")
+}
@@ -12,10 +12,10 @@ import (
 	"path/filepath"
 	"regexp"
 	"resonite-file-provider/authentication"
+	"resonite-file-provider/authorization"
 	"resonite-file-provider/config"
 	"resonite-file-provider/database"
 	"resonite-file-provider/environment"
-	"resonite-file-provider/query"
 
 	"strconv"
 	"strings"
@@ -131,7 +131,10 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 		fmt.Println("[UPLOAD] Failed Auth")
 		return
 	}
-	if allowed, err := query.IsFolderOwner(folderId, claims.UID); err != nil || !allowed {
+	if !authentication.RequireScope(w, r, claims, authentication.ScopeUpload) {
+		return
+	}
+	if allowed, err := authorization.Can(claims.UID, authorization.EndpointAction("POST /upload"), authorization.Folder(folderId)); err != nil || !allowed {
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		fmt.Println("[UPLOAD] Forbidden access to folder", folderId, "for user", claims.UID)
 		return
@@ -193,7 +196,7 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 			break
 		}
 	}
-	itemInsertResult, err := database.Db.Exec("INSERT INTO `Items` (`name`, `folder_id`, `url`) VALUES (?, ?, ?)", itemName, folderId, assetFilename)
+	itemInsertResult, err := database.Db.Exec("INSERT INTO `Items` (`name`, `folder_id`, `url`, `uploaded_by`, `created_at`) VALUES (?, ?, ?, ?, UTC_TIMESTAMP())", itemName, folderId, assetFilename, claims.UID)
 	if err != nil {
 		http.Error(w, "Failed to insert item into database", http.StatusInternalServerError)
 		fmt.Println("[UPLOAD] Failed to insert item into database:", err)
@@ -305,4 +308,15 @@ func AddListeners() {
 	http.HandleFunc("/removeInventory", handleRemoveInventory)
 	http.HandleFunc("/addInventory", handleAddInventory)
 	http.HandleFunc("/changeVisibility", HandleChangeItemVisibility)
+	http.HandleFunc("/changeFolderVisibility", handleChangeFolderVisibility)
+	http.HandleFunc("/changeInventoryVisibility", handleChangeFolderVisibility)
+	http.HandleFunc("/renameItem", renameHandler("POST /renameItem", "itemId", authorization.Item, authentication.ScopeUpload, RenameItem))
+	http.HandleFunc("/renameFolder", renameHandler("POST /renameFolder", "folderId", authorization.Folder, authentication.ScopeUpload, RenameFolder))
+	http.HandleFunc("/renameInventory", renameHandler("POST /renameInventory", "inventoryId", authorization.Inventory, authentication.ScopeManage, RenameInventory))
+	http.HandleFunc("/moveItem", handleMoveItem)
+	http.HandleFunc("/moveFolder", handleMoveFolder)
+	http.HandleFunc("/shareInventory", handleShareInventory)
+	http.HandleFunc("/unshareInventory", handleUnshareInventory)
+	http.HandleFunc("/account/export", handleAccountExport)
+	http.HandleFunc("/account/delete", handleAccountDelete)
 }
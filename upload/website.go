@@ -6,10 +6,12 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"resonite-file-provider/assethost"
 	"resonite-file-provider/authentication"
+	"resonite-file-provider/authorization"
 	"resonite-file-provider/database"
-	"resonite-file-provider/query"
 	"strconv"
+	"time"
 )
 
 type PageData struct {
@@ -70,7 +72,7 @@ func handleDashboard(w http.ResponseWriter, r *http.Request) {
 					Name:     "auth_token",
 					Value:    authToken,
 					Path:     "/",
-					MaxAge:   86400, // 1 day
+					MaxAge:   int(time.Until(claims.ExpiresAt.Time).Seconds()),
 					HttpOnly: false, // Allow JavaScript access for debugging
 					SameSite: http.SameSiteLaxMode,
 				})
@@ -96,6 +98,21 @@ func handleDashboard(w http.ResponseWriter, r *http.Request) {
 		fmt.Printf("[DASHBOARD] No auth token found in request\n")
 	}
 
+	// The access token is short-lived, try to renew it with the refresh token before giving up
+	if refreshCookie, err := r.Cookie("refresh_token"); err == nil {
+		accessToken, refreshToken, claims, err := authentication.RefreshSession(refreshCookie.Value)
+		if err == nil {
+			authentication.SetAuthCookies(w, accessToken, refreshToken)
+			fmt.Printf("[DASHBOARD] Refreshed session for user %s, serving dashboard\n", claims.Username)
+			w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+			w.Header().Set("Pragma", "no-cache")
+			w.Header().Set("Expires", "0")
+			http.ServeFile(w, r, filepath.Join("upload-site", "dashboard.html"))
+			return
+		}
+		fmt.Printf("[DASHBOARD] Refresh failed: %v\n", err)
+	}
+
 	// No valid token, redirect to login
 	fmt.Printf("[DASHBOARD] Redirecting to login page\n")
 	http.Redirect(w, r, "/login", http.StatusFound)
@@ -146,24 +163,35 @@ func handleFolder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check folder ownership
-	if allowed, err := query.IsFolderOwner(folderId, claims.UID); !allowed || err != nil {
+	// Check folder access
+	if allowed, err := authorization.Can(claims.UID, authorization.EndpointAction("GET /folder"), authorization.Folder(folderId)); !allowed || err != nil {
 		http.Error(w, "You don't have access to this folder", http.StatusForbidden)
 		return
 	}
 
+	// Visitors of a public folder who aren't members of its inventory don't see what was made private
+	role, err := authorization.Role(claims.UID, authorization.Folder(folderId))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	publicOnly := role == ""
+
 	// Get folder contents
-	childFolders, err := getFolders(folderId, authToken)
+	childFolders, err := getFolders(folderId, publicOnly)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	items, err := getItems(folderId, authToken)
+	items, err := getItems(folderId, publicOnly)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	for i := range items {
+		items[i].URL = assethost.SignedURL(claims.UID, filepath.Base(items[i].URL))
+	}
 
 	// Get breadcrumb path
 	path, err := getBreadcrumbPath(folderId)
@@ -192,9 +220,13 @@ func handleFolder(w http.ResponseWriter, r *http.Request) {
 	tmpl.Execute(w, data)
 }
 
-func getFolders(folderId int, authToken string) ([]Folder, error) {
+func getFolders(folderId int, publicOnly bool) ([]Folder, error) {
 	// Query database for child folders
-	childFolders, err := database.Db.Query("SELECT id, name FROM Folders WHERE parent_folder_id = ?", folderId)
+	statement := "SELECT id, name FROM Folders WHERE parent_folder_id = ?"
+	if publicOnly {
+		statement += " AND (isPublic IS NULL OR isPublic = 1)"
+	}
+	childFolders, err := database.Db.Query(statement, folderId)
 	if err != nil {
 		return nil, err
 	}
@@ -212,9 +244,13 @@ func getFolders(folderId int, authToken string) ([]Folder, error) {
 	return folders, nil
 }
 
-func getItems(folderId int, authToken string) ([]Item, error) {
+func getItems(folderId int, publicOnly bool) ([]Item, error) {
 	// Query database for items in folder
-	items, err := database.Db.Query("SELECT id, name, url FROM Items WHERE folder_id = ?", folderId)
+	statement := "SELECT id, name, url FROM Items WHERE folder_id = ?"
+	if publicOnly {
+		statement += " AND (isPublic IS NULL OR isPublic = 1)"
+	}
+	items, err := database.Db.Query(statement, folderId)
 	if err != nil {
 		return nil, err
 	}
@@ -265,6 +301,21 @@ func getBreadcrumbPath(folderId int) ([]Breadcrumb, error) {
 }
 
 func handleLogout(w http.ResponseWriter, r *http.Request) {
+	// Revoke the session server-side so the token stops working everywhere. The access token may
+	// already have expired, or its cookie be gone, then the refresh token still names the session.
+	var sessionId string
+	if authCookie, err := r.Cookie("auth_token"); err == nil {
+		sessionId, _ = authentication.SessionOf(authCookie.Value)
+	}
+	if refreshCookie, err := r.Cookie("refresh_token"); err == nil && sessionId == "" {
+		sessionId, _ = authentication.RefreshTokenSession(refreshCookie.Value)
+	}
+	if sessionId != "" {
+		if err := authentication.RevokeSession(sessionId); err != nil {
+			fmt.Printf("[LOGOUT] Failed to revoke session: %v\n", err)
+		}
+	}
+
 	// Clear auth cookie if present
 	http.SetCookie(w, &http.Cookie{
 		Name:   "auth_token",
@@ -272,6 +323,12 @@ func handleLogout(w http.ResponseWriter, r *http.Request) {
 		Path:   "/",
 		MaxAge: -1,
 	})
+	http.SetCookie(w, &http.Cookie{
+		Name:   "refresh_token",
+		Value:  "",
+		Path:   "/",
+		MaxAge: -1,
+	})
 
 	// Redirect to login page
 	http.Redirect(w, r, "/login", http.StatusFound)